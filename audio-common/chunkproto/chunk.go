@@ -0,0 +1,70 @@
+// Package chunkproto is the chunk schema and /stream wire format shared by
+// audio-source and audio-relay: chunk fields, binary frames and records,
+// payload encodings, named events and stream resumption.
+package chunkproto
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Version identifies the chunk schema: the JSON fields of Header and the
+// binary frame layout in frame.go, whose version byte carries the same
+// number. Consumers such as the relay adapt older versions and reject newer
+// ones.
+//
+//	1  the original fields; no protocol_version, event ID only in the SSE id
+//	   and the 60-byte frame header
+//	2  protocol_version and event_id in every chunk; frame version 2
+const Version = 2
+
+// Header holds the fields every chunk carries alongside its audio. Services
+// embed it in their own chunk types, which add the audio and any fields of
+// their own.
+type Header struct {
+	ProtocolVersion int            `json:"protocol_version"`
+	IntervalID      string         `json:"interval_id"`
+	LoopCount       int            `json:"loop_count"`
+	Position        int            `json:"position"`
+	TotalChunks     int            `json:"total_chunks"`
+	Timestamp       int64          `json:"timestamp"`
+	EventID         int64          `json:"event_id"` // increasing across loops and switches, as in the SSE id
+	SampleRate      int            `json:"sample_rate"`
+	Channels        int            `json:"channels"`
+	SampleWidth     int            `json:"sample_width"`
+	AudioFormat     map[string]int `json:"audio_format"`
+}
+
+// CheckVersion rejects chunk schema versions newer than Version. Zero means
+// the field is missing, as from version 1 sources.
+func CheckVersion(version int) error {
+	if version < 0 || version > Version {
+		return fmt.Errorf("unsupported chunk protocol version %d (supported up to %d)", version, Version)
+	}
+	return nil
+}
+
+// EncodeAudio returns chunk audio as text in the given encoding, and the
+// audio_encoding value naming it, which is empty for hex
+func EncodeAudio(raw []byte, encoding string) (string, string) {
+	if encoding == EncodingBase64 {
+		return base64.StdEncoding.EncodeToString(raw), EncodingBase64
+	}
+	return hex.EncodeToString(raw), ""
+}
+
+// DecodeAudio decodes hex or base64 chunk audio
+func DecodeAudio(text, encoding string) ([]byte, error) {
+	var raw []byte
+	var err error
+	if encoding == EncodingBase64 {
+		raw, err = base64.StdEncoding.DecodeString(text)
+	} else {
+		raw, err = hex.DecodeString(text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode chunk audio: %w", err)
+	}
+	return raw, nil
+}
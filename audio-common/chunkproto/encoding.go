@@ -0,0 +1,84 @@
+package chunkproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Chunk payload encodings negotiated by /stream clients
+const (
+	EncodingHex    = "hex"
+	EncodingBase64 = "base64"
+	EncodingBinary = "binary"
+)
+
+// StreamContentType identifies the length-prefixed binary stream
+const StreamContentType = "application/x-audio-chunks"
+
+// Binary stream record kinds. Each record is a little-endian u32 length,
+// counting the kind byte and payload, then the kind and the payload.
+const (
+	RecordJSON  = 1 // a JSON message; on the relay it precedes each chunk with its metadata
+	RecordChunk = 2 // a binary chunk frame
+
+	MaxRecordSize = 16 << 20
+)
+
+// ParseEncoding picks the payload encoding from an encoding query value,
+// falling back to the Accept header and then to hex
+func ParseEncoding(query, accept string) (string, error) {
+	switch strings.ToLower(query) {
+	case EncodingHex, EncodingBase64, EncodingBinary:
+		return strings.ToLower(query), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", query)
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case StreamContentType, "application/octet-stream":
+			return EncodingBinary, nil
+		}
+	}
+	return EncodingHex, nil
+}
+
+// WriteRecord writes one record of a binary chunk stream
+func WriteRecord(w io.Writer, kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = kind
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	return nil
+}
+
+// ReadRecord reads one record of a binary chunk stream, returning io.EOF
+// when the stream ends between records
+func ReadRecord(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	if length == 0 || length > MaxRecordSize {
+		return 0, nil, fmt.Errorf("invalid record length %d", length)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return record[0], record[1:], nil
+}
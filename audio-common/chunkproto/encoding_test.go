@@ -0,0 +1,89 @@
+package chunkproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestParseEncoding(t *testing.T) {
+	cases := []struct {
+		query, accept string
+		want          string
+		ok            bool
+	}{
+		{"", "", EncodingHex, true},
+		{"HEX", "", EncodingHex, true},
+		{"base64", StreamContentType, EncodingBase64, true},
+		{"binary", "", EncodingBinary, true},
+		{"", "text/event-stream", EncodingHex, true},
+		{"", "text/event-stream, " + StreamContentType + ";q=0.9", EncodingBinary, true},
+		{"", "application/octet-stream", EncodingBinary, true},
+		{"", "not a media type;;, text/plain", EncodingHex, true},
+		{"opus", "", "", false},
+	}
+	for _, tc := range cases {
+		got, err := ParseEncoding(tc.query, tc.accept)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseEncoding(%q, %q) = %q, %v; want %q", tc.query, tc.accept, got, err, tc.want)
+		}
+	}
+}
+
+func TestAudioRoundTrip(t *testing.T) {
+	raw := []byte{0x00, 0x7f, 0x80, 0xff, 0x12}
+	for _, encoding := range []string{EncodingHex, EncodingBase64} {
+		text, name := EncodeAudio(raw, encoding)
+		if (name == "") != (encoding == EncodingHex) {
+			t.Errorf("%s: audio_encoding %q", encoding, name)
+		}
+		got, err := DecodeAudio(text, name)
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("%s: decoded %v, %v; want %v", encoding, got, err, raw)
+		}
+	}
+	if _, err := DecodeAudio("zz", ""); err == nil {
+		t.Error("decoded invalid hex")
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	frame := EncodeFrame(testHeader(), []byte{1, 2, 3, 4})
+	if err := WriteRecord(&stream, RecordJSON, []byte(`{"event":"state"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteRecord(&stream, RecordChunk, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	kind, payload, err := ReadRecord(&stream)
+	if err != nil || kind != RecordJSON || string(payload) != `{"event":"state"}` {
+		t.Errorf("first record %d %q, %v", kind, payload, err)
+	}
+	kind, payload, err = ReadRecord(&stream)
+	if err != nil || kind != RecordChunk || !bytes.Equal(payload, frame) {
+		t.Errorf("second record %d %v, %v", kind, payload, err)
+	}
+	if _, _, err := ReadRecord(&stream); err != io.EOF {
+		t.Errorf("end of stream gave %v, want EOF", err)
+	}
+}
+
+func TestReadRecordErrors(t *testing.T) {
+	var whole bytes.Buffer
+	WriteRecord(&whole, RecordChunk, []byte{1, 2, 3})
+	oversized := binary.LittleEndian.AppendUint32(nil, MaxRecordSize+1)
+
+	for name, stream := range map[string][]byte{
+		"truncated length":  whole.Bytes()[:2],
+		"truncated payload": whole.Bytes()[:whole.Len()-1],
+		"zero length":       {0, 0, 0, 0},
+		"oversized":         oversized,
+	} {
+		if _, _, err := ReadRecord(bytes.NewReader(stream)); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", name, err)
+		}
+	}
+}
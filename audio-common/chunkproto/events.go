@@ -0,0 +1,46 @@
+package chunkproto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Named /stream events. Chunks carry audio; the others are notifications
+// with a JSON object payload.
+const (
+	EventChunk     = "chunk"
+	EventState     = "state"     // full state, sent on connect
+	EventSwitch    = "switch"    // full state after a file or generator switch
+	EventLoop      = "loop"      // a new loop of the current audio has started
+	EventHeartbeat = "heartbeat" // sent periodically so idle clients can tell the stream is alive
+	EventError     = "error"     // a problem with this client's stream
+)
+
+// HeartbeatInterval is how often /stream sends a heartbeat event
+const HeartbeatInterval = 5 * time.Second
+
+// WriteEvent writes a notification. SSE clients get a named event; binary
+// streams get a JSON record whose "event" field names it.
+func WriteEvent(w io.Writer, encoding, event string, data map[string]interface{}) error {
+	if encoding == EncodingBinary {
+		msg := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			msg[k] = v
+		}
+		msg["event"] = event
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return WriteRecord(w, RecordJSON, payload)
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
@@ -0,0 +1,39 @@
+package chunkproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteEvent(t *testing.T) {
+	data := map[string]interface{}{"loop_count": 2}
+
+	var sse bytes.Buffer
+	if err := WriteEvent(&sse, EncodingHex, EventLoop, data); err != nil {
+		t.Fatal(err)
+	}
+	if want := "event: loop\ndata: {\"loop_count\":2}\n\n"; sse.String() != want {
+		t.Errorf("SSE event %q, want %q", sse.String(), want)
+	}
+
+	// Binary streams name the event inside a JSON record, without changing data
+	var binary bytes.Buffer
+	if err := WriteEvent(&binary, EncodingBinary, EventLoop, data); err != nil {
+		t.Fatal(err)
+	}
+	kind, payload, err := ReadRecord(&binary)
+	if err != nil || kind != RecordJSON {
+		t.Fatalf("record %d, %v", kind, err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["event"] != EventLoop || msg["loop_count"] != float64(2) {
+		t.Errorf("binary event %v", msg)
+	}
+	if _, ok := data["event"]; ok {
+		t.Error("WriteEvent modified its data")
+	}
+}
@@ -0,0 +1,102 @@
+package chunkproto
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Binary chunk frames carry raw audio behind a fixed little-endian header:
+//
+//	0  u8   version, Version
+//	1  u8   header length, so newer fields can be skipped
+//	2  u16  format tag of the payload
+//	4  u32  loop count
+//	8  u32  position
+//	12 u32  total chunks
+//	16 i64  timestamp, Unix ms
+//	24 u32  sample rate
+//	28 u16  channels
+//	30 u16  bits per sample
+//	32 u16  block align
+//	34 u16  valid bits
+//	36 [16] interval ID (UUID bytes)
+//	52 i64  event ID, as in the SSE id field
+//	60      audio
+//
+// Readers skip to the header length, so frames from before the event ID was
+// added (52-byte headers) and later extensions still parse.
+const (
+	FrameMinHeader  = 52
+	FrameHeaderSize = 60
+)
+
+// EncodeFrame encodes a chunk as a frame header followed by its raw audio
+func EncodeFrame(h Header, audio []byte) []byte {
+	le := binary.LittleEndian
+	frame := make([]byte, FrameHeaderSize, FrameHeaderSize+len(audio))
+	frame[0] = Version
+	frame[1] = FrameHeaderSize
+	le.PutUint16(frame[2:], uint16(h.AudioFormat["format_tag"]))
+	le.PutUint32(frame[4:], uint32(h.LoopCount))
+	le.PutUint32(frame[8:], uint32(h.Position))
+	le.PutUint32(frame[12:], uint32(h.TotalChunks))
+	le.PutUint64(frame[16:], uint64(h.Timestamp))
+	le.PutUint32(frame[24:], uint32(h.SampleRate))
+	le.PutUint16(frame[28:], uint16(h.Channels))
+	le.PutUint16(frame[30:], uint16(h.AudioFormat["bits_per_sample"]))
+	le.PutUint16(frame[32:], uint16(h.AudioFormat["block_align"]))
+	le.PutUint16(frame[34:], uint16(h.AudioFormat["valid_bits"]))
+	if id, err := hex.DecodeString(strings.ReplaceAll(h.IntervalID, "-", "")); err == nil && len(id) == 16 {
+		copy(frame[36:52], id)
+	}
+	le.PutUint64(frame[52:], uint64(h.EventID))
+	return append(frame, audio...)
+}
+
+// DecodeFrame decodes a frame into its header and audio, which shares the
+// frame's memory. The header keeps the frame's version; version 1 frames may
+// lack the event ID, which is then zero.
+func DecodeFrame(frame []byte) (Header, []byte, error) {
+	if len(frame) < 2 {
+		return Header{}, nil, fmt.Errorf("truncated chunk frame")
+	}
+	headerSize := int(frame[1])
+	if headerSize < FrameMinHeader || len(frame) < headerSize {
+		return Header{}, nil, fmt.Errorf("truncated chunk frame")
+	}
+	if frame[0] == 0 {
+		return Header{}, nil, fmt.Errorf("unsupported chunk frame")
+	}
+	if err := CheckVersion(int(frame[0])); err != nil {
+		return Header{}, nil, err
+	}
+
+	le := binary.LittleEndian
+	id := frame[36:52]
+	bitsPerSample := int(le.Uint16(frame[30:]))
+	h := Header{
+		ProtocolVersion: int(frame[0]),
+		IntervalID:      fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]),
+		LoopCount:       int(le.Uint32(frame[4:])),
+		Position:        int(le.Uint32(frame[8:])),
+		TotalChunks:     int(le.Uint32(frame[12:])),
+		Timestamp:       int64(le.Uint64(frame[16:])),
+		SampleRate:      int(le.Uint32(frame[24:])),
+		Channels:        int(le.Uint16(frame[28:])),
+		SampleWidth:     bitsPerSample / 8,
+		AudioFormat: map[string]int{
+			"channels":        int(le.Uint16(frame[28:])),
+			"sample_rate":     int(le.Uint32(frame[24:])),
+			"bits_per_sample": bitsPerSample,
+			"format_tag":      int(le.Uint16(frame[2:])),
+			"block_align":     int(le.Uint16(frame[32:])),
+			"valid_bits":      int(le.Uint16(frame[34:])),
+		},
+	}
+	if headerSize >= FrameHeaderSize {
+		h.EventID = int64(le.Uint64(frame[52:]))
+	}
+	return h, frame[headerSize:], nil
+}
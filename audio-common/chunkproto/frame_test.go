@@ -0,0 +1,102 @@
+package chunkproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testHeader is a chunk as audio-source sends it
+func testHeader() Header {
+	return Header{
+		ProtocolVersion: Version,
+		IntervalID:      "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		LoopCount:       3,
+		Position:        41,
+		TotalChunks:     600,
+		Timestamp:       1700000000123,
+		EventID:         1841,
+		SampleRate:      44100,
+		Channels:        2,
+		SampleWidth:     2,
+		AudioFormat: map[string]int{
+			"channels":        2,
+			"sample_rate":     44100,
+			"bits_per_sample": 16,
+			"format_tag":      1,
+			"block_align":     4,
+			"valid_bits":      16,
+		},
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	h := testHeader()
+	audio := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	frame := EncodeFrame(h, audio)
+	if len(frame) != FrameHeaderSize+len(audio) {
+		t.Fatalf("frame is %d bytes, want %d", len(frame), FrameHeaderSize+len(audio))
+	}
+
+	got, gotAudio, err := DecodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("decoded %+v, want %+v", got, h)
+	}
+	if !bytes.Equal(gotAudio, audio) {
+		t.Errorf("decoded audio %v, want %v", gotAudio, audio)
+	}
+}
+
+func TestDecodeFrameVersions(t *testing.T) {
+	h := testHeader()
+	audio := []byte{9, 9}
+
+	// A version 1 frame has a 52-byte header without the event ID
+	v1 := EncodeFrame(h, nil)[:FrameMinHeader]
+	v1[0], v1[1] = 1, FrameMinHeader
+	v1 = append(v1, audio...)
+	got, gotAudio, err := DecodeFrame(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ProtocolVersion != 1 || got.EventID != 0 || got.Position != h.Position || !bytes.Equal(gotAudio, audio) {
+		t.Errorf("version 1 frame decoded as %+v with audio %v", got, gotAudio)
+	}
+
+	// A longer header from a future extension is skipped
+	long := EncodeFrame(h, nil)
+	long[1] = FrameHeaderSize + 4
+	long = append(long, 0, 0, 0, 0)
+	long = append(long, audio...)
+	if _, gotAudio, err := DecodeFrame(long); err != nil || !bytes.Equal(gotAudio, audio) {
+		t.Errorf("extended header decoded audio %v, error %v", gotAudio, err)
+	}
+
+	for name, frame := range map[string][]byte{
+		"empty":           nil,
+		"short header":    EncodeFrame(h, nil)[:FrameMinHeader-1],
+		"header too long": EncodeFrame(h, nil)[:FrameHeaderSize-1],
+		"version 0":       append([]byte{0}, EncodeFrame(h, nil)[1:]...),
+		"newer version":   append([]byte{Version + 1}, EncodeFrame(h, nil)[1:]...),
+	} {
+		if _, _, err := DecodeFrame(frame); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
+
+func TestEncodeFrameIntervalID(t *testing.T) {
+	// IDs that are not UUIDs, such as the relay's RTP stream IDs, are left zero
+	h := testHeader()
+	h.IntervalID = "rtp-0000beef"
+	got, _, err := DecodeFrame(EncodeFrame(h, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "00000000-0000-0000-0000-000000000000"; got.IntervalID != want {
+		t.Errorf("interval ID %q, want %q", got.IntervalID, want)
+	}
+}
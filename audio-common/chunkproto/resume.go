@@ -0,0 +1,23 @@
+package chunkproto
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// LastEventID reads the ID a reconnecting client last saw, from the
+// Last-Event-ID header EventSource sends or a last_event_id query value
+func LastEventID(r *http.Request) (int64, bool) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,31 @@
+package chunkproto
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLastEventID(t *testing.T) {
+	cases := []struct {
+		header, query string
+		want          int64
+		ok            bool
+	}{
+		{"", "", 0, false},
+		{"42", "", 42, true},
+		{"", "7", 7, true},
+		{"42", "7", 42, true}, // EventSource's header wins
+		{"-1", "", 0, false},
+		{"abc", "", 0, false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/stream?last_event_id="+tc.query, nil)
+		if tc.header != "" {
+			r.Header.Set("Last-Event-ID", tc.header)
+		}
+		id, ok := LastEventID(r)
+		if id != tc.want || ok != tc.ok {
+			t.Errorf("header %q, query %q: got %d, %v; want %d, %v", tc.header, tc.query, id, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module audio-common
+
+go 1.21
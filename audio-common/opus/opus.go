@@ -0,0 +1,78 @@
+// Package opus holds the Opus chunk format and encoder settings shared by
+// audio-source and audio-relay. The encoder is backed by libopus when built
+// with the opus tag and cgo; other builds get a stub that returns ErrNotBuilt.
+package opus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// FormatTag is the RIFF tag ffmpeg uses for Opus. Opus chunks carry raw
+// packets (RFC 6716, TOC byte first, no Ogg framing), each preceded by its
+// length as a little-endian u16.
+const FormatTag = 0x704F
+
+// Opus settings
+const (
+	SampleRate     = 48000
+	DefaultBitrate = 64000
+	DefaultFrameMs = 20
+	MaxPacket      = 4000 // the buffer size libopus recommends for one packet
+)
+
+// ErrNotBuilt is returned by NewEncoder in builds without libopus
+var ErrNotBuilt = errors.New("opus support not built in (build with -tags opus against libopus)")
+
+// FrameSizes maps the frame_ms values Opus allows to samples per channel
+var FrameSizes = map[string]int{
+	"2.5": 120,
+	"5":   240,
+	"10":  480,
+	"20":  960,
+	"40":  1920,
+	"60":  2880,
+}
+
+// Encoder compresses fixed-size frames of interleaved 16-bit samples at
+// 48 kHz
+type Encoder interface {
+	Encode(pcm []int16, packet []byte) (int, error)
+	Lookahead() int // encoder delay in samples per channel
+	Close()
+}
+
+// Options are the per-listener encoder settings
+type Options struct {
+	Bitrate   int // bits per second
+	FrameSize int // samples per channel at 48 kHz
+}
+
+// ParseOptions reads the bitrate and frame_ms query values
+func ParseOptions(query url.Values) (Options, error) {
+	opts := Options{Bitrate: DefaultBitrate, FrameSize: SampleRate * DefaultFrameMs / 1000}
+	if v := query.Get("bitrate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 6000 || n > 510000 {
+			return opts, fmt.Errorf("invalid bitrate %q: want 6000-510000", v)
+		}
+		opts.Bitrate = n
+	}
+	if v := query.Get("frame_ms"); v != "" {
+		size, ok := FrameSizes[v]
+		if !ok {
+			return opts, fmt.Errorf("invalid frame_ms %q: want 2.5, 5, 10, 20, 40 or 60", v)
+		}
+		opts.FrameSize = size
+	}
+	return opts, nil
+}
+
+// AppendPacket appends a length-prefixed packet to a chunk payload
+func AppendPacket(payload, packet []byte) []byte {
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(len(packet)))
+	return append(payload, packet...)
+}
@@ -0,0 +1,67 @@
+//go:build opus && cgo
+
+package opus
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+// opus_encoder_ctl is variadic, so its requests are wrapped for cgo
+static int set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+}
+
+static int get_lookahead(OpusEncoder *enc, opus_int32 *lookahead) {
+	return opus_encoder_ctl(enc, OPUS_GET_LOOKAHEAD(lookahead));
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// libopusEncoder is an Encoder backed by libopus
+type libopusEncoder struct {
+	enc       *C.OpusEncoder
+	channels  int
+	lookahead int
+}
+
+// NewEncoder creates a libopus encoder for general audio at 48 kHz
+func NewEncoder(channels, bitrate int) (Encoder, error) {
+	var status C.int
+	enc := C.opus_encoder_create(SampleRate, C.int(channels), C.OPUS_APPLICATION_AUDIO, &status)
+	if status != C.OPUS_OK {
+		return nil, fmt.Errorf("failed to create opus encoder: %s", C.GoString(C.opus_strerror(status)))
+	}
+	if status = C.set_bitrate(enc, C.opus_int32(bitrate)); status != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, fmt.Errorf("failed to set opus bitrate: %s", C.GoString(C.opus_strerror(status)))
+	}
+	var lookahead C.opus_int32
+	C.get_lookahead(enc, &lookahead)
+	return &libopusEncoder{enc: enc, channels: channels, lookahead: int(lookahead)}, nil
+}
+
+// Encode compresses one frame of interleaved samples into packet
+func (e *libopusEncoder) Encode(pcm []int16, packet []byte) (int, error) {
+	n := C.opus_encode(e.enc,
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/e.channels),
+		(*C.uchar)(unsafe.Pointer(&packet[0])), C.opus_int32(len(packet)))
+	if n < 0 {
+		return 0, fmt.Errorf("%s", C.GoString(C.opus_strerror(n)))
+	}
+	return int(n), nil
+}
+
+// Lookahead returns the encoder delay in samples per channel
+func (e *libopusEncoder) Lookahead() int {
+	return e.lookahead
+}
+
+// Close frees the encoder
+func (e *libopusEncoder) Close() {
+	C.opus_encoder_destroy(e.enc)
+}
@@ -0,0 +1,79 @@
+//go:build opus && cgo
+
+package opus
+
+import (
+	"math"
+	"testing"
+)
+
+// packetDuration reads a packet's length in samples at 48 kHz from its TOC
+// byte (RFC 6716 section 3.1)
+func packetDuration(packet []byte) int {
+	config := int(packet[0] >> 3)
+	var frame int
+	switch {
+	case config < 12: // SILK: 10, 20, 40 or 60 ms
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // hybrid: 10 or 20 ms
+		frame = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10 or 20 ms
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	return int(packet[1]&0x3f) * frame
+}
+
+func TestEncoderFrameSizes(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		enc, err := NewEncoder(channels, DefaultBitrate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc.Lookahead() <= 0 {
+			t.Errorf("%d channels: lookahead %d", channels, enc.Lookahead())
+		}
+
+		packet := make([]byte, MaxPacket)
+		for name, size := range FrameSizes {
+			pcm := make([]int16, size*channels)
+			for i := range pcm {
+				pcm[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(i/channels)/SampleRate))
+			}
+			n, err := enc.Encode(pcm, packet)
+			if err != nil {
+				t.Fatalf("%d channels, %s ms: %v", channels, name, err)
+			}
+			if n < 1 || n > MaxPacket {
+				t.Fatalf("%d channels, %s ms: %d byte packet", channels, name, n)
+			}
+			if d := packetDuration(packet[:n]); d != size {
+				t.Errorf("%d channels, %s ms: packet holds %d samples, want %d", channels, name, d, size)
+			}
+			if stereo := packet[0]&4 != 0; stereo != (channels == 2) {
+				t.Errorf("%d channels, %s ms: stereo flag %v", channels, name, stereo)
+			}
+		}
+		enc.Close()
+	}
+}
+
+func TestEncoderRejectsBadArguments(t *testing.T) {
+	if _, err := NewEncoder(3, DefaultBitrate); err == nil {
+		t.Error("created a 3-channel encoder")
+	}
+	enc, err := NewEncoder(1, DefaultBitrate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	// 15 ms is not an Opus frame size
+	if _, err := enc.Encode(make([]int16, 720), make([]byte, MaxPacket)); err == nil {
+		t.Error("encoded a 15 ms frame")
+	}
+}
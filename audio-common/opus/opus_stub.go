@@ -0,0 +1,8 @@
+//go:build !opus || !cgo
+
+package opus
+
+// NewEncoder reports that this build has no Opus encoder
+func NewEncoder(channels, bitrate int) (Encoder, error) {
+	return nil, ErrNotBuilt
+}
@@ -0,0 +1,11 @@
+//go:build !opus || !cgo
+
+package opus
+
+import "testing"
+
+func TestNewEncoderNotBuilt(t *testing.T) {
+	if enc, err := NewEncoder(2, DefaultBitrate); enc != nil || err != ErrNotBuilt {
+		t.Errorf("NewEncoder = %v, %v; want ErrNotBuilt", enc, err)
+	}
+}
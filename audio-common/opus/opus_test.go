@@ -0,0 +1,39 @@
+package opus
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	cases := []struct {
+		query string
+		want  Options
+		ok    bool
+	}{
+		{"", Options{Bitrate: DefaultBitrate, FrameSize: 960}, true},
+		{"bitrate=32000&frame_ms=2.5", Options{Bitrate: 32000, FrameSize: 120}, true},
+		{"frame_ms=60", Options{Bitrate: DefaultBitrate, FrameSize: 2880}, true},
+		{"bitrate=5999", Options{}, false},
+		{"bitrate=510001", Options{}, false},
+		{"bitrate=fast", Options{}, false},
+		{"frame_ms=15", Options{}, false},
+	}
+	for _, tc := range cases {
+		query, _ := url.ParseQuery(tc.query)
+		got, err := ParseOptions(query)
+		if (err == nil) != tc.ok || (tc.ok && got != tc.want) {
+			t.Errorf("ParseOptions(%q) = %+v, %v; want %+v", tc.query, got, err, tc.want)
+		}
+	}
+}
+
+func TestAppendPacket(t *testing.T) {
+	payload := AppendPacket(nil, []byte{0xf8, 1, 2})
+	payload = AppendPacket(payload, []byte{0xfc})
+	want := []byte{3, 0, 0xf8, 1, 2, 1, 0, 0xfc}
+	if !bytes.Equal(payload, want) {
+		t.Errorf("payload %v, want %v", payload, want)
+	}
+}
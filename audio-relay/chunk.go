@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"audio-common/chunkproto"
+)
+
+// Chunk is an audio chunk in the shared chunk schema; its EventID is the
+// source's. Sources that predate the version field send version 1, which is
+// adapted on decode; newer versions are rejected. Audio is decoded once when
+// the chunk arrives; buffered chunks are shared by every client and must not
+// be modified.
+type Chunk struct {
+	chunkproto.Header
+	RTPTimestamp *uint32 `json:"rtp_timestamp,omitempty"` // chunks from the RTP ingest
+	Audio        []byte  `json:"-"`
+
+	sourceVersion int // protocol version the chunk arrived in
+}
+
+// wireChunk is a chunk as JSON, with its audio still text encoded
+type wireChunk struct {
+	Chunk
+	Audio         *string `json:"audio"`
+	AudioEncoding string  `json:"audio_encoding"`
+}
+
+// sourceMessage is one message from the source: a chunk, or a notification
+type sourceMessage struct {
+	Event string
+	Chunk *Chunk                 // for chunkproto.EventChunk
+	Data  map[string]interface{} // for the other events
+}
+
+// adapt checks a decoded chunk's version and upgrades it to the current one.
+// Version 1 chunks have the same fields apart from event_id, which the readers
+// take from the SSE id or frame header instead.
+func (c *Chunk) adapt() error {
+	if err := chunkproto.CheckVersion(c.ProtocolVersion); err != nil {
+		return err
+	}
+	c.sourceVersion = c.ProtocolVersion
+	if c.sourceVersion == 0 {
+		c.sourceVersion = 1
+	}
+	c.ProtocolVersion = chunkproto.Version
+	return nil
+}
+
+// decodeMessage decodes a JSON message from the source. Messages from sources
+// without named events are chunks when they carry audio and state otherwise.
+// A chunk without audio is the metadata record of a relay's binary stream; the
+// frame that follows is the chunk, so the message is returned without one.
+func decodeMessage(event string, payload []byte) (sourceMessage, error) {
+	if event == "message" {
+		event = ""
+	}
+	if event == "" || event == chunkproto.EventChunk {
+		var wire wireChunk
+		if err := json.Unmarshal(payload, &wire); err != nil {
+			return sourceMessage{}, fmt.Errorf("invalid chunk: %w", err)
+		}
+		if wire.Audio != nil {
+			chunk := wire.Chunk
+			if err := chunk.adapt(); err != nil {
+				return sourceMessage{}, err
+			}
+			raw, err := chunkproto.DecodeAudio(*wire.Audio, wire.AudioEncoding)
+			if err != nil {
+				return sourceMessage{}, err
+			}
+			chunk.Audio = raw
+			return sourceMessage{Event: chunkproto.EventChunk, Chunk: &chunk}, nil
+		}
+		if event == chunkproto.EventChunk {
+			return sourceMessage{Event: chunkproto.EventChunk}, nil
+		}
+		event = chunkproto.EventState
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return sourceMessage{}, fmt.Errorf("invalid %s message: %w", event, err)
+	}
+	delete(data, "event")
+	if err := chunkproto.CheckVersion(int(number(data["protocol_version"]))); err != nil {
+		return sourceMessage{}, err
+	}
+	return sourceMessage{Event: event, Data: data}, nil
+}
+
+// clientChunk is a buffered chunk as sent to one client: the shared fields
+// plus the relay's timing. The relay's event ID takes the event_id field and
+// the source's moves to source_event_id.
+type clientChunk struct {
+	*Chunk
+	Event             string                 `json:"event,omitempty"` // set in binary streams
+	EventID           int64                  `json:"event_id"`
+	SourceEventID     int64                  `json:"source_event_id"`
+	RelayID           string                 `json:"relay_id"`
+	RelayTimestamp    int64                  `json:"relay_timestamp"`
+	SourceTimestamp   int64                  `json:"source_timestamp"`
+	ConfiguredDelayMs int                    `json:"configured_delay_ms"`
+	ActualDelayMs     int64                  `json:"actual_delay_ms"`
+	BufferStats       map[string]interface{} `json:"buffer_stats"`
+	Audio             string                 `json:"audio,omitempty"` // text encoded; binary streams send a frame instead
+	AudioEncoding     string                 `json:"audio_encoding,omitempty"`
+}
+
+// encodeAudio sets the chunk's text encoded audio
+func (c *clientChunk) encodeAudio(encoding string) {
+	c.Audio, c.AudioEncoding = chunkproto.EncodeAudio(c.Chunk.Audio, encoding)
+}
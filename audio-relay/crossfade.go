@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// crossfade returns a copy of to whose audio fades in while from, the chunk
+// the listener would otherwise have heard next, fades out. The fade is equal
+// power, as the two are unrelated points in the stream. Both must be PCM in
+// the same format; otherwise ok is false and the caller jumps without a fade.
+func crossfade(from, to *Chunk) (*Chunk, bool) {
+	for _, key := range []string{"format_tag", "bits_per_sample", "channels", "sample_rate"} {
+		if from.AudioFormat[key] != to.AudioFormat[key] {
+			return nil, false
+		}
+	}
+	formatTag, bits := to.AudioFormat["format_tag"], to.AudioFormat["bits_per_sample"]
+	channels := to.AudioFormat["channels"]
+	if _, ok := flacBitsFor(formatTag, bits); !ok || channels < 1 {
+		return nil, false
+	}
+
+	width := bits / 8
+	frameSize := width * channels
+	frames := len(to.Audio) / frameSize
+	if n := len(from.Audio) / frameSize; n < frames {
+		frames = n
+	}
+	if frames == 0 {
+		return nil, false
+	}
+
+	audio := append([]byte(nil), to.Audio...)
+	for i := 0; i < frames; i++ {
+		angle := float64(i) / float64(frames) * math.Pi / 2
+		fadeIn, fadeOut := math.Sin(angle), math.Cos(angle)
+		for ch := 0; ch < channels; ch++ {
+			off := i*frameSize + ch*width
+			v := pcmSample(from.Audio[off:], formatTag, width)*fadeOut + pcmSample(to.Audio[off:], formatTag, width)*fadeIn
+			putPCMSample(audio[off:], formatTag, width, v)
+		}
+	}
+
+	out := *to
+	out.Audio = audio
+	return &out, true
+}
+
+// pcmSample reads one little-endian sample as a value in [-1, 1)
+func pcmSample(in []byte, formatTag, width int) float64 {
+	switch {
+	case formatTag == 3:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(in)))
+	case width == 1:
+		return float64(int(in[0])-128) / 128
+	case width == 2:
+		return float64(int16(binary.LittleEndian.Uint16(in))) / 32768
+	case width == 3:
+		return float64(int32(uint32(in[0])<<8|uint32(in[1])<<16|uint32(in[2])<<24)>>8) / 8388608
+	}
+	return float64(int32(binary.LittleEndian.Uint32(in))) / 2147483648
+}
+
+// putPCMSample writes v, clipped to the format's range, as one sample
+func putPCMSample(out []byte, formatTag, width int, v float64) {
+	if formatTag == 3 {
+		binary.LittleEndian.PutUint32(out, math.Float32bits(float32(math.Max(-1, math.Min(1, v)))))
+		return
+	}
+	scale := math.Ldexp(1, width*8-1)
+	n := math.Max(-scale, math.Min(scale-1, math.Round(v*scale)))
+	switch width {
+	case 1:
+		out[0] = byte(int(n) + 128)
+	case 2:
+		binary.LittleEndian.PutUint16(out, uint16(int16(n)))
+	case 3:
+		s := int32(n)
+		out[0], out[1], out[2] = byte(s), byte(s>>8), byte(s>>16)
+	default:
+		binary.LittleEndian.PutUint32(out, uint32(int32(n)))
+	}
+}
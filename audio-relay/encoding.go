@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"audio-common/chunkproto"
+)
+
+// readSSE reads "data:" messages from an SSE stream. A chunk's "id:" is its
+// source event ID, which version 1 chunks carry nowhere else.
+func readSSE(body io.Reader, handle func(sourceMessage)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), chunkproto.MaxRecordSize)
+	var eventID, eventName string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			eventID, eventName = "", ""
+			continue
+		}
+		if strings.HasPrefix(line, "id:") {
+			eventID = strings.TrimSpace(line[3:])
+			continue
+		}
+		if strings.HasPrefix(line, "event:") {
+			eventName = strings.TrimSpace(line[6:])
+			continue
+		}
+		if len(line) > 6 && line[:6] == "data: " {
+			msg, err := decodeMessage(eventName, []byte(line[6:]))
+			if err != nil {
+				return err
+			}
+			if id, err := strconv.ParseInt(eventID, 10, 64); err == nil && msg.Chunk != nil {
+				msg.Chunk.EventID = id
+			}
+			handle(msg)
+		}
+	}
+	return scanner.Err()
+}
+
+// readRecords reads a binary chunk stream, turning chunk frames into the same
+// chunks an SSE stream would carry
+func readRecords(body io.Reader, handle func(sourceMessage)) error {
+	br := bufio.NewReader(body)
+	for {
+		kind, payload, err := chunkproto.ReadRecord(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch kind {
+		case chunkproto.RecordJSON:
+			var named struct {
+				Event string `json:"event"`
+			}
+			if err := json.Unmarshal(payload, &named); err != nil {
+				return fmt.Errorf("invalid JSON record: %w", err)
+			}
+			msg, err := decodeMessage(named.Event, payload)
+			if err != nil {
+				return err
+			}
+			handle(msg)
+		case chunkproto.RecordChunk:
+			chunk, err := parseChunkFrame(payload)
+			if err != nil {
+				return err
+			}
+			handle(sourceMessage{Event: chunkproto.EventChunk, Chunk: chunk})
+		}
+	}
+}
+
+// parseChunkFrame decodes a binary chunk frame and adapts it to the current
+// chunk protocol version
+func parseChunkFrame(frame []byte) (*Chunk, error) {
+	header, audio, err := chunkproto.DecodeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	chunk := &Chunk{Header: header, Audio: audio}
+	if err := chunk.adapt(); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// chunkFrame encodes a chunk as a binary chunk frame carrying eventID
+func chunkFrame(c *Chunk, eventID int64) []byte {
+	header := c.Header
+	header.EventID = eventID
+	return chunkproto.EncodeFrame(header, c.Audio)
+}
+
+// number converts a decoded JSON number to int64
+func number(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
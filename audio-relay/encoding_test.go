@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"audio-common/chunkproto"
+)
+
+// sourceHeader is a chunk header as audio-source sends it
+func sourceHeader(eventID int64) chunkproto.Header {
+	return chunkproto.Header{
+		ProtocolVersion: chunkproto.Version,
+		IntervalID:      "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		LoopCount:       1,
+		Position:        int(eventID),
+		TotalChunks:     300,
+		Timestamp:       1700000000000 + eventID*100,
+		EventID:         eventID,
+		SampleRate:      44100,
+		Channels:        2,
+		SampleWidth:     2,
+		AudioFormat:     map[string]int{"channels": 2, "sample_rate": 44100, "bits_per_sample": 16, "format_tag": 1, "block_align": 4, "valid_bits": 16},
+	}
+}
+
+// collect gathers the messages a reader hands on
+func collect(t *testing.T, read func(io.Reader, func(sourceMessage)) error, stream []byte) []sourceMessage {
+	t.Helper()
+	var msgs []sourceMessage
+	if err := read(bytes.NewReader(stream), func(msg sourceMessage) { msgs = append(msgs, msg) }); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// checkChunk compares a decoded chunk with the header and audio it was sent as
+func checkChunk(t *testing.T, msg sourceMessage, want chunkproto.Header, sourceVersion int, audio []byte) {
+	t.Helper()
+	if msg.Event != chunkproto.EventChunk || msg.Chunk == nil {
+		t.Fatalf("got %s message without a chunk", msg.Event)
+	}
+	want.ProtocolVersion = chunkproto.Version
+	if !reflect.DeepEqual(msg.Chunk.Header, want) {
+		t.Errorf("chunk header %+v, want %+v", msg.Chunk.Header, want)
+	}
+	if msg.Chunk.sourceVersion != sourceVersion || !bytes.Equal(msg.Chunk.Audio, audio) {
+		t.Errorf("chunk from version %d with audio %v, want %d and %v", msg.Chunk.sourceVersion, msg.Chunk.Audio, sourceVersion, audio)
+	}
+}
+
+func TestReadRecordsFromSource(t *testing.T) {
+	audio := []byte{1, 0, 2, 0, 3, 0, 4, 0}
+	var stream bytes.Buffer
+	chunkproto.WriteEvent(&stream, chunkproto.EncodingBinary, chunkproto.EventState, map[string]interface{}{
+		"protocol_version": chunkproto.Version, "chunk_duration_ms": 100,
+	})
+	chunkproto.WriteRecord(&stream, chunkproto.RecordChunk, chunkproto.EncodeFrame(sourceHeader(5), audio))
+
+	// A version 1 source sent 52-byte headers without the event ID
+	v1 := sourceHeader(6)
+	v1Frame := chunkproto.EncodeFrame(v1, nil)[:chunkproto.FrameMinHeader]
+	v1Frame[0], v1Frame[1] = 1, chunkproto.FrameMinHeader
+	chunkproto.WriteRecord(&stream, chunkproto.RecordChunk, append(v1Frame, audio...))
+	chunkproto.WriteRecord(&stream, 99, []byte("unknown kinds are skipped"))
+
+	msgs := collect(t, readRecords, stream.Bytes())
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if msgs[0].Event != chunkproto.EventState || number(msgs[0].Data["chunk_duration_ms"]) != 100 {
+		t.Errorf("state message %+v", msgs[0])
+	}
+	checkChunk(t, msgs[1], sourceHeader(5), chunkproto.Version, audio)
+	v1.EventID = 0
+	checkChunk(t, msgs[2], v1, 1, audio)
+}
+
+func TestReadSSEFromSource(t *testing.T) {
+	audio := []byte{0xff, 0x7f, 0x00, 0x80}
+	var stream strings.Builder
+	for i, encoding := range []string{chunkproto.EncodingHex, chunkproto.EncodingBase64} {
+		h := sourceHeader(int64(10 + i))
+		text, name := chunkproto.EncodeAudio(audio, encoding)
+		data, _ := json.Marshal(struct {
+			chunkproto.Header
+			Audio         string `json:"audio"`
+			AudioEncoding string `json:"audio_encoding,omitempty"`
+		}{h, text, name})
+		fmt.Fprintf(&stream, "event: %s\nid: %d\ndata: %s\n\n", chunkproto.EventChunk, h.EventID, data)
+	}
+	chunkproto.WriteEvent(&stream, chunkproto.EncodingHex, chunkproto.EventLoop, map[string]interface{}{"loop_count": 2})
+
+	// Version 1 sources sent unnamed events, with the event ID only in the id line
+	v1 := sourceHeader(12)
+	fmt.Fprintf(&stream, "id: 12\ndata: {\"interval_id\":%q,\"loop_count\":1,\"position\":12,\"total_chunks\":300,"+
+		"\"timestamp\":%d,\"audio\":%q,\"sample_rate\":44100,\"channels\":2,\"sample_width\":2,\"audio_format\":%s}\n\n",
+		v1.IntervalID, v1.Timestamp, hex.EncodeToString(audio), mustJSON(t, v1.AudioFormat))
+
+	msgs := collect(t, readSSE, []byte(stream.String()))
+	if len(msgs) != 4 {
+		t.Fatalf("got %d messages, want 4", len(msgs))
+	}
+	checkChunk(t, msgs[0], sourceHeader(10), chunkproto.Version, audio)
+	checkChunk(t, msgs[1], sourceHeader(11), chunkproto.Version, audio)
+	if msgs[2].Event != chunkproto.EventLoop || number(msgs[2].Data["loop_count"]) != 2 {
+		t.Errorf("loop message %+v", msgs[2])
+	}
+	checkChunk(t, msgs[3], v1, 1, audio)
+}
+
+func TestReadRejectsNewerProtocol(t *testing.T) {
+	h := sourceHeader(1)
+	h.ProtocolVersion = chunkproto.Version + 1
+	data := mustJSON(t, map[string]interface{}{"protocol_version": h.ProtocolVersion, "audio": "00"})
+	if err := readSSE(strings.NewReader("data: "+data+"\n\n"), func(sourceMessage) {}); err == nil {
+		t.Error("SSE chunk from a newer protocol was accepted")
+	}
+	frame := chunkproto.EncodeFrame(h, nil)
+	frame[0] = byte(h.ProtocolVersion)
+	var stream bytes.Buffer
+	chunkproto.WriteRecord(&stream, chunkproto.RecordChunk, frame)
+	if err := readRecords(&stream, func(sourceMessage) {}); err == nil {
+		t.Error("frame from a newer protocol was accepted")
+	}
+}
+
+// Relay frames carry the relay's event ID in place of the source's
+func TestChunkFrameCarriesRelayEventID(t *testing.T) {
+	chunk := &Chunk{Header: sourceHeader(5), Audio: []byte{1, 2, 3, 4}, sourceVersion: chunkproto.Version}
+	got, err := parseChunkFrame(chunkFrame(chunk, 99))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sourceHeader(5)
+	want.EventID = 99
+	if !reflect.DeepEqual(got.Header, want) || !bytes.Equal(got.Audio, chunk.Audio) {
+		t.Errorf("relay frame decoded as %+v, %v", got.Header, got.Audio)
+	}
+	if chunk.EventID != 5 {
+		t.Errorf("encoding changed the buffered chunk's event ID to %d", chunk.EventID)
+	}
+}
+
+// Client chunks keep the source's fields, with the relay's event ID in event_id
+func TestClientChunkJSON(t *testing.T) {
+	chunk := &Chunk{Header: sourceHeader(5), Audio: []byte{1, 2}}
+	msg := &clientChunk{Chunk: chunk, EventID: 99, SourceEventID: 5}
+	msg.encodeAudio(chunkproto.EncodingBase64)
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(mustJSON(t, msg)), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["event_id"] != float64(99) || fields["source_event_id"] != float64(5) || fields["position"] != float64(5) {
+		t.Errorf("event_id %v, source_event_id %v, position %v", fields["event_id"], fields["source_event_id"], fields["position"])
+	}
+	if fields["audio"] != "AQI=" || fields["audio_encoding"] != chunkproto.EncodingBase64 {
+		t.Errorf("audio %v in %v", fields["audio"], fields["audio_encoding"])
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,8 @@
+package main
+
+// relayEvent is one message queued for a client
+type relayEvent struct {
+	Type  string
+	Chunk *clientChunk           // for chunkproto.EventChunk; the client's own copy
+	Data  map[string]interface{} // for the other events
+}
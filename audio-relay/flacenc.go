@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// flacMaxBlockSize is the most samples per channel a frame header can describe
+const flacMaxBlockSize = 65535
+
+// flacStreamInfo returns the 34-byte STREAMINFO block for a stream with
+// variable block sizes of unknown total length
+func flacStreamInfo(sampleRate, channels, bitsPerSample int) []byte {
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], 16)               // minimum block size
+	binary.BigEndian.PutUint16(info[2:], flacMaxBlockSize) // maximum block size
+	// Frame sizes, total samples and MD5 are left unknown
+	packed := uint64(sampleRate)<<44 | uint64(channels-1)<<41 | uint64(bitsPerSample-1)<<36
+	binary.BigEndian.PutUint64(info[10:], packed)
+	return info
+}
+
+// flacBlockSizes splits n samples per channel into as few frames as the
+// block size limit allows, of near-equal length
+func flacBlockSizes(n int) []int {
+	frames := (n + flacMaxBlockSize - 1) / flacMaxBlockSize
+	sizes := make([]int, frames)
+	for i := range sizes {
+		sizes[i] = n / frames
+		if i < n%frames {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// flacFrame encodes interleaved samples as a FLAC frame of verbatim
+// subframes. Samples must fit in bitsPerSample, which must be 8, 16 or 24,
+// and there must be at most flacMaxBlockSize per channel.
+func flacFrame(samples []int32, channels, bitsPerSample int, firstSample int64) []byte {
+	blockSize := len(samples) / channels
+
+	// Variable block size stream, sample rate from STREAMINFO
+	frame := []byte{0xFF, 0xF9, 0x70}
+	sizeCode := map[int]byte{8: 1, 16: 4, 24: 6}[bitsPerSample]
+	frame = append(frame, byte(channels-1)<<4|sizeCode<<1)
+	frame = appendUTF8Number(frame, uint64(firstSample))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(blockSize-1))
+	frame = append(frame, flacCRC8(frame))
+
+	bytesPerSample := bitsPerSample / 8
+	for ch := 0; ch < channels; ch++ {
+		frame = append(frame, 0x02) // verbatim, no wasted bits
+		for i := 0; i < blockSize; i++ {
+			v := samples[i*channels+ch]
+			for b := bytesPerSample - 1; b >= 0; b-- {
+				frame = append(frame, byte(v>>(8*b)))
+			}
+		}
+	}
+
+	return binary.BigEndian.AppendUint16(frame, flacCRC16(frame))
+}
+
+// appendUTF8Number appends n in FLAC's extended UTF-8 coding
+func appendUTF8Number(out []byte, n uint64) []byte {
+	if n < 0x80 {
+		return append(out, byte(n))
+	}
+	// Count continuation bytes, each carrying six bits
+	extra := 1
+	for n >= 1<<(6*extra+6-extra) && extra < 6 {
+		extra++
+	}
+	lead := byte(0xFF<<(7-extra)) | byte(n>>(6*extra))
+	out = append(out, lead)
+	for i := extra - 1; i >= 0; i-- {
+		out = append(out, 0x80|byte(n>>(6*i))&0x3F)
+	}
+	return out
+}
+
+// flacCRC8 computes the frame header CRC, polynomial 0x07
+func flacCRC8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacCRC16 computes the frame footer CRC, polynomial 0x8005
+func flacCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacBitsFor returns the FLAC bit depth used for a chunk format; 32-bit
+// and float audio are carried as 24-bit
+func flacBitsFor(formatTag, bitsPerSample int) (int, bool) {
+	switch {
+	case formatTag == 3 && bitsPerSample == 32:
+		return 24, true
+	case formatTag != 1:
+		return 0, false
+	case bitsPerSample == 8, bitsPerSample == 16, bitsPerSample == 24:
+		return bitsPerSample, true
+	case bitsPerSample == 32:
+		return 24, true
+	}
+	return 0, false
+}
+
+// pcmToFLACSamples converts a chunk's PCM to signed samples at the depth
+// given by flacBitsFor
+func pcmToFLACSamples(audio []byte, formatTag, bitsPerSample int) ([]int32, int, bool) {
+	bits, ok := flacBitsFor(formatTag, bitsPerSample)
+	if !ok {
+		return nil, 0, false
+	}
+
+	width := bitsPerSample / 8
+	samples := make([]int32, len(audio)/width)
+	for i := range samples {
+		in := audio[i*width:]
+		switch {
+		case formatTag == 3:
+			f := float64(math.Float32frombits(binary.LittleEndian.Uint32(in)))
+			samples[i] = int32(math.Max(-1, math.Min(1, f)) * 8388607)
+		case width == 1:
+			samples[i] = int32(in[0]) - 128
+		case width == 2:
+			samples[i] = int32(int16(binary.LittleEndian.Uint16(in)))
+		case width == 3:
+			samples[i] = int32(uint32(in[0])<<8|uint32(in[1])<<16|uint32(in[2])<<24) >> 8
+		default:
+			samples[i] = int32(binary.LittleEndian.Uint32(in)) >> 8
+		}
+	}
+	return samples, bits, true
+}
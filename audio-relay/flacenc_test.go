@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestFLACCRCCheckValues(t *testing.T) {
+	// Check values of CRC-8/SMBUS and CRC-16/UMTS, the variants FLAC uses
+	if got := flacCRC8([]byte("123456789")); got != 0xF4 {
+		t.Errorf("CRC-8 = 0x%02x, want 0xf4", got)
+	}
+	if got := flacCRC16([]byte("123456789")); got != 0xFEE8 {
+		t.Errorf("CRC-16 = 0x%04x, want 0xfee8", got)
+	}
+}
+
+func TestFLACFrameKnownGood(t *testing.T) {
+	// Three stereo 16-bit samples starting at sample 0x1234, per RFC 9639:
+	//
+	//	fff9 70 18      sync, variable blocking; 16-bit size follows; 2 channels, 16 bits
+	//	e188b4          sample number 0x1234
+	//	0002 cf         block size - 1, header CRC-8
+	//	02 0001 fffe 1234   verbatim left: 1, -2, 4660
+	//	02 8000 7fff 0000   verbatim right: -32768, 32767, 0
+	//	fcfe            frame CRC-16
+	want, _ := hex.DecodeString("fff97018e188b40002cf" + "020001fffe1234" + "0280007fff0000" + "fcfe")
+	got := flacFrame([]int32{1, -32768, -2, 32767, 0x1234, 0}, 2, 16, 0x1234)
+	if !bytes.Equal(got, want) {
+		t.Errorf("frame\n%x, want\n%x", got, want)
+	}
+}
+
+func TestFLACFrameSampleSizes(t *testing.T) {
+	for _, tc := range []struct {
+		bits     int
+		sizeCode byte
+		samples  []int32
+		payload  string
+	}{
+		{8, 1, []int32{-128, 127}, "02" + "80" + "7f"},
+		{24, 6, []int32{-8388608, 8388607}, "02" + "800000" + "7fffff"},
+	} {
+		frame := flacFrame(tc.samples, 1, tc.bits, 0)
+		if frame[3] != tc.sizeCode<<1 {
+			t.Errorf("%d bits: channel and size byte 0x%02x", tc.bits, frame[3])
+		}
+		// Header: 4 fixed bytes, sample number 0, block size, CRC-8
+		if frame[7] != flacCRC8(frame[:7]) {
+			t.Errorf("%d bits: header CRC 0x%02x", tc.bits, frame[7])
+		}
+		// Then the verbatim subframe
+		if got := hex.EncodeToString(frame[8 : len(frame)-2]); got != tc.payload {
+			t.Errorf("%d bits: subframe %s, want %s", tc.bits, got, tc.payload)
+		}
+		if crc := flacCRC16(frame[:len(frame)-2]); frame[len(frame)-2] != byte(crc>>8) || frame[len(frame)-1] != byte(crc) {
+			t.Errorf("%d bits: frame CRC does not match", tc.bits)
+		}
+	}
+}
+
+func TestAppendUTF8Number(t *testing.T) {
+	cases := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "00"},
+		{0x7F, "7f"},
+		{0x80, "c280"},
+		{0x7FF, "dfbf"},
+		{0x800, "e0a080"},
+		{0xFFFF, "efbfbf"},
+		{0x10000, "f0908080"},
+		{0x1FFFFF, "f7bfbfbf"},
+		{0x200000, "f888808080"},
+		{0x3FFFFFF, "fbbfbfbfbf"},
+		{0x4000000, "fc8480808080"},
+		{0x7FFFFFFF, "fdbfbfbfbfbf"},
+		{0x80000000, "fe828080808080"},
+		{1<<36 - 1, "febfbfbfbfbfbf"},
+	}
+	for _, tc := range cases {
+		if got := hex.EncodeToString(appendUTF8Number([]byte{0xAA}, tc.n)); got != "aa"+tc.want {
+			t.Errorf("0x%x coded as %s, want %s", tc.n, got[2:], tc.want)
+		}
+	}
+}
+
+func TestFLACStreamInfo(t *testing.T) {
+	cases := []struct {
+		rate, channels, bits int
+		want                 string
+	}{
+		// min and max block size, unknown frame sizes, then 20 bits of
+		// rate, 3 of channels - 1, 5 of bits - 1 and 36 of total samples
+		{44100, 2, 16, "0010ffff" + "000000000000" + "0ac442f000000000"},
+		{96000, 2, 24, "0010ffff" + "000000000000" + "1770037000000000"},
+		{8000, 1, 8, "0010ffff" + "000000000000" + "01f4007000000000"},
+		{384000, 8, 24, "0010ffff" + "000000000000" + "5dc00f7000000000"},
+	}
+	for _, tc := range cases {
+		info := flacStreamInfo(tc.rate, tc.channels, tc.bits)
+		want := tc.want + "00000000000000000000000000000000" // no MD5
+		if got := hex.EncodeToString(info); got != want {
+			t.Errorf("%d Hz, %d channels, %d bits:\n%s, want\n%s", tc.rate, tc.channels, tc.bits, got, want)
+		}
+	}
+}
+
+func TestFLACBlockSizes(t *testing.T) {
+	cases := []struct {
+		n    int
+		want []int
+	}{
+		{0, []int{}},
+		{4410, []int{4410}},
+		{65535, []int{65535}},
+		{65536, []int{32768, 32768}},
+		{96000, []int{48000, 48000}},
+		{192001, []int{64001, 64000, 64000}},
+	}
+	for _, tc := range cases {
+		if got := flacBlockSizes(tc.n); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("flacBlockSizes(%d) = %v, want %v", tc.n, got, tc.want)
+		}
+	}
+}
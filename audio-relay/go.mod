@@ -1,3 +1,7 @@
 module audio-relay
 
-go 1.21
\ No newline at end of file
+go 1.21
+
+require audio-common v0.0.0
+
+replace audio-common => ../audio-common
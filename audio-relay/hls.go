@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS segments group as many consecutive buffer entries as cover
+// hlsSegmentMs at the source's chunk length. The relay buffer must hold at
+// least hlsMinBufferSegments of them.
+const (
+	hlsSegmentMs         = 2000
+	hlsMinBufferSegments = 3
+	hlsPlaylistLength    = 3
+	hlsMaxSegments       = 64
+)
+
+// hlsFormat describes the FLAC track a segment was encoded for
+type hlsFormat struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+// String names the format in init segment URIs
+func (f hlsFormat) String() string {
+	return fmt.Sprintf("%d-%d-%d", f.SampleRate, f.Channels, f.BitsPerSample)
+}
+
+// hlsSegment describes a completed segment. Its audio stays in the AudioBuffer
+// and is encoded when requested.
+type hlsSegment struct {
+	Index         int64 // media sequence number
+	First         int64 // sequence number of the first buffer entry
+	Entries       int
+	Format        hlsFormat
+	StartSample   int64
+	Samples       int64
+	EndTime       time.Time // when the last chunk was received
+	Discontinuity bool
+	DiscSeq       int // discontinuity sequence number
+}
+
+// Duration returns the segment length in seconds
+func (s hlsSegment) Duration() float64 {
+	return float64(s.Samples) / float64(s.Format.SampleRate)
+}
+
+// hlsSegmenter cuts the AudioBuffer into fMP4 segments as chunks arrive
+type hlsSegmenter struct {
+	buffer *AudioBuffer
+
+	mu         sync.Mutex
+	segments   []hlsSegment
+	nextIndex  int64
+	nextSeq    int64 // first buffer entry of the next segment
+	nextSample int64
+	discSeq    int
+}
+
+// newHLSSegmenter creates a segmenter over buffer
+func newHLSSegmenter(buffer *AudioBuffer) *hlsSegmenter {
+	return &hlsSegmenter{buffer: buffer}
+}
+
+// update records every segment that has been completed since the last call
+func (h *hlsSegmenter) update() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	oldest, newest := h.buffer.SeqRange()
+	if newest < 0 {
+		return
+	}
+	// Skip entries evicted before anyone asked for them
+	if h.nextSeq < oldest {
+		h.nextSeq = oldest
+	}
+
+	// A segment is complete once a later entry has arrived
+	n := int64(bufferCapacity(hlsSegmentMs, h.buffer.ChunkDuration()))
+	for h.nextSeq+n <= newest {
+		first := h.nextSeq
+		h.nextSeq += n
+
+		entries := h.buffer.Entries(first, first+n-1)
+		if len(entries) == 0 || entries[0].Seq != first {
+			continue
+		}
+		seg, ok := describeSegment(h.nextIndex, entries)
+		if !ok {
+			continue
+		}
+		h.nextIndex++
+
+		// A gap in the entries or a new format starts a new timeline
+		last := len(h.segments) - 1
+		if last >= 0 && (h.segments[last].First+int64(h.segments[last].Entries) != first || h.segments[last].Format != seg.Format) {
+			seg.Discontinuity = true
+			h.discSeq++
+			// Keep the timeline moving forward in the new track's timescale
+			h.nextSample = h.nextSample * int64(seg.Format.SampleRate) / int64(h.segments[last].Format.SampleRate)
+		}
+		seg.DiscSeq = h.discSeq
+		seg.StartSample = h.nextSample
+		h.nextSample += seg.Samples
+
+		h.segments = append(h.segments, seg)
+		if len(h.segments) > hlsMaxSegments {
+			h.segments = h.segments[1:]
+		}
+	}
+}
+
+// describeSegment summarises the audio chunks among entries. A segment takes
+// the format of its last chunk, so audio from before a format switch is left out.
+func describeSegment(index int64, entries []BufferEntry) (hlsSegment, bool) {
+	seg := hlsSegment{Index: index, First: entries[0].Seq, Entries: len(entries)}
+	found := false
+	for i := len(entries) - 1; i >= 0 && !found; i-- {
+		seg.Format, _, found = chunkFormat(entries[i].Chunk)
+	}
+	if !found {
+		return seg, false
+	}
+
+	for _, e := range entries {
+		format, samples, ok := chunkFormat(e.Chunk)
+		if !ok || format != seg.Format {
+			continue
+		}
+		seg.Samples += int64(samples)
+		seg.EndTime = e.ReceivedTime
+	}
+	return seg, true
+}
+
+// chunkFormat returns the FLAC format and frame count of a buffered chunk
+func chunkFormat(chunk *Chunk) (hlsFormat, int, bool) {
+	if chunk == nil || chunk.AudioFormat == nil {
+		return hlsFormat{}, 0, false
+	}
+
+	format := chunk.AudioFormat
+	channels := format["channels"]
+	bits := format["bits_per_sample"]
+	rate := format["sample_rate"]
+	flacBits, ok := flacBitsFor(format["format_tag"], bits)
+	if !ok || channels < 1 || channels > 8 || rate <= 0 {
+		return hlsFormat{}, 0, false
+	}
+	return hlsFormat{SampleRate: rate, Channels: channels, BitsPerSample: flacBits}, len(chunk.Audio) / (bits / 8 * channels), true
+}
+
+// playlist returns the live playlist for a listener delayed by delay
+func (h *hlsSegmenter) playlist(delay time.Duration) string {
+	h.update()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Only segments that finished before the delayed play point and whose
+	// audio is still buffered are listed
+	cutoff := time.Now().Add(-delay)
+	oldest, _ := h.buffer.SeqRange()
+
+	var eligible []hlsSegment
+	for _, seg := range h.segments {
+		if seg.First >= oldest && !seg.EndTime.After(cutoff) {
+			eligible = append(eligible, seg)
+		}
+	}
+	if len(eligible) > hlsPlaylistLength {
+		eligible = eligible[len(eligible)-hlsPlaylistLength:]
+	}
+
+	target := 1.0
+	for _, seg := range eligible {
+		target = math.Max(target, math.Ceil(seg.Duration()))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	if len(eligible) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", eligible[0].Index)
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", eligible[0].DiscSeq)
+	}
+	for i, seg := range eligible {
+		if i > 0 && seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || seg.Format != eligible[i-1].Format {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init/%s.mp4\"\n", seg.Format)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nsegment/%d.m4s\n", seg.Duration(), seg.Index)
+	}
+	return b.String()
+}
+
+// segment encodes a listed segment as fMP4
+func (h *hlsSegmenter) segment(index int64) ([]byte, bool) {
+	h.mu.Lock()
+	var seg hlsSegment
+	found := false
+	for _, s := range h.segments {
+		if s.Index == index {
+			seg, found = s, true
+			break
+		}
+	}
+	h.mu.Unlock()
+	if !found {
+		return nil, false
+	}
+
+	entries := h.buffer.Entries(seg.First, seg.First+int64(seg.Entries)-1)
+	if len(entries) != seg.Entries || entries[0].Seq != seg.First {
+		return nil, false
+	}
+
+	var frames [][]byte
+	var durations []uint32
+	sample := seg.StartSample
+	for _, e := range entries {
+		format, _, ok := chunkFormat(e.Chunk)
+		if !ok || format != seg.Format {
+			continue
+		}
+		samples, bits, _ := pcmToFLACSamples(e.Chunk.Audio, e.Chunk.AudioFormat["format_tag"], e.Chunk.AudioFormat["bits_per_sample"])
+		// Long chunks at high rates take more than one FLAC frame
+		for _, n := range flacBlockSizes(len(samples) / format.Channels) {
+			frames = append(frames, flacFrame(samples[:n*format.Channels], format.Channels, bits, sample))
+			durations = append(durations, uint32(n))
+			samples = samples[n*format.Channels:]
+			sample += int64(n)
+		}
+	}
+	return mp4MediaSegment(uint32(index+1), uint64(seg.StartSample), frames, durations), true
+}
+
+// handleHLS serves the live playlist, init segments and media segments
+func handleHLS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	path := strings.TrimPrefix(r.URL.Path, "/hls/")
+
+	switch {
+	case path == "playlist.m3u8":
+		// Delay is clamped as for /stream
+		delayMs := 2000
+		if d := r.URL.Query().Get("delay"); d != "" {
+			fmt.Sscanf(d, "%d", &delayMs)
+		}
+		delayMs = relay.limits.clampDelay(delayMs)
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(relay.hls.playlist(time.Duration(delayMs) * time.Millisecond)))
+
+	case strings.HasPrefix(path, "init/") && strings.HasSuffix(path, ".mp4"):
+		var f hlsFormat
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "init/"), ".mp4")
+		if _, err := fmt.Sscanf(name, "%d-%d-%d", &f.SampleRate, &f.Channels, &f.BitsPerSample); err != nil ||
+			f.Channels < 1 || f.Channels > 8 || (f.BitsPerSample != 8 && f.BitsPerSample != 16 && f.BitsPerSample != 24) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mp4")
+		w.Write(mp4InitSegment(f.SampleRate, f.Channels, f.BitsPerSample))
+
+	case strings.HasPrefix(path, "segment/") && strings.HasSuffix(path, ".m4s"):
+		index, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, "segment/"), ".m4s"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, ok := relay.hls.segment(index)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Write(data)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"audio-common/chunkproto"
+)
+
+// pcmChunk is a buffered chunk of 100ms of PCM
+func pcmChunk(rate, channels, bits int) *Chunk {
+	return &Chunk{
+		Header: chunkproto.Header{
+			AudioFormat: map[string]int{
+				"format_tag":      1,
+				"bits_per_sample": bits,
+				"channels":        channels,
+				"sample_rate":     rate,
+			},
+		},
+		Audio: make([]byte, rate/10*channels*bits/8),
+	}
+}
+
+// adpcmChunk is a chunk HLS cannot carry
+func adpcmChunk() *Chunk {
+	chunk := pcmChunk(44100, 2, 16)
+	chunk.AudioFormat["format_tag"] = 0x11
+	return chunk
+}
+
+// addChunks buffers n copies of chunk
+func addChunks(b *AudioBuffer, n int, chunk *Chunk) {
+	for i := 0; i < n; i++ {
+		b.AddChunk(chunk)
+	}
+}
+
+// receivedEvery backdates the buffer so entries arrived 100ms apart, the
+// newest now
+func receivedEvery(b *AudioBuffer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < b.count; i++ {
+		b.ring[(b.head+i)%b.maxSize].ReceivedTime = now.Add(-time.Duration(b.count-1-i) * 100 * time.Millisecond)
+	}
+}
+
+// playlistLines is an expected playlist, after the fixed header lines
+func playlistLines(lines ...string) string {
+	return "#EXTM3U\n#EXT-X-VERSION:7\n" + strings.Join(lines, "\n") + "\n"
+}
+
+func TestHLSPlaylist(t *testing.T) {
+	cases := []struct {
+		name     string
+		bufferMs int
+		chunkMs  int
+		fill     func(b *AudioBuffer, h *hlsSegmenter)
+		want     string
+	}{
+		{
+			name: "no complete segment",
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 20, pcmChunk(44100, 2, 16)) // needs chunk 20 to end
+			},
+			want: playlistLines("#EXT-X-TARGETDURATION:1"),
+		},
+		{
+			name: "segment boundaries",
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 21, pcmChunk(44100, 2, 16))
+				h.update()
+				addChunks(b, 20, pcmChunk(44100, 2, 16))
+			},
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+				`#EXT-X-MAP:URI="init/44100-2-16.mp4"`,
+				"#EXTINF:2.000,", "segment/0.m4s",
+				"#EXTINF:2.000,", "segment/1.m4s",
+			),
+		},
+		{
+			name: "only the newest segments",
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 101, pcmChunk(8000, 1, 8))
+			},
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:2",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+				`#EXT-X-MAP:URI="init/8000-1-8.mp4"`,
+				"#EXTINF:2.000,", "segment/2.m4s",
+				"#EXTINF:2.000,", "segment/3.m4s",
+				"#EXTINF:2.000,", "segment/4.m4s",
+			),
+		},
+		{
+			name: "gap in the audio",
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 20, pcmChunk(44100, 2, 16))
+				addChunks(b, 20, adpcmChunk())
+				addChunks(b, 21, pcmChunk(44100, 2, 16))
+			},
+			// Segments are numbered as they are cut, so the gap takes no number
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+				`#EXT-X-MAP:URI="init/44100-2-16.mp4"`,
+				"#EXTINF:2.000,", "segment/0.m4s",
+				"#EXT-X-DISCONTINUITY",
+				"#EXTINF:2.000,", "segment/1.m4s",
+			),
+		},
+		{
+			name:     "gap from eviction",
+			bufferMs: 3000,
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 21, pcmChunk(44100, 2, 16))
+				h.update()
+				// Chunks 20-30 leave the buffer before anyone looks, and the
+				// next segment starts at the oldest one left
+				addChunks(b, 40, pcmChunk(44100, 2, 16))
+			},
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:1",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1",
+				`#EXT-X-MAP:URI="init/44100-2-16.mp4"`,
+				"#EXTINF:2.000,", "segment/1.m4s",
+			),
+		},
+		{
+			name: "format change",
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 20, pcmChunk(44100, 2, 16))
+				addChunks(b, 21, pcmChunk(48000, 1, 24))
+			},
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+				`#EXT-X-MAP:URI="init/44100-2-16.mp4"`,
+				"#EXTINF:2.000,", "segment/0.m4s",
+				"#EXT-X-DISCONTINUITY",
+				`#EXT-X-MAP:URI="init/48000-1-24.mp4"`,
+				"#EXTINF:2.000,", "segment/1.m4s",
+			),
+		},
+		{
+			name: "format change inside a segment",
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				addChunks(b, 10, pcmChunk(44100, 2, 16))
+				addChunks(b, 31, pcmChunk(48000, 2, 16))
+			},
+			// The first segment keeps only the chunks in its last format
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+				`#EXT-X-MAP:URI="init/48000-2-16.mp4"`,
+				"#EXTINF:1.000,", "segment/0.m4s",
+				"#EXTINF:2.000,", "segment/1.m4s",
+			),
+		},
+		{
+			name:    "longer source chunks",
+			chunkMs: 200,
+			fill: func(b *AudioBuffer, h *hlsSegmenter) {
+				chunk := pcmChunk(44100, 2, 16)
+				chunk.Audio = make([]byte, 2*len(chunk.Audio))
+				addChunks(b, 21, chunk) // ten chunks make a segment
+			},
+			want: playlistLines(
+				"#EXT-X-TARGETDURATION:2",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+				`#EXT-X-MAP:URI="init/44100-2-16.mp4"`,
+				"#EXTINF:2.000,", "segment/0.m4s",
+				"#EXTINF:2.000,", "segment/1.m4s",
+			),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bufferMs, chunkMs := tc.bufferMs, tc.chunkMs
+			if bufferMs == 0 {
+				bufferMs = 20000
+			}
+			if chunkMs == 0 {
+				chunkMs = 100
+			}
+			b := NewAudioBuffer(bufferMs, chunkMs)
+			h := newHLSSegmenter(b)
+			tc.fill(b, h)
+			receivedEvery(b)
+			if got := h.playlist(0); got != tc.want {
+				t.Errorf("playlist\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHLSPlaylistDelay(t *testing.T) {
+	b := NewAudioBuffer(20000, 100)
+	h := newHLSSegmenter(b)
+	addChunks(b, 81, pcmChunk(44100, 2, 16))
+	// Segment n's last chunk, 20n+19, arrived (61-20n)*100ms ago
+	receivedEvery(b)
+
+	cases := []struct {
+		delay time.Duration
+		want  string // listed segments
+	}{
+		{0, "1 2 3"},
+		{time.Second, "0 1 2"},
+		{4 * time.Second, "0 1"},
+		{6 * time.Second, "0"},
+		{7 * time.Second, ""},
+	}
+	for _, tc := range cases {
+		var listed []string
+		for _, line := range strings.Split(h.playlist(tc.delay), "\n") {
+			if strings.HasPrefix(line, "segment/") {
+				listed = append(listed, strings.TrimSuffix(strings.TrimPrefix(line, "segment/"), ".m4s"))
+			}
+		}
+		if got := strings.Join(listed, " "); got != tc.want {
+			t.Errorf("delay %v lists segments %q, want %q", tc.delay, got, tc.want)
+		}
+	}
+}
+
+// childBox returns the payload of the first box of type name in data
+func childBox(data []byte, name string) []byte {
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data)
+		if size < 8 || int(size) > len(data) {
+			return nil
+		}
+		if string(data[4:8]) == name {
+			return data[8:size]
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func TestHLSSegmentFrames(t *testing.T) {
+	cases := []struct {
+		name         string
+		rate, frames int // per chunk
+		blocks       []int
+	}{
+		{"one frame per chunk", 44100, 4410, []int{4410}},
+		{"long chunks split", 96000, 96000, []int{48000, 48000}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewAudioBuffer(20000, 100)
+			h := newHLSSegmenter(b)
+			chunk := pcmChunk(tc.rate, 2, 24)
+			chunk.Audio = make([]byte, tc.frames*2*3)
+			addChunks(b, 21, chunk)
+			h.update()
+
+			seg, ok := h.segment(0)
+			if !ok {
+				t.Fatal("segment 0 not found")
+			}
+			trun := childBox(childBox(childBox(seg, "moof"), "traf"), "trun")
+			if trun == nil {
+				t.Fatal("no trun box")
+			}
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			if count != 20*len(tc.blocks) {
+				t.Fatalf("trun lists %d samples, want %d", count, 20*len(tc.blocks))
+			}
+
+			// One trun sample per FLAC frame, each a valid frame of its duration
+			mdat := childBox(seg, "mdat")
+			var next int64
+			for i := 0; i < count; i++ {
+				duration := int(binary.BigEndian.Uint32(trun[12+8*i:]))
+				size := int(binary.BigEndian.Uint32(trun[16+8*i:]))
+				frame := mdat[:size]
+				mdat = mdat[size:]
+
+				want := tc.blocks[i%len(tc.blocks)]
+				header := 4 + len(appendUTF8Number(nil, uint64(next)))
+				blockSize := int(binary.BigEndian.Uint16(frame[header:])) + 1
+				if duration != want || blockSize != want || size != header+3+2*(1+3*want)+2 {
+					t.Fatalf("frame %d: duration %d, block size %d, %d bytes; want %d samples", i, duration, blockSize, size, want)
+				}
+				if string(frame[4:header]) != string(appendUTF8Number(nil, uint64(next))) {
+					t.Errorf("frame %d does not start at sample %d", i, next)
+				}
+				if crc := flacCRC16(frame[:size-2]); binary.BigEndian.Uint16(frame[size-2:]) != crc {
+					t.Errorf("frame %d fails its CRC", i)
+				}
+				next += int64(want)
+			}
+			if len(mdat) != 0 {
+				t.Errorf("%d bytes of mdat not listed in trun", len(mdat))
+			}
+		})
+	}
+}
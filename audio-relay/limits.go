@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Default relay limits
+const (
+	defaultBufferMs   = 20000
+	defaultMaxDelayMs = 15000
+	defaultChunkMs    = 100 // until the source reports its chunk length
+)
+
+// relayLimits are how much audio the relay keeps and how far behind its
+// clients may play
+type relayLimits struct {
+	BufferMs   int
+	MaxDelayMs int
+}
+
+// limitsFromEnv reads AUDIO_BUFFER_MS and AUDIO_MAX_DELAY_MS. The maximum
+// delay must be shorter than the buffer, so the chunk a client at that delay
+// plays is still held.
+func limitsFromEnv() (relayLimits, error) {
+	limits := relayLimits{BufferMs: defaultBufferMs, MaxDelayMs: defaultMaxDelayMs}
+	for env, value := range map[string]*int{"AUDIO_BUFFER_MS": &limits.BufferMs, "AUDIO_MAX_DELAY_MS": &limits.MaxDelayMs} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return limits, fmt.Errorf("invalid %s %q: want milliseconds", env, v)
+		}
+		*value = n
+	}
+	if limits.BufferMs == 0 {
+		return limits, fmt.Errorf("AUDIO_BUFFER_MS must be positive")
+	}
+	if limits.BufferMs < hlsMinBufferSegments*hlsSegmentMs {
+		return limits, fmt.Errorf("AUDIO_BUFFER_MS (%d) must hold at least %d HLS segments of %d ms", limits.BufferMs, hlsMinBufferSegments, hlsSegmentMs)
+	}
+	if limits.MaxDelayMs >= limits.BufferMs {
+		return limits, fmt.Errorf("AUDIO_MAX_DELAY_MS (%d) must be less than AUDIO_BUFFER_MS (%d)", limits.MaxDelayMs, limits.BufferMs)
+	}
+	return limits, nil
+}
+
+// clampDelay limits a requested delay to [0, MaxDelayMs]
+func (l relayLimits) clampDelay(delayMs int) int {
+	if delayMs < 0 {
+		return 0
+	}
+	if delayMs > l.MaxDelayMs {
+		return l.MaxDelayMs
+	}
+	return delayMs
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestLimitsFromEnv(t *testing.T) {
+	cases := []struct {
+		buffer, maxDelay string
+		want             relayLimits // zero for an error
+	}{
+		{"", "", relayLimits{BufferMs: 20000, MaxDelayMs: 15000}},
+		{"60000", "45000", relayLimits{BufferMs: 60000, MaxDelayMs: 45000}},
+		{"6000", "0", relayLimits{BufferMs: 6000, MaxDelayMs: 0}},
+		{"5999", "0", relayLimits{}}, // under three HLS segments
+		{"0", "", relayLimits{}},
+		{"10000", "", relayLimits{}}, // shorter than the default delay
+		{"20000", "20000", relayLimits{}},
+		{"20s", "", relayLimits{}},
+		{"", "-1", relayLimits{}},
+	}
+	for _, tc := range cases {
+		t.Setenv("AUDIO_BUFFER_MS", tc.buffer)
+		t.Setenv("AUDIO_MAX_DELAY_MS", tc.maxDelay)
+		got, err := limitsFromEnv()
+		if tc.want == (relayLimits{}) {
+			if err == nil {
+				t.Errorf("buffer %q, max delay %q: got %+v, want an error", tc.buffer, tc.maxDelay, got)
+			}
+		} else if err != nil || got != tc.want {
+			t.Errorf("buffer %q, max delay %q: got %+v, %v; want %+v", tc.buffer, tc.maxDelay, got, err, tc.want)
+		}
+	}
+}
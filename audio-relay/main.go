@@ -1,42 +1,114 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+
+	"audio-common/chunkproto"
+	"audio-common/opus"
 )
 
 // BufferEntry represents a buffered audio chunk with timing info
 type BufferEntry struct {
-	Data         interface{}
+	Chunk        *Chunk
 	ReceivedTime time.Time
 	RelativeTime float64
+	Seq          int64 // Position in the order chunks were received
 }
 
-// AudioBuffer is a ring buffer for audio chunks
+// AudioBuffer is a ring buffer for audio chunks. Entries are kept in
+// receive order, so they are indexed by sequence number and searched by time.
 type AudioBuffer struct {
-	maxSize   int
-	buffer    []BufferEntry
-	startTime *time.Time
-	mu        sync.RWMutex
+	maxDurationMs int
+	chunkMs       int
+	maxSize       int
+	ring          []BufferEntry // fixed capacity, reallocated only when the chunk length changes
+	head          int           // ring index of the oldest entry
+	count         int
+	startTime     *time.Time
+	nextSeq       int64
+	mu            sync.RWMutex
 }
 
-// NewAudioBuffer creates a new audio buffer
-func NewAudioBuffer(maxSeconds int) *AudioBuffer {
+// NewAudioBuffer creates a buffer holding maxDurationMs of chunks chunkMs long
+func NewAudioBuffer(maxDurationMs, chunkMs int) *AudioBuffer {
+	maxSize := bufferCapacity(maxDurationMs, chunkMs)
 	return &AudioBuffer{
-		maxSize: maxSeconds * 10, // Assuming 100ms chunks
-		buffer:  make([]BufferEntry, 0),
+		maxDurationMs: maxDurationMs,
+		chunkMs:       chunkMs,
+		maxSize:       maxSize,
+		ring:          make([]BufferEntry, maxSize),
+	}
+}
+
+// bufferCapacity is the number of chunks that cover a duration
+func bufferCapacity(durationMs, chunkMs int) int {
+	n := (durationMs + chunkMs - 1) / chunkMs
+	if n < 1 {
+		n = 1
 	}
+	return n
+}
+
+// SetChunkDuration resizes the buffer for chunks chunkMs long, keeping the
+// newest entries that fit, and reports whether the length changed
+func (b *AudioBuffer) SetChunkDuration(chunkMs int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	if chunkMs <= 0 || chunkMs == b.chunkMs {
+		return false
+	}
+	size := bufferCapacity(b.maxDurationMs, chunkMs)
+	ring := make([]BufferEntry, size)
+	n := b.count
+	if n > size {
+		n = size
+	}
+	for i := 0; i < n; i++ {
+		ring[i] = b.at(b.count - n + i)
+	}
+	b.ring, b.head, b.count, b.maxSize, b.chunkMs = ring, 0, n, size, chunkMs
+	return true
+}
+
+// info describes the buffer's configuration for /status
+func (b *AudioBuffer) info() map[string]interface{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	
+	return map[string]interface{}{
+		"max_duration_ms":   b.maxDurationMs,
+		"chunk_duration_ms": b.chunkMs,
+		"capacity":          b.maxSize,
+	}
+}
+
+// ChunkDuration returns the chunk length the buffer is sized for
+func (b *AudioBuffer) ChunkDuration() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.chunkMs
+}
+
+// at returns the i-th entry counting from the oldest; the caller holds mu
+func (b *AudioBuffer) at(i int) BufferEntry {
+	return b.ring[(b.head+i)%b.maxSize]
 }
 
-// AddChunk adds a chunk to the buffer
-func (b *AudioBuffer) AddChunk(chunkData interface{}) {
+// AddChunk adds a chunk to the buffer and returns its sequence number
+func (b *AudioBuffer) AddChunk(chunk *Chunk) int64 {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	
@@ -46,42 +118,85 @@ func (b *AudioBuffer) AddChunk(chunkData interface{}) {
 	}
 	
 	entry := BufferEntry{
-		Data:         chunkData,
+		Chunk:        chunk,
 		ReceivedTime: now,
 		RelativeTime: now.Sub(*b.startTime).Seconds(),
+		Seq:          b.nextSeq,
 	}
+	b.nextSeq++
 	
-	b.buffer = append(b.buffer, entry)
-	if len(b.buffer) > b.maxSize {
-		b.buffer = b.buffer[1:]
+	// Once full, the newest entry overwrites the oldest
+	if b.count < b.maxSize {
+		b.ring[(b.head+b.count)%b.maxSize] = entry
+		b.count++
+	} else {
+		b.ring[b.head] = entry
+		b.head = (b.head + 1) % b.maxSize
 	}
+	return entry.Seq
 }
 
-// GetChunkAtDelay returns the chunk that should play now given the delay
-func (b *AudioBuffer) GetChunkAtDelay(delaySeconds float64) interface{} {
+// SeqAtDelay returns the sequence number of the newest entry received at
+// least delaySeconds ago, the last one a client with that delay should have
+// been sent, or -1 when there is none
+func (b *AudioBuffer) SeqAtDelay(delaySeconds float64) int64 {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	
-	if len(b.buffer) == 0 || b.startTime == nil {
-		return nil
+	if b.count == 0 {
+		return -1
 	}
 	
-	// Special case: zero delay means play the most recent chunk
-	if delaySeconds == 0 {
-		return b.buffer[len(b.buffer)-1].Data
+	// Receive times only increase, so the entries are sorted by time
+	cutoff := time.Since(*b.startTime).Seconds() - delaySeconds
+	i := sort.Search(b.count, func(i int) bool {
+		return b.at(i).RelativeTime > cutoff
+	})
+	if i == 0 {
+		return -1
 	}
+	return b.at(i - 1).Seq
+}
+
+// SeqRange returns the sequence numbers of the oldest and newest buffered
+// entries, or -1 for both when the buffer is empty
+func (b *AudioBuffer) SeqRange() (int64, int64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	
-	currentRelativeTime := time.Since(*b.startTime).Seconds()
-	targetTime := currentRelativeTime - delaySeconds
+	if b.count == 0 {
+		return -1, -1
+	}
+	return b.at(0).Seq, b.at(b.count - 1).Seq
+}
+
+// Entries returns the buffered entries with sequence numbers in [first, last]
+func (b *AudioBuffer) Entries(first, last int64) []BufferEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	
-	// Find the chunk closest to our target time
-	for _, entry := range b.buffer {
-		if entry.RelativeTime >= targetTime {
-			return entry.Data
-		}
+	if b.count == 0 {
+		return nil
+	}
+	
+	// Sequence numbers are contiguous, so they index the buffer directly
+	oldest := b.at(0).Seq
+	newest := b.at(b.count - 1).Seq
+	if first < oldest {
+		first = oldest
+	}
+	if last > newest {
+		last = newest
+	}
+	if first > last {
+		return nil
 	}
 	
-	return nil
+	entries := make([]BufferEntry, last-first+1)
+	for i := range entries {
+		entries[i] = b.at(int(first-oldest) + i)
+	}
+	return entries
 }
 
 // GetStats returns buffer statistics
@@ -89,59 +204,83 @@ func (b *AudioBuffer) GetStats() map[string]interface{} {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	
-	if len(b.buffer) == 0 {
+	if b.count == 0 {
 		return map[string]interface{}{"size": 0, "duration": 0}
 	}
 	
-	duration := 0.0
-	if len(b.buffer) > 1 {
-		duration = b.buffer[len(b.buffer)-1].RelativeTime - b.buffer[0].RelativeTime
-	}
-	
-	oldestAge := 0.0
-	if len(b.buffer) > 0 {
-		oldestAge = time.Since(b.buffer[0].ReceivedTime).Seconds()
-	}
+	oldest := b.at(0)
+	duration := b.at(b.count-1).RelativeTime - oldest.RelativeTime
 	
 	return map[string]interface{}{
-		"size":       len(b.buffer),
+		"size":       b.count,
 		"duration":   duration,
-		"oldest_age": oldestAge,
+		"oldest_age": time.Since(oldest.ReceivedTime).Seconds(),
 	}
 }
 
 // ClientInfo represents a connected client
 type ClientInfo struct {
-	Queue    chan map[string]interface{}
+	Queue    chan relayEvent
 	DelayMs  int
+	mu       sync.Mutex // guards DelayMs and the cursor
+	cursor   int64      // next sequence number to send, -1 until placed at the play point
+	fadeFrom int64      // where the client was before a delay change to crossfade from, or -1
 }
 
 // AudioRelay manages the relay service
 type AudioRelay struct {
 	sourceURL      string
+	sourceEncoding string
+	sourceCodec    url.Values // codec query for the source, stored in the buffer as received
 	buffer         *AudioBuffer
 	listeners      map[int]*ClientInfo
 	listenersMux   sync.RWMutex
+	stateMux       sync.RWMutex // guards currentState, isConnected and latestChunk
 	currentState   map[string]interface{}
 	isConnected    bool
 	relayID        string
+	limits         relayLimits
 	clientCounter  int
-	latestChunk    interface{}
+	latestChunk    *Chunk
+	lastSourceID   int64 // event ID of the last chunk from the source, -1 before the first
+	hls            *hlsSegmenter
+	rtp            *rtpReceiver // optional RTP ingest, replacing ConnectToSource
 }
 
 // NewAudioRelay creates a new relay instance
-func NewAudioRelay() *AudioRelay {
+func NewAudioRelay(limits relayLimits) *AudioRelay {
 	sourceURL := os.Getenv("AUDIO_SOURCE_URL")
 	if sourceURL == "" {
 		sourceURL = "http://audio-source:8000"
 	}
 	
+	// Binary framing avoids the hex overhead between services
+	sourceEncoding := os.Getenv("AUDIO_SOURCE_ENCODING")
+	if sourceEncoding == "" {
+		sourceEncoding = chunkproto.EncodingBinary
+	}
+	
+	// Optional compression on the source link, e.g. AUDIO_SOURCE_CODEC=opus.
+	// Encoded chunks are buffered and forwarded without decoding.
+	sourceCodec := url.Values{}
+	for param, env := range map[string]string{"codec": "AUDIO_SOURCE_CODEC", "bitrate": "AUDIO_SOURCE_BITRATE", "frame_ms": "AUDIO_SOURCE_FRAME_MS"} {
+		if v := os.Getenv(env); v != "" {
+			sourceCodec.Set(param, v)
+		}
+	}
+	
+	buffer := NewAudioBuffer(limits.BufferMs, defaultChunkMs)
 	return &AudioRelay{
-		sourceURL:    sourceURL,
-		buffer:       NewAudioBuffer(20),
+		sourceURL:      sourceURL,
+		sourceEncoding: sourceEncoding,
+		sourceCodec:    sourceCodec,
+		buffer:       buffer,
+		hls:          newHLSSegmenter(buffer),
 		listeners:    make(map[int]*ClientInfo),
 		currentState: make(map[string]interface{}),
 		relayID:      "relay-buffered",
+		limits:       limits,
+		lastSourceID: -1,
 	}
 }
 
@@ -156,93 +295,253 @@ func (r *AudioRelay) ConnectToSource(ctx context.Context) {
 		
 		log.Printf("Connecting to audio source at %s/stream", r.sourceURL)
 		
-		req, err := http.NewRequestWithContext(ctx, "GET", r.sourceURL+"/stream", nil)
+		query := url.Values{"encoding": {r.sourceEncoding}}
+		for k, v := range r.sourceCodec {
+			query[k] = v
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", r.sourceURL+"/stream?"+query.Encode(), nil)
 		if err != nil {
 			log.Printf("Failed to create request: %v", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		
+		// Resume after the last chunk so the source replays what we missed
+		if r.lastSourceID >= 0 {
+			req.Header.Set("Last-Event-ID", strconv.FormatInt(r.lastSourceID, 10))
+		}
+		
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			log.Printf("Connection to source failed: %v", err)
-			r.isConnected = false
+			r.setConnected(false)
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		
-		r.isConnected = true
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			log.Printf("Source refused stream: %s: %s", resp.Status, body)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		
+		r.setConnected(true)
 		log.Println("Connected to audio source")
 		
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if len(line) > 6 && line[:6] == "data: " {
-				var data map[string]interface{}
-				if err := json.Unmarshal([]byte(line[6:]), &data); err == nil {
-					// Update current state
-					r.currentState = map[string]interface{}{
-						"source_interval_id": data["interval_id"],
-						"source_loop_count":  data["loop_count"],
-						"source_position":    data["position"],
-						"total_chunks":       data["total_chunks"],
-						"audio_format":       data["audio_format"],
-					}
-					
-					// Buffer the chunk
-					r.buffer.AddChunk(data)
-					
-					// Store latest chunk for real-time playback
-					r.latestChunk = data
-					
-					// Send immediately to real-time clients
-					r.sendToRealtimeClients(data)
-				}
-			}
+		// The source answers with SSE or binary records depending on the encoding
+		read := readSSE
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == chunkproto.StreamContentType {
+			read = readRecords
+		}
+		if err := read(resp.Body, r.handleSourceMessage); err != nil {
+			log.Printf("Error reading from source: %v", err)
 		}
 		
 		resp.Body.Close()
-		r.isConnected = false
+		r.setConnected(false)
 		log.Println("Disconnected from source")
 		time.Sleep(5 * time.Second)
 	}
 }
 
-// sendToRealtimeClients sends chunk immediately to real-time (0 delay) clients
-func (r *AudioRelay) sendToRealtimeClients(chunkData interface{}) {
+// ReceiveRTP buffers chunks assembled from the RTP ingest, restarting the
+// receiver if it fails
+func (r *AudioRelay) ReceiveRTP(ctx context.Context) {
+	if r.buffer.SetChunkDuration(r.rtp.chunkMs) {
+		log.Printf("RTP chunks are %dms: buffering %d chunks", r.rtp.chunkMs, bufferCapacity(r.limits.BufferMs, r.rtp.chunkMs))
+	}
+	for {
+		if err := r.rtp.Receive(ctx, r.handleSourceMessage); err != nil {
+			log.Printf("RTP ingest failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// handleSourceMessage buffers a message from the source and forwards it to real-time clients
+func (r *AudioRelay) handleSourceMessage(msg sourceMessage) {
+	switch msg.Event {
+	case chunkproto.EventChunk:
+		if msg.Chunk == nil {
+			return
+		}
+	case chunkproto.EventSwitch, chunkproto.EventLoop:
+		r.updateChunkDuration(msg.Data)
+		r.forwardEvent(msg.Event, msg.Data)
+		return
+	case chunkproto.EventState:
+		r.updateChunkDuration(msg.Data)
+		if resume, ok := msg.Data["resume"].(map[string]interface{}); ok {
+			log.Printf("Resumed source stream after event %v: %v chunks replayed, %v missed",
+				resume["last_event_id"], resume["replayed"], resume["missed"])
+		}
+		return
+	case chunkproto.EventError:
+		log.Printf("Source reported an error: %v", msg.Data["error"])
+		return
+	default:
+		return
+	}
+	
+	chunk := msg.Chunk
+	r.lastSourceID = chunk.EventID
+	
+	// Update current state
+	state := map[string]interface{}{
+		"protocol_version":   chunk.sourceVersion,
+		"source_interval_id": chunk.IntervalID,
+		"source_loop_count":  chunk.LoopCount,
+		"source_position":    chunk.Position,
+		"total_chunks":       chunk.TotalChunks,
+		"audio_format":       chunk.AudioFormat,
+	}
+	
+	// Store latest chunk for real-time playback
+	r.stateMux.Lock()
+	r.currentState = state
+	r.latestChunk = chunk
+	r.stateMux.Unlock()
+	
+	// Buffer the chunk
+	r.buffer.AddChunk(chunk)
+	
+	// Real-time clients get it straight away
+	r.deliverAll()
+}
+
+// updateChunkDuration sizes the buffer for the chunk length in a source state
+func (r *AudioRelay) updateChunkDuration(state map[string]interface{}) {
+	chunkMs := int(number(state["chunk_duration_ms"]))
+	if r.buffer.SetChunkDuration(chunkMs) {
+		log.Printf("Source chunks are %dms: buffering %d chunks", chunkMs, bufferCapacity(r.limits.BufferMs, chunkMs))
+	}
+}
+
+// forwardEvent passes a source notification to every client as it arrives,
+// ahead of the delayed audio it refers to
+func (r *AudioRelay) forwardEvent(event string, data map[string]interface{}) {
 	r.listenersMux.RLock()
 	defer r.listenersMux.RUnlock()
 	
-	chunk := chunkData.(map[string]interface{})
-	now := time.Now().UnixMilli()
+	// One copy is shared by every client
+	msg := make(map[string]interface{}, len(data)+2)
+	for k, v := range data {
+		msg[k] = v
+	}
+	msg["relay_id"] = r.relayID
+	msg["relay_timestamp"] = time.Now().UnixMilli()
 	
 	for clientID, clientInfo := range r.listeners {
-		if clientInfo.DelayMs == 0 {
-			relayData := make(map[string]interface{})
-			for k, v := range chunk {
-				relayData[k] = v
-			}
-			relayData["relay_id"] = r.relayID
-			relayData["relay_timestamp"] = now
-			relayData["source_timestamp"] = chunk["timestamp"]
-			relayData["configured_delay_ms"] = 0
-			
-			if sourceTs, ok := chunk["timestamp"].(float64); ok {
-				relayData["actual_delay_ms"] = now - int64(sourceTs)
-			}
-			
-			relayData["buffer_stats"] = r.buffer.GetStats()
-			
-			select {
-			case clientInfo.Queue <- relayData:
-			default:
-				log.Printf("Queue full for real-time client %d", clientID)
+		select {
+		case clientInfo.Queue <- relayEvent{Type: event, Data: msg}:
+		default:
+			log.Printf("Queue full for client %d, dropped %s event", clientID, event)
+		}
+	}
+}
+
+// relayMessage wraps a buffered chunk for a client, adding relay timing and
+// buffer stats taken once for every client sent the chunk. The chunk itself
+// is shared, not copied. The entry's sequence number is the relay's event ID
+// for the chunk.
+func (r *AudioRelay) relayMessage(entry BufferEntry, delayMs int, stats map[string]interface{}) *clientChunk {
+	now := time.Now().UnixMilli()
+	return &clientChunk{
+		Chunk:             entry.Chunk,
+		EventID:           entry.Seq,
+		SourceEventID:     entry.Chunk.EventID,
+		RelayID:           r.relayID,
+		RelayTimestamp:    now,
+		SourceTimestamp:   entry.Chunk.Timestamp,
+		ConfiguredDelayMs: delayMs,
+		ActualDelayMs:     now - entry.Chunk.Timestamp,
+		BufferStats:       stats,
+	}
+}
+
+// connected reports whether audio is arriving from the source or RTP ingest
+func (r *AudioRelay) connected() bool {
+	if r.rtp != nil {
+		return r.rtp.receiving()
+	}
+	r.stateMux.RLock()
+	defer r.stateMux.RUnlock()
+	return r.isConnected
+}
+
+// setConnected records whether the source stream is open
+func (r *AudioRelay) setConnected(connected bool) {
+	r.stateMux.Lock()
+	r.isConnected = connected
+	r.stateMux.Unlock()
+}
+
+// latest returns the most recent source chunk and the state it carried, or
+// nil before the first chunk
+func (r *AudioRelay) latest() (*Chunk, map[string]interface{}) {
+	r.stateMux.RLock()
+	defer r.stateMux.RUnlock()
+	return r.latestChunk, r.currentState
+}
+
+// deliver queues a client's chunks from its cursor up to its play point, in
+// order. A full queue holds the cursor until the next call, so each chunk is
+// sent exactly once unless the client falls a whole buffer behind.
+func (r *AudioRelay) deliver(clientID int, info *ClientInfo, stats map[string]interface{}) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	
+	due := r.buffer.SeqAtDelay(float64(info.DelayMs) / 1000.0)
+	if due < 0 {
+		return
+	}
+	if info.cursor < 0 {
+		info.cursor = due
+	}
+	
+	entries := r.buffer.Entries(info.cursor, due)
+	if len(entries) > 0 && entries[0].Seq > info.cursor {
+		log.Printf("Client %d fell behind: %d chunks left the buffer unsent", clientID, entries[0].Seq-info.cursor)
+		info.fadeFrom = -1
+	}
+	for _, entry := range entries {
+		msg := r.relayMessage(entry, info.DelayMs, stats)
+		if info.fadeFrom >= 0 {
+			if from := r.buffer.Entries(info.fadeFrom, info.fadeFrom); len(from) == 1 {
+				if chunk, ok := crossfade(from[0].Chunk, entry.Chunk); ok {
+					msg.Chunk = chunk
+				}
 			}
 		}
+		
+		select {
+		case info.Queue <- relayEvent{Type: chunkproto.EventChunk, Chunk: msg}:
+			info.cursor = entry.Seq + 1
+			info.fadeFrom = -1
+		default:
+			return // queue full; resume here on the next call
+		}
 	}
 }
 
-// PlaybackLoop sends buffered audio to clients based on their delay settings
+// deliverAll sends every client the chunks that have reached its delay
+func (r *AudioRelay) deliverAll() {
+	r.listenersMux.RLock()
+	defer r.listenersMux.RUnlock()
+	
+	stats := r.buffer.GetStats()
+	for clientID, clientInfo := range r.listeners {
+		r.deliver(clientID, clientInfo, stats)
+	}
+}
+
+// PlaybackLoop sends buffered audio to clients as it reaches their delay
 func (r *AudioRelay) PlaybackLoop(ctx context.Context) {
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
@@ -252,61 +551,26 @@ func (r *AudioRelay) PlaybackLoop(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			r.listenersMux.RLock()
-			clients := make(map[int]*ClientInfo)
-			for id, info := range r.listeners {
-				clients[id] = info
-			}
-			r.listenersMux.RUnlock()
-			
-			for clientID, clientInfo := range clients {
-				if clientInfo.DelayMs > 0 { // Skip real-time clients
-					delaySeconds := float64(clientInfo.DelayMs) / 1000.0
-					chunkData := r.buffer.GetChunkAtDelay(delaySeconds)
-					
-					if chunkData != nil {
-						chunk := chunkData.(map[string]interface{})
-						relayData := make(map[string]interface{})
-						for k, v := range chunk {
-							relayData[k] = v
-						}
-						
-						now := time.Now().UnixMilli()
-						relayData["relay_id"] = r.relayID
-						relayData["relay_timestamp"] = now
-						relayData["source_timestamp"] = chunk["timestamp"]
-						relayData["configured_delay_ms"] = clientInfo.DelayMs
-						
-						if sourceTs, ok := chunk["timestamp"].(float64); ok {
-							relayData["actual_delay_ms"] = now - int64(sourceTs)
-						}
-						
-						relayData["buffer_stats"] = r.buffer.GetStats()
-						
-						select {
-						case clientInfo.Queue <- relayData:
-						default:
-							log.Printf("Queue full for client %d", clientID)
-						}
-					}
-				}
-			}
+			r.deliverAll()
 		}
 	}
 }
 
-// AddClient adds a new client
-func (r *AudioRelay) AddClient(delayMs int) (int, chan map[string]interface{}) {
+// AddClient adds a new client whose first chunk is cursor, or the one at its
+// play point when cursor is -1
+func (r *AudioRelay) AddClient(delayMs int, cursor int64) (int, chan relayEvent) {
 	r.listenersMux.Lock()
 	defer r.listenersMux.Unlock()
 	
 	clientID := r.clientCounter
 	r.clientCounter++
 	
-	ch := make(chan map[string]interface{}, 10)
+	ch := make(chan relayEvent, 10)
 	r.listeners[clientID] = &ClientInfo{
-		Queue:   ch,
-		DelayMs: delayMs,
+		Queue:    ch,
+		DelayMs:  delayMs,
+		cursor:   cursor,
+		fadeFrom: -1,
 	}
 	
 	log.Printf("Client %d connected with %dms delay. Total: %d", clientID, delayMs, len(r.listeners))
@@ -325,13 +589,24 @@ func (r *AudioRelay) RemoveClient(clientID int) {
 	}
 }
 
-// UpdateClientDelay updates the delay for a client
-func (r *AudioRelay) UpdateClientDelay(clientID, delayMs int) {
+// UpdateClientDelay updates the delay for a client. Its cursor jumps to the
+// new play point, optionally crossfading from where it was.
+func (r *AudioRelay) UpdateClientDelay(clientID, delayMs int, crossfade bool) {
 	r.listenersMux.Lock()
 	defer r.listenersMux.Unlock()
 	
 	if info, ok := r.listeners[clientID]; ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		if info.DelayMs == delayMs {
+			return
+		}
 		info.DelayMs = delayMs
+		info.fadeFrom = -1
+		if crossfade && info.cursor >= 0 {
+			info.fadeFrom = info.cursor
+		}
+		info.cursor = -1
 		log.Printf("Updated client %d delay to %dms", clientID, delayMs)
 	}
 }
@@ -372,13 +647,13 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         <div class="controls">
             <h3>Latency Control</h3>
             <div class="slider-container">
-                <input type="range" min="0" max="15000" value="2000" step="100" class="slider" id="latencySlider">
+                <input type="range" min="0" max="%d" value="2000" step="100" class="slider" id="latencySlider">
                 <div class="delay-display" id="delayDisplay">2.0 seconds</div>
             </div>
             <div style="display: flex; justify-content: space-between; color: #666;">
                 <span>0s</span>
                 <span>Real-time ← → Delayed</span>
-                <span>15s</span>
+                <span>%gs</span>
             </div>
         </div>
         
@@ -420,7 +695,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                 fetch('/set-delay', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ client_id: clientId, delay_ms: currentDelay })
+                    body: JSON.stringify({ client_id: clientId, delay_ms: currentDelay, crossfade: true })
                 });
             }
         }
@@ -436,13 +711,18 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                 eventSource = new EventSource('/stream?delay=' + currentDelay);
                 document.getElementById('state').textContent = 'Connecting...';
                 
-                eventSource.onmessage = (event) => {
+                eventSource.addEventListener('state', (event) => {
+                    clientId = JSON.parse(event.data).client_id;
+                    document.getElementById('state').textContent = 'Connected';
+                });
+                
+                eventSource.addEventListener('loop', (event) => {
+                    document.getElementById('loop').textContent = JSON.parse(event.data).loop_count;
+                });
+                
+                eventSource.addEventListener('chunk', (event) => {
                     const data = JSON.parse(event.data);
                     
-                    if (data.client_id !== undefined) {
-                        clientId = data.client_id;
-                    }
-                    
                     document.getElementById('state').textContent = 'Connected';
                     document.getElementById('loop').textContent = data.loop_count || '-';
                     document.getElementById('position').textContent = 
@@ -462,9 +742,14 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                     if (data.audio && isPlaying) {
                         playChunk(data);
                     }
-                };
+                });
                 
-                eventSource.onerror = () => {
+                // Server error events and connection failures share the error handler
+                eventSource.onerror = (e) => {
+                    if (e.data) {
+                        console.error('Stream error:', JSON.parse(e.data).error);
+                        return;
+                    }
                     document.getElementById('state').textContent = 'Error';
                     stopStream();
                 };
@@ -476,22 +761,24 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         
         function playChunk(data) {
             try {
-                const bytes = new Uint8Array(data.audio.match(/.{1,2}/g).map(byte => parseInt(byte, 16)));
+                const bytes = data.audio_encoding === 'base64'
+                    ? Uint8Array.from(atob(data.audio), c => c.charCodeAt(0))
+                    : new Uint8Array(data.audio.match(/.{1,2}/g).map(byte => parseInt(byte, 16)));
                 const sampleRate = data.sample_rate || 44100;
                 const channels = data.channels || 1;
                 const sampleWidth = data.sample_width || 2;
-                const samplesPerChannel = bytes.length / (channels * sampleWidth);
+                const format = data.audio_format || {};
+                const formatTag = format.format_tag || 1;
+                const blockAlign = format.block_align || channels * sampleWidth;
+                const samplesPerChannel = Math.floor(bytes.length / blockAlign);
                 
                 const buffer = audioContext.createBuffer(channels, samplesPerChannel, sampleRate);
+                const view = new DataView(bytes.buffer);
                 
-                if (sampleWidth === 2) {
-                    for (let channel = 0; channel < channels; channel++) {
-                        const channelData = buffer.getChannelData(channel);
-                        for (let i = 0; i < samplesPerChannel; i++) {
-                            const byteIndex = (i * channels + channel) * 2;
-                            const int16 = (bytes[byteIndex + 1] << 8) | bytes[byteIndex];
-                            channelData[i] = (int16 > 32767 ? int16 - 65536 : int16) / 32768.0;
-                        }
+                for (let channel = 0; channel < channels; channel++) {
+                    const channelData = buffer.getChannelData(channel);
+                    for (let i = 0; i < samplesPerChannel; i++) {
+                        channelData[i] = readSample(view, i * blockAlign + channel * sampleWidth, sampleWidth, formatTag);
                     }
                 }
                 
@@ -511,6 +798,24 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
+        function readSample(view, offset, sampleWidth, formatTag) {
+            if (formatTag === 3) {
+                return view.getFloat32(offset, true);
+            }
+            switch (sampleWidth) {
+                case 1:
+                    return (view.getUint8(offset) - 128) / 128.0;
+                case 3: {
+                    const int24 = (view.getInt8(offset + 2) << 16) | (view.getUint8(offset + 1) << 8) | view.getUint8(offset);
+                    return int24 / 8388608.0;
+                }
+                case 4:
+                    return view.getInt32(offset, true) / 2147483648.0;
+                default:
+                    return view.getInt16(offset, true) / 32768.0;
+            }
+        }
+        
         function stopStream() {
             isPlaying = false;
             if (eventSource) {
@@ -527,7 +832,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         }
     </script>
 </body>
-</html>`, relay.isConnected)
+</html>`, relay.limits.MaxDelayMs, float64(relay.limits.MaxDelayMs)/1000, relay.connected())
 	
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(html))
@@ -540,42 +845,164 @@ func handleStream(w http.ResponseWriter, r *http.Request) {
 	if d := r.URL.Query().Get("delay"); d != "" {
 		fmt.Sscanf(d, "%d", &delayMs)
 	}
-	if delayMs < 0 {
-		delayMs = 0
+	delayMs = relay.limits.clampDelay(delayMs)
+	
+	// Payload encoding: hex or base64 JSON over SSE, or binary records
+	encoding, err := chunkproto.ParseEncoding(r.URL.Query().Get("encoding"), r.Header.Get("Accept"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	// Optional per-client Opus compression of PCM chunks
+	useOpus, err := parseCodec(r.URL.Query().Get("codec"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if delayMs > 15000 {
-		delayMs = 15000
+	var encoder *opusStream
+	if useOpus {
+		opts, err := opus.ParseOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		channels := 2
+		if chunk, _ := relay.latest(); chunk != nil {
+			channels = chunk.Channels
+		}
+		if encoder, err = newOpusStream(opts, channels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer encoder.Close()
 	}
 	
-	w.Header().Set("Content-Type", "text/event-stream")
+	if encoding == chunkproto.EncodingBinary {
+		w.Header().Set("Content-Type", chunkproto.StreamContentType)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	
-	clientID, ch := relay.AddClient(delayMs)
+	// A reconnecting client's cursor starts after the last chunk it saw, so
+	// it is first sent the buffered chunks it missed
+	cursor := int64(-1)
+	var resume map[string]interface{}
+	lastID, resuming := chunkproto.LastEventID(r)
+	if resuming {
+		var replay, missed int64
+		cursor, replay, missed = relay.resumeCursor(lastID, delayMs)
+		resume = map[string]interface{}{
+			"last_event_id": lastID,
+			"replayed":      replay,
+			"missed":        missed,
+		}
+	}
+	
+	clientID, ch := relay.AddClient(delayMs, cursor)
 	defer relay.RemoveClient(clientID)
 	
+	hello := map[string]interface{}{
+		"protocol_version": chunkproto.Version,
+		"client_id":        clientID,
+		"relay_id":         relay.relayID,
+		"delay_ms":         delayMs,
+	}
+	if resuming {
+		hello["resume"] = resume
+		log.Printf("Client %d resuming after event %d: replaying %v chunks, %v no longer buffered", clientID, lastID, resume["replayed"], resume["missed"])
+	}
+	
 	// Send client ID
-	fmt.Fprintf(w, "data: %s\n\n", fmt.Sprintf(`{"client_id":%d}`, clientID))
+	if err := chunkproto.WriteEvent(w, encoding, chunkproto.EventState, hello); err != nil {
+		return
+	}
 	w.(http.Flusher).Flush()
 	
+	// send writes one chunk event; SSE events carry the relay's event ID
+	lastSent := int64(-1)
+	send := func(msg *clientChunk) error {
+		if encoder != nil {
+			chunk, err := encoder.encode(msg.Chunk)
+			if err != nil {
+				log.Printf("Failed to encode chunk for client %d: %v", clientID, err)
+				return chunkproto.WriteEvent(w, encoding, chunkproto.EventError, map[string]interface{}{
+					"error":    err.Error(),
+					"event_id": msg.EventID,
+				})
+			}
+			msg.Chunk = chunk
+		}
+		lastSent = msg.EventID
+		if encoding == chunkproto.EncodingBinary {
+			if err := writeBinaryMessage(w, msg); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+			return nil
+		}
+		msg.encodeAudio(encoding)
+		if data, err := json.Marshal(msg); err == nil {
+			if _, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", chunkproto.EventChunk, msg.EventID, data); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+		}
+		return nil
+	}
+	
+	heartbeat := time.NewTicker(chunkproto.HeartbeatInterval)
+	defer heartbeat.Stop()
 	for {
 		select {
-		case chunk := <-ch:
-			if data, err := json.Marshal(chunk); err == nil {
-				fmt.Fprintf(w, "data: %s\n\n", data)
+		case event := <-ch:
+			var err error
+			if event.Type == chunkproto.EventChunk {
+				err = send(event.Chunk)
+			} else {
+				err = chunkproto.WriteEvent(w, encoding, event.Type, event.Data)
 				w.(http.Flusher).Flush()
 			}
+			if err != nil {
+				return
+			}
+		case now := <-heartbeat.C:
+			if err := chunkproto.WriteEvent(w, encoding, chunkproto.EventHeartbeat, map[string]interface{}{
+				"timestamp":     now.UnixMilli(),
+				"last_event_id": lastSent,
+				"is_connected":  relay.connected(),
+			}); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
 		case <-r.Context().Done():
 			return
 		}
 	}
 }
 
+// writeBinaryMessage writes a relay chunk as binary records: its metadata as
+// JSON, followed by a chunk frame carrying the audio
+func writeBinaryMessage(w io.Writer, msg *clientChunk) error {
+	msg.Event = chunkproto.EventChunk
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := chunkproto.WriteRecord(w, chunkproto.RecordJSON, data); err != nil {
+		return err
+	}
+	return chunkproto.WriteRecord(w, chunkproto.RecordChunk, chunkFrame(msg.Chunk, msg.EventID))
+}
+
 // handleSetDelay updates delay for a client
 func handleSetDelay(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ClientID int `json:"client_id"`
-		DelayMs  int `json:"delay_ms"`
+		ClientID  int  `json:"client_id"`
+		DelayMs   int  `json:"delay_ms"`
+		Crossfade bool `json:"crossfade"` // fade from the old play point instead of cutting
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -583,14 +1010,9 @@ func handleSetDelay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	if req.DelayMs < 0 {
-		req.DelayMs = 0
-	}
-	if req.DelayMs > 15000 {
-		req.DelayMs = 15000
-	}
+	req.DelayMs = relay.limits.clampDelay(req.DelayMs)
 	
-	relay.UpdateClientDelay(req.ClientID, req.DelayMs)
+	relay.UpdateClientDelay(req.ClientID, req.DelayMs, req.Crossfade)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -604,14 +1026,22 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	relay.listenersMux.RLock()
 	numListeners := len(relay.listeners)
 	relay.listenersMux.RUnlock()
+	_, currentState := relay.latest()
 	
 	status := map[string]interface{}{
 		"relay_id":      relay.relayID,
 		"source_url":    relay.sourceURL,
-		"is_connected":  relay.isConnected,
+		"source_encoding": relay.sourceEncoding,
+		"source_codec":  relay.sourceCodec.Get("codec"),
+		"is_connected":  relay.connected(),
 		"listeners":     numListeners,
 		"buffer_stats":  relay.buffer.GetStats(),
-		"current_state": relay.currentState,
+		"buffer":        relay.buffer.info(),
+		"max_delay_ms":  relay.limits.MaxDelayMs,
+		"current_state": currentState,
+	}
+	if relay.rtp != nil {
+		status["rtp"] = relay.rtp.info()
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
@@ -619,12 +1049,27 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	relay = NewAudioRelay()
+	limits, err := limitsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid buffer setting: %v", err)
+	}
+	relay = NewAudioRelay(limits)
+	
+	// Optional RTP ingest
+	rtp, err := rtpReceiverFromEnv(relay.sourceURL)
+	if err != nil {
+		log.Fatalf("Invalid RTP setting: %v", err)
+	}
+	relay.rtp = rtp
 	
 	ctx := context.Background()
 	
 	// Start background tasks
-	go relay.ConnectToSource(ctx)
+	if relay.rtp != nil {
+		go relay.ReceiveRTP(ctx)
+	} else {
+		go relay.ConnectToSource(ctx)
+	}
 	go relay.PlaybackLoop(ctx)
 	
 	// Setup HTTP routes
@@ -632,6 +1077,7 @@ func main() {
 	http.HandleFunc("/stream", handleStream)
 	http.HandleFunc("/set-delay", handleSetDelay)
 	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/hls/", handleHLS)
 	
 	// Start HTTP server
 	log.Println("Audio relay server started on :8001")
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"audio-common/chunkproto"
+)
+
+// testChunk is 100 frames of 16-bit mono whose samples all hold
+// chunkValue(seq), so a delivered chunk shows which chunk it came from
+func testChunk(seq int64) *Chunk {
+	audio := make([]byte, 200)
+	for i := 0; i < len(audio); i += 2 {
+		binary.LittleEndian.PutUint16(audio[i:], uint16(chunkValue(seq)))
+	}
+	return &Chunk{
+		Header: chunkproto.Header{
+			ProtocolVersion: chunkproto.Version,
+			Position:        int(seq),
+			EventID:         seq,
+			SampleRate:      1000,
+			Channels:        1,
+			SampleWidth:     2,
+			AudioFormat:     map[string]int{"format_tag": 1, "bits_per_sample": 16, "channels": 1, "sample_rate": 1000, "block_align": 2, "valid_bits": 16},
+		},
+		Audio:         audio,
+		sourceVersion: chunkproto.Version,
+	}
+}
+
+func chunkValue(seq int64) int16 {
+	return int16(100 * (seq + 1))
+}
+
+// elapse moves the buffer's clock forward by ms, making every entry that
+// much older, so tests run in virtual time
+func elapse(b *AudioBuffer, ms int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.startTime != nil {
+		start := b.startTime.Add(-time.Duration(ms) * time.Millisecond)
+		b.startTime = &start
+	}
+}
+
+// fillBuffer adds n chunks that arrived chunkMs apart, the last one now
+func fillBuffer(b *AudioBuffer, n, chunkMs int) {
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			elapse(b, chunkMs)
+		}
+		b.AddChunk(testChunk(int64(i)))
+	}
+}
+
+// seqs lists the sequence numbers of entries
+func seqs(entries []BufferEntry) []int64 {
+	out := make([]int64, len(entries))
+	for i, e := range entries {
+		out[i] = e.Seq
+		if e.Chunk.EventID != e.Seq {
+			out[i] = -1 // entry holds the wrong chunk
+		}
+	}
+	return out
+}
+
+// span lists first through last
+func span(first, last int64) []int64 {
+	var out []int64
+	for s := first; s <= last; s++ {
+		out = append(out, s)
+	}
+	return out
+}
+
+func checkRange(t *testing.T, b *AudioBuffer, oldest, newest int64) {
+	t.Helper()
+	if o, n := b.SeqRange(); o != oldest || n != newest {
+		t.Errorf("buffer holds %d-%d, want %d-%d", o, n, oldest, newest)
+	}
+	if got, want := fmt.Sprint(seqs(b.Entries(0, 1<<40))), fmt.Sprint(span(oldest, newest)); got != want {
+		t.Errorf("entries %s, want %s", got, want)
+	}
+}
+
+func TestAudioBufferWraparound(t *testing.T) {
+	b := NewAudioBuffer(1000, 100) // ten entries
+	for i := int64(0); i < 23; i++ {
+		if seq := b.AddChunk(testChunk(i)); seq != i {
+			t.Fatalf("chunk %d got sequence %d", i, seq)
+		}
+		oldest := i - 9
+		if oldest < 0 {
+			oldest = 0
+		}
+		checkRange(t, b, oldest, i)
+	}
+	if b.count != 10 || b.head != 23%10 {
+		t.Errorf("count %d, head %d after 23 chunks", b.count, b.head)
+	}
+	if stats := b.GetStats(); stats["size"] != 10 {
+		t.Errorf("size %v after eviction, want 10", stats["size"])
+	}
+
+	// Ranges across the end of the ring come back in order
+	if got := seqs(b.Entries(19, 21)); fmt.Sprint(got) != "[19 20 21]" {
+		t.Errorf("entries 19-21 = %v", got)
+	}
+}
+
+func TestAudioBufferEvictedLookup(t *testing.T) {
+	b := NewAudioBuffer(1000, 100)
+	fillBuffer(b, 13, 100) // holds 3-12, the newest now
+
+	if got := b.Entries(1, 2); got != nil {
+		t.Errorf("evicted entries 1-2 = %v, want none", seqs(got))
+	}
+	if got := seqs(b.Entries(1, 4)); fmt.Sprint(got) != "[3 4]" {
+		t.Errorf("entries 1-4 = %v, want the buffered 3 and 4", got)
+	}
+	if got := b.Entries(13, 14); got != nil {
+		t.Errorf("entries 13-14 = %v, want none yet", seqs(got))
+	}
+
+	// The oldest entry is 900ms old, so a longer delay's play point has left
+	cases := []struct {
+		delay float64
+		seq   int64
+	}{
+		{0, 12},
+		{0.05, 11},
+		{0.35, 8},
+		{0.85, 3},
+		{0.95, -1},
+	}
+	for _, tc := range cases {
+		if seq := b.SeqAtDelay(tc.delay); seq != tc.seq {
+			t.Errorf("play point at %vs = %d, want %d", tc.delay, seq, tc.seq)
+		}
+	}
+
+	// A client resuming after an evicted chunk restarts at the oldest one
+	r := &AudioRelay{buffer: b, listeners: map[int]*ClientInfo{}}
+	cursor, replay, missed := r.resumeCursor(1, 350)
+	if cursor != 3 || replay != 6 || missed != 1 {
+		t.Errorf("resume after 1 = cursor %d, %d replayed, %d missed; want 3, 6, 1", cursor, replay, missed)
+	}
+}
+
+func TestSetChunkDurationResizes(t *testing.T) {
+	b := NewAudioBuffer(1000, 100)
+	fillBuffer(b, 13, 100) // ten entries, 3-12, with the ring wrapped
+	checkRange(t, b, 3, 12)
+
+	// Longer chunks keep the newest that fit
+	if !b.SetChunkDuration(200) {
+		t.Fatal("SetChunkDuration(200) reported no change")
+	}
+	checkRange(t, b, 8, 12)
+	if capacity := b.info()["capacity"]; capacity != 5 {
+		t.Errorf("capacity %v, want 5", capacity)
+	}
+	b.AddChunk(testChunk(13))
+	checkRange(t, b, 9, 13)
+
+	// Shorter chunks keep everything and numbering carries on
+	if !b.SetChunkDuration(50) {
+		t.Fatal("SetChunkDuration(50) reported no change")
+	}
+	checkRange(t, b, 9, 13)
+	for i := int64(14); i < 29; i++ {
+		b.AddChunk(testChunk(i))
+	}
+	checkRange(t, b, 9, 28)
+	b.AddChunk(testChunk(29))
+	checkRange(t, b, 10, 29)
+
+	if b.SetChunkDuration(50) || b.SetChunkDuration(0) {
+		t.Error("SetChunkDuration reported a change for the same or an invalid length")
+	}
+}
+
+// BenchmarkAudioBuffer measures the per-tick work with 1000 clients at
+// delays spread over the buffer: play point lookups, entry reads, and a full
+// delivery round in which every client is sent its next chunk
+func BenchmarkAudioBuffer(b *testing.B) {
+	const chunkMs, bufferMs, maxDelayMs = 100, 20000, 15000
+	delays := make([]int, 1000)
+	for i := range delays {
+		delays[i] = i * 7919 % maxDelayMs // mixed, not sorted
+	}
+
+	buf := NewAudioBuffer(bufferMs, chunkMs)
+	fillBuffer(buf, bufferMs/chunkMs, chunkMs)
+
+	b.Run("SeqAtDelay", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, d := range delays {
+				buf.SeqAtDelay(float64(d) / 1000)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(delays)), "ns/client")
+	})
+
+	b.Run("Entries", func(b *testing.B) {
+		_, newest := buf.SeqRange()
+		for i := 0; i < b.N; i++ {
+			for _, d := range delays {
+				due := newest - int64(d/chunkMs)
+				buf.Entries(due, due)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(delays)), "ns/client")
+	})
+
+	for _, clients := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("deliver/%d", clients), func(b *testing.B) {
+			buf := NewAudioBuffer(bufferMs, chunkMs)
+			fillBuffer(buf, bufferMs/chunkMs, chunkMs)
+			r := &AudioRelay{buffer: buf, listeners: map[int]*ClientInfo{}}
+			for _, d := range delays[:clients] {
+				r.AddClient(d, -1)
+			}
+			r.deliverAll()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// One chunk's worth of time passes and a chunk arrives
+				elapse(buf, chunkMs)
+				buf.AddChunk(testChunk(int64(bufferMs/chunkMs + i)))
+				r.deliverAll()
+				for _, info := range r.listeners {
+					for len(info.Queue) > 0 {
+						<-info.Queue
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*clients), "ns/client")
+		})
+	}
+}
+
+// deliverySim plays one client against a relay in virtual time: chunks
+// arrive, time passes and the playback tick runs when a test says so
+type deliverySim struct {
+	relay *AudioRelay
+	id    int
+	queue chan relayEvent
+	next  int64    // sequence of the next chunk to arrive
+	got   []string // chunks sent to the client, "to" or "from>to" if crossfaded
+}
+
+const simChunkMs = 100
+
+func newDeliverySim(bufferMs, delayMs, queue int) *deliverySim {
+	s := &deliverySim{relay: &AudioRelay{buffer: NewAudioBuffer(bufferMs, simChunkMs), listeners: map[int]*ClientInfo{}}}
+	s.id, _ = s.relay.AddClient(delayMs, -1)
+	s.queue = make(chan relayEvent, queue)
+	s.relay.listeners[s.id].Queue = s.queue
+	return s
+}
+
+func (s *deliverySim) arrive() {
+	s.relay.buffer.AddChunk(testChunk(s.next))
+	s.next++
+}
+
+func (s *deliverySim) wait(ms int) { elapse(s.relay.buffer, ms) }
+
+func (s *deliverySim) tick() { s.relay.deliverAll() }
+
+func (s *deliverySim) drain() {
+	for len(s.queue) > 0 {
+		msg := (<-s.queue).Chunk
+		label := fmt.Sprint(msg.EventID)
+		if first := int16(binary.LittleEndian.Uint16(msg.Chunk.Audio)); first != chunkValue(msg.EventID) {
+			label = fmt.Sprintf("%d>%d", int64(first)/100-1, msg.EventID)
+		}
+		s.got = append(s.got, label)
+	}
+}
+
+// steady plays n chunk periods with the tick right after each arrival
+func (s *deliverySim) steady(n int) {
+	for i := 0; i < n; i++ {
+		s.arrive()
+		s.tick()
+		s.drain()
+		s.wait(simChunkMs)
+	}
+}
+
+// labels lists first through last as delivered without a crossfade
+func labels(first, last int64, more ...string) []string {
+	var out []string
+	for _, s := range span(first, last) {
+		out = append(out, fmt.Sprint(s))
+	}
+	return append(out, more...)
+}
+
+func TestDeliverCursor(t *testing.T) {
+	// Chunks are 100ms, so a client 300ms behind has been sent 0-8 after
+	// steady(12), and 9 is next
+	changeDelay := func(delayMs int, crossfade bool) func(*deliverySim) {
+		return func(s *deliverySim) {
+			s.steady(12)
+			s.relay.UpdateClientDelay(s.id, delayMs, crossfade)
+			s.tick()
+			s.drain()
+			s.arrive()
+			s.wait(simChunkMs)
+			s.tick()
+			s.drain()
+		}
+	}
+
+	cases := []struct {
+		name     string
+		bufferMs int
+		delayMs  int
+		queue    int
+		run      func(*deliverySim)
+		want     []string
+	}{
+		{
+			name:    "ticks in phase with arrivals",
+			delayMs: 300,
+			run:     func(s *deliverySim) { s.steady(8) },
+			want:    labels(0, 4),
+		},
+		{
+			name:    "ticks out of phase with arrivals",
+			delayMs: 300,
+			run: func(s *deliverySim) {
+				for i := 0; i < 8; i++ {
+					s.arrive()
+					s.wait(50)
+					s.tick()
+					s.drain()
+					s.wait(50)
+				}
+			},
+			want: labels(0, 4),
+		},
+		{
+			name:    "ticks repeated, late and between arrivals",
+			delayMs: 300,
+			run: func(s *deliverySim) {
+				for i := 0; i < 3; i++ {
+					s.arrive()
+					s.wait(simChunkMs)
+				}
+				s.arrive()
+				s.tick() // 0 is due
+				s.tick()
+				s.drain()
+				s.wait(30)
+				s.tick()
+				s.wait(270)
+				s.tick() // 1-3 are due at once
+				s.drain()
+				s.arrive()
+				s.wait(20)
+				s.tick()
+				s.wait(280)
+				s.arrive()
+				s.tick()
+				s.drain()
+			},
+			want: labels(0, 4),
+		},
+		{
+			name:    "queue full",
+			delayMs: 300,
+			queue:   2,
+			run: func(s *deliverySim) {
+				s.steady(4) // 0 sent
+				for i := 0; i < 4; i++ {
+					s.arrive()
+					s.wait(simChunkMs)
+				}
+				s.tick() // 1-5 are due, 1 and 2 fit
+				s.tick()
+				s.drain()
+				s.tick()
+				s.drain()
+				s.tick()
+				s.drain()
+			},
+			want: labels(0, 5),
+		},
+		{
+			name:     "falls behind the oldest entry",
+			bufferMs: 1000,
+			delayMs:  100,
+			run: func(s *deliverySim) {
+				s.steady(2) // 0 sent
+				for i := 0; i < 12; i++ {
+					s.arrive()
+					s.wait(simChunkMs)
+				}
+				s.tick() // 1-3 have left the buffer
+				s.drain()
+				s.steady(1) // 14 is not due yet
+			},
+			want: append(labels(0, 0), labels(4, 13)...),
+		},
+		{
+			name:    "delay unchanged",
+			delayMs: 300,
+			run:     changeDelay(300, true),
+			want:    labels(0, 10),
+		},
+		{
+			name:    "delay raised",
+			delayMs: 300,
+			run:     changeDelay(600, false),
+			want:    labels(0, 8, "6", "7"),
+		},
+		{
+			name:    "delay raised with crossfade",
+			delayMs: 300,
+			run:     changeDelay(600, true),
+			want:    labels(0, 8, "9>6", "7"),
+		},
+		{
+			name:    "delay lowered",
+			delayMs: 300,
+			run:     changeDelay(0, false),
+			want:    labels(0, 8, "11", "12"),
+		},
+		{
+			name:    "delay lowered with crossfade",
+			delayMs: 300,
+			run:     changeDelay(0, true),
+			want:    labels(0, 8, "9>11", "12"),
+		},
+		{
+			name:    "delay lowered before the first chunk",
+			delayMs: 300,
+			run: func(s *deliverySim) {
+				s.steady(2)
+				s.relay.UpdateClientDelay(s.id, 0, true)
+				s.tick()
+				s.drain()
+			},
+			want: labels(1, 1),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			bufferMs, queue := tc.bufferMs, tc.queue
+			if bufferMs == 0 {
+				bufferMs = 2000
+			}
+			if queue == 0 {
+				queue = 10
+			}
+			s := newDeliverySim(bufferMs, tc.delayMs, queue)
+			tc.run(s)
+			if fmt.Sprint(s.got) != fmt.Sprint(tc.want) {
+				t.Errorf("sent %v, want %v", s.got, tc.want)
+			}
+		})
+	}
+}
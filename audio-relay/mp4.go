@@ -0,0 +1,128 @@
+package main
+
+import "encoding/binary"
+
+// box builds an ISO BMFF box from its type and payload parts
+func box(boxType string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], boxType)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// fullBox builds a box with a version and flags header
+func fullBox(boxType string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, flags)
+	header[0] = version
+	return box(boxType, append([][]byte{header}, parts...)...)
+}
+
+// u16, u32 and u64 encode big-endian fields
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// mp4InitSegment builds the ftyp and moov boxes for a single FLAC audio track
+func mp4InitSegment(sampleRate, channels, bitsPerSample int) []byte {
+	// 3x3 unity matrix used by mvhd and tkhd
+	matrix := []byte{
+		0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+	}
+
+	ftyp := box("ftyp", []byte("iso6"), u32(0), []byte("iso6mp41"))
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), u32(0), // timescale, duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		matrix, make([]byte, 24), // matrix, pre-defined
+		u32(2), // next track ID
+	)
+
+	tkhd := fullBox("tkhd", 0, 7, // enabled, in movie, in preview
+		u32(0), u32(0), u32(1), u32(0), u32(0), // times, track ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(0x0100), u16(0), // reserved, layer, group, volume
+		matrix, u32(0), u32(0), // matrix, width, height
+	)
+
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0), u32(uint32(sampleRate)), u32(0),
+		u16(0x55C4), u16(0), // language "und"
+	)
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+
+	// fLaC sample entry carrying STREAMINFO in a dfLa box
+	entryRate := uint32(0)
+	if sampleRate < 0x10000 {
+		entryRate = uint32(sampleRate) << 16
+	}
+	dfLa := fullBox("dfLa", 0, 0, []byte{0x80, 0, 0, 34}, flacStreamInfo(sampleRate, channels, bitsPerSample))
+	fLaC := box("fLaC",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 8), u16(uint16(channels)), u16(uint16(bitsPerSample)),
+		u16(0), u16(0), u32(entryRate),
+		dfLa,
+	)
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), fLaC),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	minf := box("minf", fullBox("smhd", 0, 0, u32(0)), dinf, stbl)
+	trak := box("trak", tkhd, box("mdia", mdhd, hdlr, minf))
+
+	trex := fullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0))
+	moov := box("moov", mvhd, trak, box("mvex", trex))
+
+	return append(ftyp, moov...)
+}
+
+// mp4MediaSegment builds a moof and mdat pair holding one sample per FLAC frame
+func mp4MediaSegment(sequence uint32, baseDecodeTime uint64, frames [][]byte, durations []uint32) []byte {
+	// trun carries a data offset plus a duration and size per sample
+	trunEntries := make([]byte, 0, len(frames)*8)
+	mdatSize := 0
+	for i, f := range frames {
+		trunEntries = append(trunEntries, u32(durations[i])...)
+		trunEntries = append(trunEntries, u32(uint32(len(f)))...)
+		mdatSize += len(f)
+	}
+
+	build := func(dataOffset uint32) []byte {
+		trun := fullBox("trun", 0, 0x000301, u32(uint32(len(frames))), u32(dataOffset), trunEntries)
+		traf := box("traf",
+			fullBox("tfhd", 0, 0x020000, u32(1)), // default base is moof
+			fullBox("tfdt", 1, 0, u64(baseDecodeTime)),
+			trun,
+		)
+		return box("moof", fullBox("mfhd", 0, 0, u32(sequence)), traf)
+	}
+
+	// The data offset counts from the start of moof to the first sample
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+
+	mdat := make([]byte, 8, 8+mdatSize)
+	binary.BigEndian.PutUint32(mdat, uint32(8+mdatSize))
+	copy(mdat[4:], "mdat")
+	for _, f := range frames {
+		mdat = append(mdat, f...)
+	}
+
+	styp := box("styp", []byte("msdh"), u32(0), []byte("msdhmsix"))
+	return append(append(styp, moof...), mdat...)
+}
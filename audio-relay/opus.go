@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"audio-common/opus"
+)
+
+// parseCodec reports whether a /stream codec query value asks for Opus
+func parseCodec(name string) (bool, error) {
+	switch strings.ToLower(name) {
+	case "", "pcm":
+		return false, nil
+	case "opus":
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported codec: %s", name)
+}
+
+// opusStream encodes one listener's PCM chunks. Audio is resampled to
+// 48 kHz mono or stereo, and samples that do not fill a frame wait for the
+// next chunk. Chunks that are already Opus pass through unchanged; the relay
+// buffers them as the source sent them and never decodes Opus.
+type opusStream struct {
+	opts     opus.Options
+	channels int
+	enc      opus.Encoder
+	pending  []int16
+	packet   []byte
+
+	inRate int
+	prev   []float64 // last input frame, already remixed
+	pos    float64   // position of the next output frame, in input frames after prev
+}
+
+// newOpusStream creates an encoder for audio with the given channel count;
+// anything beyond stereo is downmixed
+func newOpusStream(opts opus.Options, channels int) (*opusStream, error) {
+	if channels > 2 {
+		channels = 2
+	}
+	if channels < 1 {
+		channels = 1
+	}
+	enc, err := opus.NewEncoder(channels, opts.Bitrate)
+	if err != nil {
+		return nil, err
+	}
+	return &opusStream{
+		opts:     opts,
+		channels: channels,
+		enc:      enc,
+		packet:   make([]byte, opus.MaxPacket),
+	}, nil
+}
+
+// format describes the stream's chunks. pre_skip is the encoder delay to
+// drop after decoding, in samples per channel.
+func (s *opusStream) format() map[string]int {
+	return map[string]int{
+		"format_tag":      opus.FormatTag,
+		"sample_rate":     opus.SampleRate,
+		"channels":        s.channels,
+		"bits_per_sample": 0,
+		"block_align":     0,
+		"valid_bits":      0,
+		"bitrate":         s.opts.Bitrate,
+		"frame_size":      s.opts.FrameSize,
+		"pre_skip":        s.enc.Lookahead(),
+	}
+}
+
+// encode returns a copy of a PCM chunk carrying Opus packets instead
+func (s *opusStream) encode(c *Chunk) (*Chunk, error) {
+	formatTag := c.AudioFormat["format_tag"]
+	if formatTag == opus.FormatTag {
+		return c, nil
+	}
+	samples, bits, ok := pcmToFLACSamples(c.Audio, formatTag, c.AudioFormat["bits_per_sample"])
+	inChannels := c.AudioFormat["channels"]
+	if !ok || inChannels < 1 {
+		return nil, fmt.Errorf("cannot encode format tag %d as opus", formatTag)
+	}
+
+	// Remix every input frame to the output channel count
+	scale := float64(int32(1) << (bits - 1))
+	frames := make([][]float64, len(samples)/inChannels)
+	for i := range frames {
+		in := make([]float64, inChannels)
+		for ch := range in {
+			in[ch] = float64(samples[i*inChannels+ch]) / scale
+		}
+		frames[i] = remix(in, s.channels)
+	}
+	frames = s.resample(frames, c.AudioFormat["sample_rate"])
+	for _, frame := range frames {
+		for _, v := range frame {
+			v = math.Round(v * 32767)
+			if v > 32767 {
+				v = 32767
+			} else if v < -32768 {
+				v = -32768
+			}
+			s.pending = append(s.pending, int16(v))
+		}
+	}
+
+	var payload []byte
+	size := s.opts.FrameSize * s.channels
+	used := 0
+	for ; len(s.pending)-used >= size; used += size {
+		n, err := s.enc.Encode(s.pending[used:used+size], s.packet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode opus frame: %w", err)
+		}
+		payload = opus.AppendPacket(payload, s.packet[:n])
+	}
+	s.pending = append(s.pending[:0], s.pending[used:]...)
+
+	out := *c
+	out.Audio = payload
+	out.AudioFormat = s.format()
+	out.SampleRate = opus.SampleRate
+	out.Channels = s.channels
+	out.SampleWidth = 0
+	return &out, nil
+}
+
+// resample interpolates frames linearly to 48 kHz, carrying the last frame
+// over to the next chunk. A new input rate restarts interpolation.
+func (s *opusStream) resample(frames [][]float64, rate int) [][]float64 {
+	if rate != s.inRate {
+		s.inRate = rate
+		s.prev = nil
+		s.pos = 0
+	}
+	if rate == opus.SampleRate || rate <= 0 {
+		return frames
+	}
+
+	seq := frames
+	if s.prev != nil {
+		seq = append([][]float64{s.prev}, frames...)
+	}
+	if len(seq) < 2 {
+		if len(seq) == 1 {
+			s.prev = seq[0]
+		}
+		return nil
+	}
+
+	step := float64(rate) / opus.SampleRate
+	var out [][]float64
+	for ; int(s.pos)+1 < len(seq); s.pos += step {
+		i := int(s.pos)
+		frac := s.pos - float64(i)
+		frame := make([]float64, s.channels)
+		for ch := range frame {
+			frame[ch] = seq[i][ch]*(1-frac) + seq[i+1][ch]*frac
+		}
+		out = append(out, frame)
+	}
+	s.pos -= float64(len(seq) - 1)
+	s.prev = seq[len(seq)-1]
+	return out
+}
+
+// remix maps one frame to channels outputs: mono is averaged or duplicated,
+// other layouts keep the channels they share
+func remix(in []float64, channels int) []float64 {
+	if len(in) == channels {
+		return in
+	}
+	out := make([]float64, channels)
+	switch {
+	case channels == 1:
+		for _, v := range in {
+			out[0] += v / float64(len(in))
+		}
+	case len(in) == 1:
+		for ch := range out {
+			out[ch] = in[0]
+		}
+	default:
+		copy(out, in)
+	}
+	return out
+}
+
+// Close releases the encoder
+func (s *opusStream) Close() {
+	s.enc.Close()
+}
@@ -0,0 +1,23 @@
+package main
+
+// resumeCursor returns where a client resuming after lastID starts: the
+// chunk after lastID, or the oldest buffered one if that has gone. It also
+// returns how many chunks are already due at the client's delay, and how many
+// it missed have left the buffer. An ID the buffer has not reached, as after
+// a relay restart, starts the client at its play point like a new one.
+func (r *AudioRelay) resumeCursor(lastID int64, delayMs int) (cursor, replay, missed int64) {
+	oldest, newest := r.buffer.SeqRange()
+	if oldest < 0 || lastID > newest {
+		return -1, 0, 0
+	}
+
+	cursor = lastID + 1
+	if cursor < oldest {
+		missed = oldest - cursor
+		cursor = oldest
+	}
+	if due := r.buffer.SeqAtDelay(float64(delayMs) / 1000.0); due >= cursor {
+		replay = due - cursor + 1
+	}
+	return cursor, replay, missed
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"audio-common/chunkproto"
+)
+
+// RTP ingest settings
+const (
+	rtpReorderWindow  = 40 * time.Millisecond // how long a gap may wait for a late packet
+	rtpDefaultChunkMs = 100                   // length of assembled chunks, reported to the buffer
+	rtpIdleTimeout    = time.Second
+
+	// Sample rates accepted in an rtpmap. At the lowest, even a 10ms chunk
+	// holds 80 frames.
+	rtpMinSampleRate = 8000
+	rtpMaxSampleRate = 192000
+)
+
+// rtpFormat is the payload format of an RTP stream, as in an SDP rtpmap
+type rtpFormat struct {
+	PayloadType int
+	Bits        int // 16 for L16, 24 for L24
+	SampleRate  int
+	Channels    int
+}
+
+// parseRTPMap parses an rtpmap encoding such as "L16/48000/2"
+func parseRTPMap(s string) (rtpFormat, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) < 2 {
+		return rtpFormat{}, fmt.Errorf("invalid rtpmap %q", s)
+	}
+
+	f := rtpFormat{PayloadType: -1, Channels: 1}
+	switch strings.ToUpper(parts[0]) {
+	case "L16":
+		f.Bits = 16
+	case "L24":
+		f.Bits = 24
+	default:
+		return rtpFormat{}, fmt.Errorf("unsupported RTP encoding %q", parts[0])
+	}
+	rate, err := strconv.Atoi(parts[1])
+	if err != nil || rate < rtpMinSampleRate || rate > rtpMaxSampleRate {
+		return rtpFormat{}, fmt.Errorf("invalid rtpmap rate %q: want %d-%d", parts[1], rtpMinSampleRate, rtpMaxSampleRate)
+	}
+	f.SampleRate = rate
+	if len(parts) > 2 {
+		channels, err := strconv.Atoi(parts[2])
+		if err != nil || channels < 1 || channels > 8 {
+			return rtpFormat{}, fmt.Errorf("invalid rtpmap channels %q", parts[2])
+		}
+		f.Channels = channels
+	}
+	return f, nil
+}
+
+// staticRTPFormat returns the RFC 3551 format of static payload types 10 and 11
+func staticRTPFormat(payloadType int) (rtpFormat, bool) {
+	switch payloadType {
+	case 10:
+		return rtpFormat{PayloadType: 10, Bits: 16, SampleRate: 44100, Channels: 2}, true
+	case 11:
+		return rtpFormat{PayloadType: 11, Bits: 16, SampleRate: 44100, Channels: 1}, true
+	}
+	return rtpFormat{}, false
+}
+
+// parseSDP returns the audio format and SSRC (zero when absent) described by an SDP
+func parseSDP(r io.Reader) (rtpFormat, uint32, error) {
+	format := rtpFormat{PayloadType: -1}
+	var ssrc uint32
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "m=audio "):
+			fields := strings.Fields(line)
+			if len(fields) >= 4 {
+				format.PayloadType, _ = strconv.Atoi(fields[3])
+			}
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) != 2 {
+				continue
+			}
+			pt, err := strconv.Atoi(fields[0])
+			if err != nil || pt != format.PayloadType {
+				continue
+			}
+			f, err := parseRTPMap(fields[1])
+			if err != nil {
+				return rtpFormat{}, 0, err
+			}
+			f.PayloadType = pt
+			format = f
+		case strings.HasPrefix(line, "a=ssrc:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=ssrc:"))
+			if len(fields) == 0 {
+				continue
+			}
+			if v, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				ssrc = uint32(v)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return rtpFormat{}, 0, err
+	}
+
+	if format.Bits == 0 {
+		if static, ok := staticRTPFormat(format.PayloadType); ok {
+			return static, ssrc, nil
+		}
+		return rtpFormat{}, 0, errors.New("SDP has no usable audio rtpmap")
+	}
+	return format, ssrc, nil
+}
+
+// rtpPacket is a received packet waiting in the reorder buffer
+type rtpPacket struct {
+	timestamp uint32
+	payload   []byte
+	arrival   time.Time
+}
+
+// rtpStats counts what happened to received packets
+type rtpStats struct {
+	Packets    uint64  `json:"packets"`
+	Lost       uint64  `json:"lost"`
+	Reordered  uint64  `json:"reordered"`
+	Late       uint64  `json:"late"` // arrived after their gap was given up as lost
+	Duplicates uint64  `json:"duplicates"`
+	Concealed  uint64  `json:"concealed_frames"`
+	JitterMs   float64 `json:"jitter_ms"`
+	Streams    uint64  `json:"streams"`
+}
+
+// rtpReceiver receives an L16/L24 RTP stream on a UDP port, puts packets back
+// in sequence order, fills losses with silence and hands chunks of chunkMs to
+// the relay in the same form as chunks from the source's /stream
+type rtpReceiver struct {
+	listen  string
+	sdpURL  string     // where to learn the format of dynamic payload types
+	fixed   *rtpFormat // format given by AUDIO_RTP_FORMAT, used instead of the SDP
+	chunkMs int
+
+	mu         sync.Mutex
+	format     rtpFormat
+	ssrc       uint32
+	active     bool      // a stream with a known format is being received
+	retryAt    time.Time // next format lookup for a stream that failed one
+	lastPacket time.Time
+	stats      rtpStats
+
+	// Reorder state, in extended (wrap-free) sequence numbers
+	highest  int64
+	expected int64
+	pending  map[int64]rtpPacket
+	nextTS   uint32
+	tsValid  bool
+
+	// Jitter estimate state (RFC 3550 section 6.4.1)
+	transit     float64
+	jitter      float64
+	haveTransit bool
+
+	// Chunk assembly
+	chunk      []byte
+	chunkStart time.Time
+	chunkTS    uint32
+	chunkIndex int
+}
+
+// rtpReceiverFromEnv reads AUDIO_RTP_LISTEN (a UDP address such as ":5004" or
+// "239.1.2.3:5004"), AUDIO_RTP_FORMAT (an rtpmap such as "L16/48000/2"),
+// AUDIO_RTP_SDP (the SDP URL, by default the source's /rtp.sdp) and
+// AUDIO_RTP_CHUNK_MS (the chunk length, 10-1000 ms). It returns nil when RTP
+// ingest is off.
+func rtpReceiverFromEnv(sourceURL string) (*rtpReceiver, error) {
+	listen := os.Getenv("AUDIO_RTP_LISTEN")
+	if listen == "" {
+		return nil, nil
+	}
+
+	r := &rtpReceiver{
+		listen:  listen,
+		sdpURL:  os.Getenv("AUDIO_RTP_SDP"),
+		chunkMs: rtpDefaultChunkMs,
+		pending: make(map[int64]rtpPacket),
+	}
+	if r.sdpURL == "" {
+		r.sdpURL = sourceURL + "/rtp.sdp"
+	}
+	if v := os.Getenv("AUDIO_RTP_FORMAT"); v != "" {
+		f, err := parseRTPMap(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUDIO_RTP_FORMAT: %w", err)
+		}
+		r.fixed = &f
+	}
+	if v := os.Getenv("AUDIO_RTP_CHUNK_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 10 || ms > 1000 {
+			return nil, fmt.Errorf("invalid AUDIO_RTP_CHUNK_MS %q: want 10-1000 ms", v)
+		}
+		r.chunkMs = ms
+	}
+	return r, nil
+}
+
+// Receive reads packets until ctx is done, passing completed chunks to handle
+func (r *rtpReceiver) Receive(ctx context.Context, handle func(sourceMessage)) error {
+	addr, err := net.ResolveUDPAddr("udp", r.listen)
+	if err != nil {
+		return fmt.Errorf("failed to resolve RTP listen address: %w", err)
+	}
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen for RTP: %w", err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	log.Printf("Receiving RTP on %s", addr)
+
+	buf := make([]byte, 65536)
+	for {
+		// Wake up regularly so gaps are given up even when packets stop
+		conn.SetReadDeadline(time.Now().Add(rtpReorderWindow / 2))
+		n, _, err := conn.ReadFromUDP(buf)
+		now := time.Now()
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("failed to read RTP packet: %w", err)
+			}
+		} else {
+			r.handlePacket(buf[:n], now)
+		}
+		for _, chunk := range r.drain(now) {
+			handle(sourceMessage{Event: chunkproto.EventChunk, Chunk: chunk})
+		}
+	}
+}
+
+// handlePacket validates a packet and adds it to the reorder buffer
+func (r *rtpReceiver) handlePacket(packet []byte, now time.Time) {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return
+	}
+	// Skip CSRCs and any header extension; drop padding
+	offset := 12 + int(packet[0]&0x0F)*4
+	if packet[0]&0x10 != 0 {
+		if len(packet) < offset+4 {
+			return
+		}
+		offset += 4 + int(binary.BigEndian.Uint16(packet[offset+2:]))*4
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 && end > offset {
+		end -= int(packet[end-1])
+	}
+	if offset > end {
+		return
+	}
+
+	payloadType := int(packet[1] & 0x7F)
+	seq := binary.BigEndian.Uint16(packet[2:])
+	timestamp := binary.BigEndian.Uint32(packet[4:])
+	ssrc := binary.BigEndian.Uint32(packet[8:])
+
+	// Stream state is only written from this goroutine, so it can be read
+	// without the lock while the format is looked up
+	if ssrc != r.ssrc || !r.active {
+		if ssrc == r.ssrc && now.Before(r.retryAt) {
+			return
+		}
+		// A new stream: learn its format and start over
+		format, err := r.lookupFormat(payloadType, ssrc)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err != nil {
+			if ssrc != r.ssrc {
+				log.Printf("Ignoring RTP stream %08x: %v", ssrc, err)
+			}
+			r.ssrc = ssrc
+			r.active = false
+			r.retryAt = now.Add(time.Second)
+			return
+		}
+		log.Printf("RTP stream %08x: L%d/%d/%d", ssrc, format.Bits, format.SampleRate, format.Channels)
+		r.startStream(ssrc, format, seq)
+	} else {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	}
+	r.lastPacket = now
+	r.stats.Packets++
+
+	// Extend the sequence number relative to the highest seen so far
+	ext := r.highest + int64(int16(seq-uint16(r.highest)))
+	switch {
+	case ext < r.expected:
+		r.stats.Late++
+		return
+	case r.pending[ext].payload != nil:
+		r.stats.Duplicates++
+		return
+	case ext < r.highest:
+		r.stats.Reordered++
+	default:
+		r.highest = ext
+	}
+
+	payload := append([]byte(nil), packet[offset:end]...)
+	r.pending[ext] = rtpPacket{timestamp: timestamp, payload: payload, arrival: now}
+	r.updateJitter(timestamp, now)
+}
+
+// lookupFormat finds the format of a new stream
+func (r *rtpReceiver) lookupFormat(payloadType int, ssrc uint32) (rtpFormat, error) {
+	if r.fixed != nil {
+		return *r.fixed, nil
+	}
+	if f, ok := staticRTPFormat(payloadType); ok {
+		return f, nil
+	}
+
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(r.sdpURL)
+	if err != nil {
+		return rtpFormat{}, fmt.Errorf("failed to fetch SDP: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rtpFormat{}, fmt.Errorf("failed to fetch SDP: %s", resp.Status)
+	}
+	format, sdpSSRC, err := parseSDP(resp.Body)
+	if err != nil {
+		return rtpFormat{}, err
+	}
+	if format.PayloadType != payloadType || (sdpSSRC != 0 && sdpSSRC != ssrc) {
+		return rtpFormat{}, errors.New("SDP describes a different stream")
+	}
+	return format, nil
+}
+
+// startStream resets sequencing and assembly for a new stream; the caller holds mu
+func (r *rtpReceiver) startStream(ssrc uint32, format rtpFormat, seq uint16) {
+	r.ssrc = ssrc
+	r.format = format
+	r.active = true
+	r.stats.Streams++
+
+	r.highest = int64(seq)
+	r.expected = int64(seq)
+	r.pending = make(map[int64]rtpPacket)
+	r.tsValid = false
+	r.haveTransit = false
+	r.jitter = 0
+	r.chunk = nil
+}
+
+// updateJitter folds a packet into the interarrival jitter estimate; the
+// caller holds mu
+func (r *rtpReceiver) updateJitter(timestamp uint32, arrival time.Time) {
+	arrivalUnits := float64(arrival.UnixNano()) * float64(r.format.SampleRate) / 1e9
+	transit := arrivalUnits - float64(timestamp)
+	if r.haveTransit {
+		d := math.Abs(transit - r.transit)
+		// Timestamp wrap-around shows up as a huge jump; ignore it
+		if d < float64(r.format.SampleRate) {
+			r.jitter += (d - r.jitter) / 16
+		}
+	}
+	r.transit = transit
+	r.haveTransit = true
+	r.stats.JitterMs = r.jitter * 1000 / float64(r.format.SampleRate)
+}
+
+// drain releases packets in sequence order, giving up on gaps that have
+// waited longer than the reorder window, and returns any completed chunks
+func (r *rtpReceiver) drain(now time.Time) []*Chunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var chunks []*Chunk
+	for r.active && len(r.pending) > 0 {
+		if p, ok := r.pending[r.expected]; ok {
+			delete(r.pending, r.expected)
+			r.expected++
+			chunks = append(chunks, r.appendPacket(p)...)
+			continue
+		}
+
+		// The gap is lost once the packet after it has waited long enough
+		next := int64(math.MaxInt64)
+		for seq := range r.pending {
+			if seq < next {
+				next = seq
+			}
+		}
+		if now.Sub(r.pending[next].arrival) < rtpReorderWindow {
+			break
+		}
+		r.stats.Lost += uint64(next - r.expected)
+		r.expected = next
+	}
+
+	if r.active && now.Sub(r.lastPacket) > rtpIdleTimeout {
+		log.Printf("RTP stream %08x stopped", r.ssrc)
+		r.active = false
+	}
+	return chunks
+}
+
+// appendPacket adds a packet's audio to the chunk being assembled, with
+// silence for any frames skipped since the previous packet; the caller holds mu
+func (r *rtpReceiver) appendPacket(p rtpPacket) []*Chunk {
+	width := r.format.Bits / 8
+	frameSize := width * r.format.Channels
+	frames := len(p.payload) / frameSize
+
+	if r.tsValid {
+		// Conceal up to a second of lost audio; anything else is a discontinuity
+		if gap := int32(p.timestamp - r.nextTS); gap > 0 && int(gap) < r.format.SampleRate {
+			r.stats.Concealed += uint64(gap)
+			r.appendAudio(make([]byte, int(gap)*frameSize), p.arrival, r.nextTS)
+		}
+	}
+	r.nextTS = p.timestamp + uint32(frames)
+	r.tsValid = true
+
+	// Payloads are big-endian; chunks carry little-endian PCM
+	le := make([]byte, frames*frameSize)
+	for i := 0; i < frames*r.format.Channels; i++ {
+		for b := 0; b < width; b++ {
+			le[i*width+b] = p.payload[i*width+width-1-b]
+		}
+	}
+	return r.appendAudio(le, p.arrival, p.timestamp)
+}
+
+// appendAudio accumulates little-endian PCM and returns the chunks it completes
+func (r *rtpReceiver) appendAudio(pcm []byte, arrival time.Time, timestamp uint32) []*Chunk {
+	frameSize := r.format.Bits / 8 * r.format.Channels
+	chunkSize := r.format.SampleRate * r.chunkMs / 1000 * frameSize
+
+	var chunks []*Chunk
+	for len(pcm) > 0 {
+		if len(r.chunk) == 0 {
+			r.chunkStart = arrival
+			r.chunkTS = timestamp
+		}
+		n := chunkSize - len(r.chunk)
+		if n > len(pcm) {
+			n = len(pcm)
+		}
+		r.chunk = append(r.chunk, pcm[:n]...)
+		pcm = pcm[n:]
+		timestamp += uint32(n / frameSize)
+
+		if len(r.chunk) == chunkSize {
+			chunks = append(chunks, r.chunkMessage())
+			r.chunk = nil
+		}
+	}
+	return chunks
+}
+
+// chunkMessage describes the assembled chunk like a source chunk. The
+// timestamp is the arrival time of its first packet, since RTP carries no
+// wall clock time without RTCP, and the event ID counts chunks since start.
+func (r *rtpReceiver) chunkMessage() *Chunk {
+	f := r.format
+	rtpTimestamp := r.chunkTS
+	chunk := &Chunk{
+		Header: chunkproto.Header{
+			ProtocolVersion: chunkproto.Version,
+			IntervalID:      fmt.Sprintf("rtp-%08x", r.ssrc),
+			Position:        r.chunkIndex,
+			Timestamp:       r.chunkStart.UnixMilli(),
+			EventID:         int64(r.chunkIndex),
+			SampleRate:      f.SampleRate,
+			Channels:        f.Channels,
+			SampleWidth:     f.Bits / 8,
+			AudioFormat: map[string]int{
+				"channels":        f.Channels,
+				"sample_rate":     f.SampleRate,
+				"bits_per_sample": f.Bits,
+				"format_tag":      1,
+				"block_align":     f.Bits / 8 * f.Channels,
+				"valid_bits":      f.Bits,
+			},
+		},
+		sourceVersion: chunkproto.Version,
+		RTPTimestamp:  &rtpTimestamp,
+		Audio:         r.chunk,
+	}
+	r.chunkIndex++
+	return chunk
+}
+
+// receiving reports whether packets of a known stream are arriving
+func (r *rtpReceiver) receiving() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active
+}
+
+// info describes the RTP ingest for /status
+func (r *rtpReceiver) info() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info := map[string]interface{}{
+		"listen":    r.listen,
+		"receiving": r.active,
+		"chunk_ms":  r.chunkMs,
+		"stats":     r.stats,
+	}
+	if r.active {
+		info["ssrc"] = r.ssrc
+		info["format"] = fmt.Sprintf("L%d/%d/%d", r.format.Bits, r.format.SampleRate, r.format.Channels)
+		info["payload_type"] = r.format.PayloadType
+	}
+	return info
+}
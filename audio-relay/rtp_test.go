@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"audio-common/chunkproto"
+)
+
+// Test packets are 10ms of L16/8000 mono, numbered by their place in the
+// stream: packet n starts at timestamp rtpTestTS+80n and its samples count
+// up from there
+const (
+	rtpTestFrames = 80
+	rtpTestTS     = 1000
+	rtpTestSSRC   = 0x1111
+	rtpTestType   = 96
+)
+
+// rtpTestPacket builds packet n of a stream with the given sequence number
+func rtpTestPacket(ssrc uint32, seq uint16, n int) []byte {
+	packet := make([]byte, 12, 12+2*rtpTestFrames)
+	packet[0] = 0x80
+	packet[1] = rtpTestType
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], uint32(rtpTestTS+rtpTestFrames*n))
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	for i := 0; i < rtpTestFrames; i++ {
+		packet = binary.BigEndian.AppendUint16(packet, uint16(rtpTestTS+rtpTestFrames*n+i))
+	}
+	return packet
+}
+
+// describeRTPAudio names each packet's worth of little-endian chunk audio by
+// its packet number, or "-" for concealed silence
+func describeRTPAudio(pcm []byte) string {
+	var blocks []string
+	for ; len(pcm) >= 2*rtpTestFrames; pcm = pcm[2*rtpTestFrames:] {
+		first := int(binary.LittleEndian.Uint16(pcm))
+		if first == 0 {
+			blocks = append(blocks, "-")
+			continue
+		}
+		blocks = append(blocks, strconv.Itoa((first-rtpTestTS)/rtpTestFrames))
+	}
+	return strings.Join(blocks, " ")
+}
+
+// rtpArrival is a packet reaching the receiver at a time in ms
+type rtpArrival struct {
+	at   int
+	seq  uint16
+	n    int    // packet number, for the timestamp and samples
+	ssrc uint32 // rtpTestSSRC when zero
+}
+
+func TestRTPReceiverReorder(t *testing.T) {
+	cases := []struct {
+		name     string
+		arrivals []rtpArrival
+		audio    string // packets delivered, in order
+		chunks   int
+		want     rtpStats
+	}{
+		{
+			name: "in order",
+			arrivals: []rtpArrival{
+				{0, 100, 0, 0}, {10, 101, 1, 0}, {20, 102, 2, 0}, {30, 103, 3, 0}, {40, 104, 4, 0}, {50, 105, 5, 0},
+				{60, 106, 6, 0}, {70, 107, 7, 0}, {80, 108, 8, 0}, {90, 109, 9, 0}, {100, 110, 10, 0}, {110, 111, 11, 0},
+			},
+			audio:  "0 1 2 3 4 5 6 7 8 9 10 11",
+			chunks: 1,
+			want:   rtpStats{Packets: 12, Streams: 1},
+		},
+		{
+			name:     "reordered inside the window",
+			arrivals: []rtpArrival{{0, 100, 0, 0}, {10, 101, 1, 0}, {20, 103, 3, 0}, {45, 102, 2, 0}, {50, 104, 4, 0}},
+			audio:    "0 1 2 3 4",
+			want:     rtpStats{Packets: 5, Reordered: 1, Streams: 1},
+		},
+		{
+			name: "gap given up, then the late packet",
+			// Packet 3 has waited 40ms by 60ms, so 2 is lost and arrives late
+			arrivals: []rtpArrival{{0, 100, 0, 0}, {10, 101, 1, 0}, {20, 103, 3, 0}, {60, 104, 4, 0}, {65, 102, 2, 0}},
+			audio:    "0 1 - 3 4",
+			want:     rtpStats{Packets: 5, Lost: 1, Late: 1, Concealed: rtpTestFrames, Streams: 1},
+		},
+		{
+			name:     "duplicate",
+			arrivals: []rtpArrival{{0, 100, 0, 0}, {10, 102, 2, 0}, {12, 102, 2, 0}, {15, 101, 1, 0}},
+			audio:    "0 1 2",
+			want:     rtpStats{Packets: 4, Reordered: 1, Duplicates: 1, Streams: 1},
+		},
+		{
+			name:     "sequence wrap",
+			arrivals: []rtpArrival{{0, 65534, 0, 0}, {10, 0, 2, 0}, {15, 65535, 1, 0}, {20, 1, 3, 0}},
+			audio:    "0 1 2 3",
+			want:     rtpStats{Packets: 4, Reordered: 1, Streams: 1},
+		},
+		{
+			name: "SSRC change",
+			// The new stream starts over; the old one's partial chunk is dropped
+			arrivals: []rtpArrival{{0, 100, 0, 0}, {10, 101, 1, 0}, {20, 500, 5, 0x2222}, {30, 501, 6, 0x2222}},
+			audio:    "5 6",
+			want:     rtpStats{Packets: 4, Streams: 2},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			format := rtpFormat{PayloadType: rtpTestType, Bits: 16, SampleRate: 8000, Channels: 1}
+			r := &rtpReceiver{fixed: &format, chunkMs: rtpDefaultChunkMs, pending: make(map[int64]rtpPacket)}
+			start := time.Now()
+
+			var audio []byte
+			chunks := 0
+			deliver := func(at time.Time) {
+				for _, chunk := range r.drain(at) {
+					audio = append(audio, chunk.Audio...)
+					chunks++
+				}
+			}
+			for _, a := range tc.arrivals {
+				ssrc := a.ssrc
+				if ssrc == 0 {
+					ssrc = rtpTestSSRC
+				}
+				at := start.Add(time.Duration(a.at) * time.Millisecond)
+				r.handlePacket(rtpTestPacket(ssrc, a.seq, a.n), at)
+				deliver(at)
+			}
+			audio = append(audio, r.chunk...)
+
+			if got := describeRTPAudio(audio); got != tc.audio {
+				t.Errorf("delivered %q, want %q", got, tc.audio)
+			}
+			if chunks != tc.chunks {
+				t.Errorf("%d chunks, want %d", chunks, tc.chunks)
+			}
+			r.stats.JitterMs = 0
+			if r.stats != tc.want {
+				t.Errorf("stats %+v, want %+v", r.stats, tc.want)
+			}
+		})
+	}
+}
+
+func TestRTPReceiverChunkMessage(t *testing.T) {
+	format := rtpFormat{PayloadType: rtpTestType, Bits: 16, SampleRate: 8000, Channels: 1}
+	r := &rtpReceiver{fixed: &format, chunkMs: rtpDefaultChunkMs, pending: make(map[int64]rtpPacket)}
+	start := time.Now()
+
+	var chunks []*Chunk
+	for n := 0; n < 20; n++ {
+		at := start.Add(time.Duration(10*n) * time.Millisecond)
+		r.handlePacket(rtpTestPacket(rtpTestSSRC, uint16(n), n), at)
+		chunks = append(chunks, r.drain(at)...)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("%d chunks from 200ms of packets, want 2", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk.Audio) != 1600 || chunk.Position != i || chunk.IntervalID != "rtp-00001111" || chunk.ProtocolVersion != chunkproto.Version {
+			t.Errorf("chunk %d: %d bytes at position %d of %s, version %d", i, len(chunk.Audio), chunk.Position, chunk.IntervalID, chunk.ProtocolVersion)
+		}
+		if chunk.RTPTimestamp == nil || *chunk.RTPTimestamp != uint32(rtpTestTS+800*i) || chunk.Timestamp != start.Add(time.Duration(100*i)*time.Millisecond).UnixMilli() {
+			t.Errorf("chunk %d: RTP timestamp %v, timestamp %d", i, chunk.RTPTimestamp, chunk.Timestamp)
+		}
+	}
+	if f := chunks[0].AudioFormat; f["sample_rate"] != 8000 || f["bits_per_sample"] != 16 || f["block_align"] != 2 {
+		t.Errorf("audio format %v", f)
+	}
+}
+
+func TestParseRTPMap(t *testing.T) {
+	cases := []struct {
+		in   string
+		want rtpFormat // zero for an error
+	}{
+		{"L16/48000/2", rtpFormat{PayloadType: -1, Bits: 16, SampleRate: 48000, Channels: 2}},
+		{" l24/44100 ", rtpFormat{PayloadType: -1, Bits: 24, SampleRate: 44100, Channels: 1}},
+		{"L16/8000/8", rtpFormat{PayloadType: -1, Bits: 16, SampleRate: 8000, Channels: 8}},
+		{"L24/192000/1", rtpFormat{PayloadType: -1, Bits: 24, SampleRate: 192000, Channels: 1}},
+		{"L16", rtpFormat{}},
+		{"PCMU/8000", rtpFormat{}},
+		{"L16/x/2", rtpFormat{}},
+		{"L16/4/1", rtpFormat{}}, // too slow to fill a chunk
+		{"L16/7999", rtpFormat{}},
+		{"L16/384000", rtpFormat{}},
+		{"L16/48000/0", rtpFormat{}},
+		{"L16/48000/9", rtpFormat{}},
+	}
+	for _, tc := range cases {
+		got, err := parseRTPMap(tc.in)
+		if (err != nil) != (tc.want == rtpFormat{}) || got != tc.want {
+			t.Errorf("parseRTPMap(%q) = %+v, %v; want %+v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseSDP(t *testing.T) {
+	cases := []struct {
+		name   string
+		sdp    string
+		format rtpFormat // zero for an error
+		ssrc   uint32
+	}{
+		{
+			name: "audio-source description",
+			sdp: "v=0\r\no=- 42 3 IN IP4 10.0.0.5\r\ns=k8s-audio-lab\r\nc=IN IP4 239.255.0.1/1\r\nt=0 0\r\n" +
+				"m=audio 5004 RTP/AVP 96\r\na=rtpmap:96 L24/48000/2\r\na=ptime:5\r\na=ssrc:305419896 cname:k8s-audio-lab\r\n",
+			format: rtpFormat{PayloadType: 96, Bits: 24, SampleRate: 48000, Channels: 2},
+			ssrc:   305419896,
+		},
+		{
+			name:   "static payload type",
+			sdp:    "v=0\nm=audio 5004 RTP/AVP 11\n",
+			format: rtpFormat{PayloadType: 11, Bits: 16, SampleRate: 44100, Channels: 1},
+		},
+		{
+			name:   "rtpmap of another payload type",
+			sdp:    "m=audio 5004 RTP/AVP 97\na=rtpmap:96 L16/48000/2\na=rtpmap:97 L16/32000\n",
+			format: rtpFormat{PayloadType: 97, Bits: 16, SampleRate: 32000, Channels: 1},
+		},
+		{
+			name:   "bare ssrc attribute",
+			sdp:    "m=audio 5004 RTP/AVP 96\na=rtpmap:96 L16/48000/2\na=ssrc:\n",
+			format: rtpFormat{PayloadType: 96, Bits: 16, SampleRate: 48000, Channels: 2},
+		},
+		{
+			name: "no rtpmap for a dynamic type",
+			sdp:  "m=audio 5004 RTP/AVP 96\na=rtpmap:97 L16/48000/2\n",
+		},
+		{
+			name: "unsupported encoding",
+			sdp:  "m=audio 5004 RTP/AVP 96\na=rtpmap:96 opus/48000/2\n",
+		},
+		{
+			name: "rate too low",
+			sdp:  "m=audio 5004 RTP/AVP 96\na=rtpmap:96 L16/4/1\n",
+		},
+	}
+	for _, tc := range cases {
+		format, ssrc, err := parseSDP(strings.NewReader(tc.sdp))
+		if (err != nil) != (tc.format == rtpFormat{}) || format != tc.format || ssrc != tc.ssrc {
+			t.Errorf("%s: got %+v, ssrc %d, %v; want %+v, ssrc %d", tc.name, format, ssrc, err, tc.format, tc.ssrc)
+		}
+	}
+}
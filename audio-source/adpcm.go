@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// wavFormatIMAADPCM is the WAV format tag for IMA/DVI ADPCM
+const wavFormatIMAADPCM = 0x0011
+
+var imaIndexTable = [16]int{-1, -1, -1, -1, 2, 4, 6, 8, -1, -1, -1, -1, 2, 4, 6, 8}
+
+var imaStepTable = [89]int{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17,
+	19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+	50, 55, 60, 66, 73, 80, 88, 97, 107, 118,
+	130, 143, 157, 173, 190, 209, 230, 253, 279, 307,
+	337, 371, 408, 449, 494, 544, 598, 658, 724, 796,
+	876, 963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066,
+	2272, 2499, 2749, 3024, 3327, 3660, 4026, 4428, 4871, 5358,
+	5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487, 12635, 13899,
+	15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767,
+}
+
+// imaChannel holds the decoder state for one channel
+type imaChannel struct {
+	predictor int
+	index     int
+}
+
+// decodeNibble expands one 4-bit code and advances the channel state
+func (c *imaChannel) decodeNibble(nibble byte) int16 {
+	step := imaStepTable[c.index]
+	diff := step >> 3
+	if nibble&4 != 0 {
+		diff += step
+	}
+	if nibble&2 != 0 {
+		diff += step >> 1
+	}
+	if nibble&1 != 0 {
+		diff += step >> 2
+	}
+	if nibble&8 != 0 {
+		c.predictor -= diff
+	} else {
+		c.predictor += diff
+	}
+
+	if c.predictor > 32767 {
+		c.predictor = 32767
+	} else if c.predictor < -32768 {
+		c.predictor = -32768
+	}
+
+	c.index += imaIndexTable[nibble]
+	if c.index < 0 {
+		c.index = 0
+	} else if c.index > 88 {
+		c.index = 88
+	}
+
+	return int16(c.predictor)
+}
+
+// imaSamplesPerBlock returns the number of frames encoded in a block of the given size
+func imaSamplesPerBlock(blockAlign, channels int) int {
+	return (blockAlign-4*channels)*2/channels + 1
+}
+
+// validateIMAADPCM checks the block layout of an IMA ADPCM format
+func (f wavFormat) validateIMAADPCM() error {
+	if f.BitsPerSample != 4 {
+		return fmt.Errorf("unsupported IMA ADPCM bit depth: %d", f.BitsPerSample)
+	}
+	channels := int(f.NumChannels)
+	if int(f.BlockAlign) <= 4*channels || (int(f.BlockAlign)-4*channels)%(4*channels) != 0 {
+		return fmt.Errorf("invalid IMA ADPCM block align %d for %d channels", f.BlockAlign, channels)
+	}
+	if expected := imaSamplesPerBlock(int(f.BlockAlign), channels); f.SamplesPerBlock != 0 && int(f.SamplesPerBlock) != expected {
+		return fmt.Errorf("IMA ADPCM block of %d bytes holds %d samples, header says %d",
+			f.BlockAlign, expected, f.SamplesPerBlock)
+	}
+	return nil
+}
+
+// decodeIMAADPCM expands IMA ADPCM blocks to interleaved 16-bit little-endian PCM.
+// A truncated final block is decoded as far as it goes.
+func decodeIMAADPCM(data []byte, blockAlign, channels int) []byte {
+	headerSize := 4 * channels
+	groupSize := 4 * channels
+	out := make([]byte, 0, len(data)/blockAlign*imaSamplesPerBlock(blockAlign, channels)*channels*2+channels*2)
+	state := make([]imaChannel, channels)
+
+	for offset := 0; offset+headerSize <= len(data); offset += blockAlign {
+		end := offset + blockAlign
+		if end > len(data) {
+			end = len(data)
+		}
+		block := data[offset:end]
+
+		// Each channel header carries the first sample verbatim
+		frame := make([]int16, channels)
+		for ch := 0; ch < channels; ch++ {
+			h := block[ch*4:]
+			state[ch].predictor = int(int16(binary.LittleEndian.Uint16(h)))
+			state[ch].index = int(h[2])
+			if state[ch].index > 88 {
+				state[ch].index = 88
+			}
+			frame[ch] = int16(state[ch].predictor)
+		}
+		out = appendSamples(out, frame)
+
+		// Channels are interleaved in 4-byte groups of 8 samples each
+		groups := (len(block) - headerSize) / groupSize
+		samples := make([]int16, channels*8)
+		for g := 0; g < groups; g++ {
+			base := headerSize + g*groupSize
+			for ch := 0; ch < channels; ch++ {
+				for i, b := range block[base+ch*4 : base+ch*4+4] {
+					samples[(i*2)*channels+ch] = state[ch].decodeNibble(b & 0x0F)
+					samples[(i*2+1)*channels+ch] = state[ch].decodeNibble(b >> 4)
+				}
+			}
+			out = appendSamples(out, samples)
+		}
+	}
+
+	return out
+}
+
+// appendSamples appends interleaved samples as 16-bit little-endian PCM
+func appendSamples(out []byte, samples []int16) []byte {
+	for _, s := range samples {
+		out = binary.LittleEndian.AppendUint16(out, uint16(s))
+	}
+	return out
+}
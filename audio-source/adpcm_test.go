@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// samples16 reads 16-bit little-endian PCM
+func samples16(pcm []byte) []int16 {
+	out := make([]int16, len(pcm)/2)
+	for i := range out {
+		out[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return out
+}
+
+// A mono block starting from predictor 1000 at step index 10, worked through
+// the IMA step and index tables by hand
+var imaMonoBlock = []byte{
+	0xE8, 0x03, 10, 0, // predictor 1000, step index 10
+	0x07, 0x8F, 0x00, 0x70, // nibbles 7 0 F 8 0 0 0 7, low first
+}
+
+var imaMonoSamples = []int16{1000, 1034, 1039, 971, 961, 970, 978, 985, 1086}
+
+func TestDecodeIMAADPCMKnownVector(t *testing.T) {
+	got := samples16(decodeIMAADPCM(imaMonoBlock, len(imaMonoBlock), 1))
+	if !reflect.DeepEqual(got, imaMonoSamples) {
+		t.Errorf("decoded %v, want %v", got, imaMonoSamples)
+	}
+}
+
+func TestDecodeIMAADPCMStereo(t *testing.T) {
+	block := []byte{
+		0xE8, 0x03, 10, 0, // left: predictor 1000, index 10
+		0x18, 0xFC, 0, 0, // right: predictor -1000, index 0
+		0x07, 0x8F, 0x00, 0x70, // left nibbles
+		0x11, 0x11, 0x11, 0x11, // right nibbles, all 1
+	}
+	got := samples16(decodeIMAADPCM(block, len(block), 2))
+
+	// Index 0 steps by 7 and stays at 0 for nibble 1: diff 0 + 1 each sample
+	right := []int16{-1000, -999, -998, -997, -996, -995, -994, -993, -992}
+	if len(got) != 2*len(imaMonoSamples) {
+		t.Fatalf("decoded %d samples, want %d", len(got), 2*len(imaMonoSamples))
+	}
+	for i := range imaMonoSamples {
+		if got[2*i] != imaMonoSamples[i] || got[2*i+1] != right[i] {
+			t.Errorf("frame %d = %d/%d, want %d/%d", i, got[2*i], got[2*i+1], imaMonoSamples[i], right[i])
+		}
+	}
+}
+
+func TestDecodeIMAADPCMClamps(t *testing.T) {
+	// The predictor saturates and a step index past the table is clamped
+	block := []byte{0xBC, 0x7F, 200, 0, 0x77, 0x77, 0x77, 0x77}
+	got := samples16(decodeIMAADPCM(block, len(block), 1))
+	if got[0] != 32700 {
+		t.Errorf("header sample %d, want 32700", got[0])
+	}
+	for i, s := range got[1:] {
+		if s != 32767 {
+			t.Errorf("sample %d = %d, want 32767", i+1, s)
+		}
+	}
+}
+
+func TestDecodeIMAADPCMTruncatedBlock(t *testing.T) {
+	cases := []struct {
+		name string
+		tail []byte
+		want int
+	}{
+		// A header and a partial nibble group yields only the header sample
+		{"header and part of a group", []byte{0x10, 0x00, 0, 0, 0x12, 0x34}, len(imaMonoSamples) + 1},
+		// Less than a header is dropped
+		{"part of a header", []byte{0x10, 0x00}, len(imaMonoSamples)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append(append([]byte(nil), imaMonoBlock...), tc.tail...)
+			got := samples16(decodeIMAADPCM(data, len(imaMonoBlock), 1))
+			if len(got) != tc.want {
+				t.Fatalf("decoded %d samples, want %d", len(got), tc.want)
+			}
+			if !reflect.DeepEqual(got[:len(imaMonoSamples)], imaMonoSamples) {
+				t.Errorf("full block decoded %v, want %v", got[:len(imaMonoSamples)], imaMonoSamples)
+			}
+			if tc.want > len(imaMonoSamples) && got[len(imaMonoSamples)] != 16 {
+				t.Errorf("truncated block header sample %d, want 16", got[len(imaMonoSamples)])
+			}
+		})
+	}
+}
+
+func TestValidateIMAADPCM(t *testing.T) {
+	cases := []struct {
+		blockAlign, channels, samplesPerBlock int
+		ok                                    bool
+	}{
+		{256, 1, 505, true},
+		{256, 1, 0, true},
+		{512, 2, 505, true},
+		{256, 1, 500, false},
+		{4, 1, 0, false},
+		{258, 2, 0, false},
+	}
+	for _, tc := range cases {
+		f := wavFormat{
+			BitsPerSample:   4,
+			NumChannels:     uint16(tc.channels),
+			BlockAlign:      uint16(tc.blockAlign),
+			SamplesPerBlock: uint16(tc.samplesPerBlock),
+		}
+		if err := f.validateIMAADPCM(); (err == nil) != tc.ok {
+			t.Errorf("block %d, %d channels, %d samples: error %v", tc.blockAlign, tc.channels, tc.samplesPerBlock, err)
+		}
+	}
+}
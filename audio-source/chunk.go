@@ -0,0 +1,28 @@
+package main
+
+import "audio-common/chunkproto"
+
+// AudioChunk represents a chunk of audio with metadata in the shared chunk
+// schema, see chunkproto.Header
+type AudioChunk struct {
+	chunkproto.Header
+	Audio         string `json:"audio"`                    // hex or base64 encoded
+	AudioEncoding string `json:"audio_encoding,omitempty"` // base64 when not hex
+
+	raw  []byte // Audio before hex encoding, for binary transports
+	file string // Current file or generator, for stream metadata
+}
+
+// withEncoding returns a copy of chunk whose Audio field uses the given text
+// encoding. Hex chunks are returned unchanged.
+func (c AudioChunk) withEncoding(encoding string) AudioChunk {
+	if encoding == chunkproto.EncodingBase64 {
+		c.Audio, c.AudioEncoding = chunkproto.EncodeAudio(c.raw, encoding)
+	}
+	return c
+}
+
+// binaryFrame encodes the chunk as a chunkproto frame
+func (c AudioChunk) binaryFrame() []byte {
+	return chunkproto.EncodeFrame(c.Header, c.raw)
+}
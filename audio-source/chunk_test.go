@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"audio-common/chunkproto"
+)
+
+// testChunk builds a chunk the way the audio loop does
+func testChunk() AudioChunk {
+	raw := []byte{0x10, 0x00, 0xf0, 0xff, 0x20, 0x00, 0xe0, 0xff}
+	return AudioChunk{
+		Header: chunkproto.Header{
+			ProtocolVersion: chunkproto.Version,
+			IntervalID:      "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			LoopCount:       2,
+			Position:        7,
+			TotalChunks:     300,
+			Timestamp:       1700000000123,
+			EventID:         607,
+			SampleRate:      44100,
+			Channels:        2,
+			SampleWidth:     2,
+			AudioFormat:     map[string]int{"channels": 2, "sample_rate": 44100, "bits_per_sample": 16, "format_tag": wavFormatPCM, "block_align": 4, "valid_bits": 16},
+		},
+		Audio: hex.EncodeToString(raw),
+		raw:   raw,
+	}
+}
+
+// The relay decodes chunks with chunkproto; what the source sends must come
+// back unchanged in every encoding
+func TestAudioChunkWireRoundTrip(t *testing.T) {
+	chunk := testChunk()
+
+	header, audio, err := chunkproto.DecodeFrame(chunk.binaryFrame())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(header, chunk.Header) || !bytes.Equal(audio, chunk.raw) {
+		t.Errorf("binary frame decoded as %+v, %v", header, audio)
+	}
+
+	for _, encoding := range []string{chunkproto.EncodingHex, chunkproto.EncodingBase64} {
+		data, err := json.Marshal(chunk.withEncoding(encoding))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wire struct {
+			chunkproto.Header
+			Audio         string `json:"audio"`
+			AudioEncoding string `json:"audio_encoding"`
+		}
+		if err := json.Unmarshal(data, &wire); err != nil {
+			t.Fatal(err)
+		}
+		audio, err := chunkproto.DecodeAudio(wire.Audio, wire.AudioEncoding)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !reflect.DeepEqual(wire.Header, chunk.Header) || !bytes.Equal(audio, chunk.raw) {
+			t.Errorf("%s: JSON decoded as %+v, %v", encoding, wire.Header, audio)
+		}
+	}
+}
+
+func TestAudioChunkJSONFields(t *testing.T) {
+	data, err := json.Marshal(testChunk())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"protocol_version", "interval_id", "loop_count", "position", "total_chunks",
+		"timestamp", "event_id", "audio", "sample_rate", "channels", "sample_width", "audio_format"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("chunk JSON lacks %s", name)
+		}
+	}
+	// Hex is the default, so hex chunks carry no audio_encoding
+	if len(fields) != 12 {
+		t.Errorf("chunk JSON has %d fields, want 12: %v", len(fields), fields)
+	}
+}
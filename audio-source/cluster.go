@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// clusterNamespace scopes the interval IDs derived in cluster sync mode
+var clusterNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/navicore/k8s-audio-lab/audio-source"))
+
+// clusterSync derives playback position from a shared epoch so every replica
+// emits the same chunk at the same wall-clock instant
+type clusterSync struct {
+	epoch time.Time
+}
+
+// parseSyncEpoch reads a cluster sync epoch given as RFC 3339 or Unix
+// milliseconds. An empty value, with cluster sync off, gives the zero time.
+func parseSyncEpoch(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	epoch, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want RFC 3339 or Unix milliseconds, got %q", v)
+	}
+	return epoch, nil
+}
+
+// chunkIndex returns the chunk due at now. Epoch times carry no monotonic
+// reading, so replicas agree as long as their clocks do.
+func (c *clusterSync) chunkIndex(now time.Time, chunkDuration time.Duration) int {
+	if now.Before(c.epoch) {
+		return 0
+	}
+	return int(now.Sub(c.epoch) / chunkDuration)
+}
+
+// intervalID names a loop of the given content identically on every replica
+func (c *clusterSync) intervalID(contentHash string, loop int) string {
+	name := fmt.Sprintf("%d/%s/%d", c.epoch.UnixMilli(), contentHash, loop)
+	return uuid.NewSHA1(clusterNamespace, []byte(name)).String()
+}
+
+// info describes the sync settings for /status
+func (c *clusterSync) info(contentHash string) map[string]interface{} {
+	return map[string]interface{}{
+		"mode":         "cluster",
+		"epoch":        c.epoch.UTC().Format(time.RFC3339Nano),
+		"content_hash": contentHash,
+	}
+}
+
+// hashFile returns the SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open audio file: %w", err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash audio file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashGenerator returns a content hash for a synthetic signal, which is fully
+// determined by its configuration
+func hashGenerator(cfg generatorConfig) string {
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceConfig is the audio source's startup configuration. Each setting is
+// taken from, in rising precedence, its default, the config file, the
+// environment and the command line.
+type sourceConfig struct {
+	AudioDir        string // files offered by /switch
+	DefaultFile     string // played at startup, within AudioDir
+	ChunkDurationMs int
+	Listen          string // HTTP listen address
+	QueueDepth      int    // chunks queued per listener before it loses audio
+	Live            liveInputConfig
+	Watermark       watermarkConfig
+	SyncEpoch       time.Time // zero when cluster sync is off
+	RTP             rtpConfig
+}
+
+// configSetting is one setting, given as text by its flag, its environment
+// variable or its config file key (the flag name with underscores)
+type configSetting struct {
+	name  string
+	env   string
+	def   string
+	usage string
+	set   func(c *sourceConfig, value string) error
+}
+
+// sourceSettings lists every setting
+var sourceSettings = []configSetting{
+	{"audio-dir", "AUDIO_DIR", "/app", "directory of the WAV and FLAC files offered by /switch",
+		func(c *sourceConfig, v string) error { c.AudioDir = v; return nil }},
+	{"default-file", "AUDIO_DEFAULT_FILE", "audio.wav", "file in the audio directory played at startup",
+		func(c *sourceConfig, v string) error { c.DefaultFile = v; return nil }},
+	{"chunk-duration-ms", "AUDIO_CHUNK_DURATION_MS", "100", "chunk length in milliseconds (10-1000)",
+		func(c *sourceConfig, v string) error { return setInt(&c.ChunkDurationMs, v) }},
+	{"listen", "AUDIO_LISTEN", ":8000", "HTTP listen address, or just a port",
+		func(c *sourceConfig, v string) error { c.Listen = v; return nil }},
+	{"queue-depth", "AUDIO_QUEUE_DEPTH", "10", "chunks queued per listener before it starts losing audio",
+		func(c *sourceConfig, v string) error { return setInt(&c.QueueDepth, v) }},
+	{"input", "AUDIO_INPUT", "", "live PCM input: - for stdin, a file or FIFO path, or tcp://host:port",
+		func(c *sourceConfig, v string) error { c.Live.Input = v; return nil }},
+	{"input-format", "AUDIO_INPUT_FORMAT", "S16_LE", "sample format of raw live input (U8, S16_LE, S24_3LE, S32_LE, FLOAT_LE)",
+		func(c *sourceConfig, v string) error { c.Live.Format = v; return nil }},
+	{"input-rate", "AUDIO_INPUT_RATE", "44100", "sample rate of raw live input",
+		func(c *sourceConfig, v string) error { c.Live.Rate = v; return nil }},
+	{"input-channels", "AUDIO_INPUT_CHANNELS", "2", "channel count of raw live input",
+		func(c *sourceConfig, v string) error { c.Live.Channels = v; return nil }},
+	{"watermark", "AUDIO_WATERMARK", "off", "timing watermark: off, loop for a burst at the start of each loop, or an interval such as 2s",
+		func(c *sourceConfig, v string) (err error) {
+			c.Watermark.Enabled, c.Watermark.Interval, err = parseWatermarkMode(v)
+			return err
+		}},
+	{"watermark-level", "AUDIO_WATERMARK_LEVEL", strconv.FormatFloat(defaultWatermarkLevel, 'g', -1, 64), "watermark level in dBFS",
+		func(c *sourceConfig, v string) error { return setFloat(&c.Watermark.LevelDb, v) }},
+	{"sync-epoch", "AUDIO_SYNC_EPOCH", "", "shared epoch for cluster sync, RFC 3339 or Unix milliseconds",
+		func(c *sourceConfig, v string) (err error) { c.SyncEpoch, err = parseSyncEpoch(v); return err }},
+	{"rtp-dest", "AUDIO_RTP_DEST", "", "send the audio as RTP to this unicast or multicast host:port",
+		func(c *sourceConfig, v string) error { c.RTP.Dest = v; return nil }},
+	{"rtp-payload", "AUDIO_RTP_PAYLOAD", "L16", "RTP payload format, L16 or L24",
+		func(c *sourceConfig, v string) (err error) { c.RTP.Bits, err = parseRTPPayload(v); return err }},
+	{"rtp-ptime", "AUDIO_RTP_PTIME", strconv.Itoa(rtpDefaultPtimeMs), "RTP packet duration in milliseconds",
+		func(c *sourceConfig, v string) error { return setInt(&c.RTP.PtimeMs, v) }},
+}
+
+// setInt parses a whole number setting
+func setInt(dst *int, value string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("want a whole number, got %q", value)
+	}
+	*dst = n
+	return nil
+}
+
+// setFloat parses a decimal setting
+func setFloat(dst *float64, value string) error {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return fmt.Errorf("want a number, got %q", value)
+	}
+	*dst = f
+	return nil
+}
+
+// loadSourceConfig registers the settings' flags on fs, parses args and
+// builds the configuration, reading the file named by -config or
+// AUDIO_CONFIG when one is given
+func loadSourceConfig(fs *flag.FlagSet, args []string) (sourceConfig, error) {
+	var cfg sourceConfig
+	byName := make(map[string]configSetting, len(sourceSettings))
+	for _, s := range sourceSettings {
+		byName[s.name] = s
+		fs.String(s.name, s.def, s.usage+" (env "+s.env+")")
+		if err := s.set(&cfg, s.def); err != nil {
+			return cfg, fmt.Errorf("default %s: %w", s.name, err)
+		}
+	}
+	configPath := fs.String("config", os.Getenv("AUDIO_CONFIG"), "YAML or JSON file of settings, keyed by flag name with underscores (env AUDIO_CONFIG)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		values, err := readConfigFile(*configPath)
+		if err != nil {
+			return cfg, err
+		}
+		for key, value := range values {
+			s, ok := byName[strings.ReplaceAll(key, "_", "-")]
+			if !ok || strings.Contains(key, "-") {
+				return cfg, fmt.Errorf("unknown setting %q in %s", key, *configPath)
+			}
+			if err := s.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("%s in %s: %w", key, *configPath, err)
+			}
+		}
+	}
+
+	for _, s := range sourceSettings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := byName[f.Name]; ok && flagErr == nil {
+			if err := s.set(&cfg, f.Value.String()); err != nil {
+				flagErr = fmt.Errorf("-%s: %w", f.Name, err)
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate checks the settings and the combinations they are used in
+func (c *sourceConfig) validate() error {
+	if c.ChunkDurationMs < 10 || c.ChunkDurationMs > 1000 {
+		return fmt.Errorf("chunk-duration-ms must be 10-1000, got %d", c.ChunkDurationMs)
+	}
+	if c.QueueDepth < 1 || c.QueueDepth > 1000 {
+		return fmt.Errorf("queue-depth must be 1-1000, got %d", c.QueueDepth)
+	}
+
+	if _, err := strconv.Atoi(c.Listen); err == nil {
+		c.Listen = ":" + c.Listen
+	}
+	_, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", c.Listen, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid listen port %q", port)
+	}
+
+	if c.Watermark.Enabled {
+		if c.Watermark.Interval != 0 && c.Watermark.Interval < minWatermarkInterval {
+			return fmt.Errorf("watermark interval %v is too short (minimum %v)", c.Watermark.Interval, minWatermarkInterval)
+		}
+		if c.Watermark.LevelDb > 0 {
+			return fmt.Errorf("watermark-level must not exceed 0 dBFS, got %g", c.Watermark.LevelDb)
+		}
+	}
+
+	// Packets are paced within a chunk, so one cannot be longer than it
+	if c.RTP.Dest != "" {
+		if _, _, err := net.SplitHostPort(c.RTP.Dest); err != nil {
+			return fmt.Errorf("invalid rtp-dest %q: %w", c.RTP.Dest, err)
+		}
+		if c.RTP.PtimeMs < 1 || c.RTP.PtimeMs > c.ChunkDurationMs {
+			return fmt.Errorf("rtp-ptime must be 1-%d, the chunk duration, got %d", c.ChunkDurationMs, c.RTP.PtimeMs)
+		}
+	}
+
+	// A live input plays instead of the default file
+	if c.Live.Input != "" {
+		if c.ChunkDurationMs > liveTargetBufferMs {
+			return fmt.Errorf("chunk-duration-ms %d is too long for live input, which buffers %d ms", c.ChunkDurationMs, liveTargetBufferMs)
+		}
+		if _, err := c.Live.declaredFormat(); err != nil {
+			return err
+		}
+		if !c.SyncEpoch.IsZero() {
+			return fmt.Errorf("input cannot be combined with sync-epoch: live audio has no fixed loop to align across replicas")
+		}
+		return nil
+	}
+
+	if info, err := os.Stat(c.AudioDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("audio-dir %q is not a directory", c.AudioDir)
+	}
+	if filepath.Base(c.DefaultFile) != c.DefaultFile || !isAudioFile(c.DefaultFile) {
+		return fmt.Errorf("default-file %q must be a .wav or .flac file name within audio-dir", c.DefaultFile)
+	}
+	if info, err := os.Stat(filepath.Join(c.AudioDir, c.DefaultFile)); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("default-file %q not found in %s", c.DefaultFile, c.AudioDir)
+	}
+	return nil
+}
+
+// isAudioFile reports whether a file name has an extension the source plays
+func isAudioFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".wav", ".flac":
+		return true
+	}
+	return false
+}
+
+// audioFiles lists the playable files in dir
+func audioFiles(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && isAudioFile(e.Name()) {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+// readConfigFile reads a flat YAML or JSON object of settings as text
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		values := make(map[string]string, len(raw))
+		for key, v := range raw {
+			switch v := v.(type) {
+			case string:
+				values[key] = v
+			case float64:
+				values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				values[key] = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("%s in %s must be a string, number or boolean", key, path)
+			}
+		}
+		return values, nil
+	case ".yaml", ".yml":
+		values, err := parseFlatYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("config file %s must be .yaml, .yml or .json", path)
+}
+
+// parseFlatYAML reads the subset of YAML a settings file needs: one
+// "key: value" per line, with # comments and optionally quoted values
+func parseFlatYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested values are not supported", n+1)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key: value", n+1)
+		}
+		key = strings.TrimSpace(key)
+		value, err := yamlScalar(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", n+1, key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// yamlScalar unquotes a YAML scalar, or strips a trailing comment from a
+// plain one
+func yamlScalar(v string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(v, `"`):
+		quoted, err := strconv.QuotedPrefix(v)
+		if err != nil {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		if value, err = strconv.Unquote(quoted); err != nil {
+			return "", err
+		}
+		rest = v[len(quoted):]
+	case strings.HasPrefix(v, "'"):
+		// Single-quoted strings escape a quote by doubling it
+		i := 1
+		for ; i < len(v); i++ {
+			if v[i] != '\'' {
+				continue
+			}
+			if i+1 < len(v) && v[i+1] == '\'' {
+				i++
+				continue
+			}
+			break
+		}
+		if i >= len(v) {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		value, rest = strings.ReplaceAll(v[1:i], "''", "'"), v[i+1:]
+	default:
+		if strings.HasPrefix(v, "#") {
+			return "", nil
+		}
+		if i := strings.Index(v, " #"); i >= 0 {
+			v = strings.TrimSpace(v[:i])
+		}
+		if v != "" && strings.ContainsRune("[{|>&*!%@`", rune(v[0])) {
+			return "", fmt.Errorf("unsupported value %s", v)
+		}
+		return v, nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after string", rest)
+	}
+	return value, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestYAMLScalar(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"plain", "plain", true},
+		{"", "", true},
+		{"100 # ms", "100", true},
+		{"# only a comment", "", true},
+		{"a#b", "a#b", true},
+		{"true", "true", true}, // booleans are text, read by the setting
+		{"off", "off", true},
+		{`"quoted # not a comment"`, "quoted # not a comment", true},
+		{`"tab\there" # comment`, "tab\there", true},
+		{`'it''s'`, "it's", true},
+		{`'a # b'  # comment`, "a # b", true},
+		{`"unterminated`, "", false},
+		{`'unterminated`, "", false},
+		{`"a" b`, "", false},
+		{"[1, 2]", "", false},
+		{"{a: 1}", "", false},
+		{"|", "", false},
+		{"&anchor", "", false},
+	}
+	for _, tc := range cases {
+		got, err := yamlScalar(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("yamlScalar(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseFlatYAML(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]string // nil for an error
+	}{
+		{
+			name: "settings file",
+			in: "---\n# audio source\naudio_dir: /srv/audio\r\n\ndefault_file: 'loop.flac'\n" +
+				"chunk_duration_ms: 50 # shorter chunks\nwatermark: true\nsync_epoch: \"2024-01-01T00:00:00Z\"\n",
+			want: map[string]string{
+				"audio_dir":         "/srv/audio",
+				"default_file":      "loop.flac",
+				"chunk_duration_ms": "50",
+				"watermark":         "true",
+				"sync_epoch":        "2024-01-01T00:00:00Z",
+			},
+		},
+		{
+			name: "empty value",
+			in:   "rtp_dest:\n",
+			want: map[string]string{"rtp_dest": ""},
+		},
+		{name: "nested", in: "rtp:\n  dest: host:5004\n"},
+		{name: "no colon", in: "audio_dir /srv/audio\n"},
+		{name: "duplicate key", in: "listen: 80\nlisten: 8080\n"},
+		{name: "bad value", in: "listen: [80]\n"},
+	}
+	for _, tc := range cases {
+		got, err := parseFlatYAML([]byte(tc.in))
+		if (err == nil) != (tc.want != nil) || (tc.want != nil && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("%s: got %v, %v; want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	cases := []struct {
+		file string
+		data string
+		want map[string]string // nil for an error
+	}{
+		{"a.yaml", "listen: 9000\n", map[string]string{"listen": "9000"}},
+		{"a.yml", "listen: '9000'\n", map[string]string{"listen": "9000"}},
+		{"a.YAML", "listen: 9000\n", map[string]string{"listen": "9000"}},
+		{"a.json", `{"listen": "9000", "chunk_duration_ms": 50, "watermark_level": -12.5, "watermark": true}`,
+			map[string]string{"listen": "9000", "chunk_duration_ms": "50", "watermark_level": "-12.5", "watermark": "true"}},
+		// The extension decides the parser, not the content
+		{"a.json", "listen: 9000\n", nil},
+		{"a.yaml", `{"listen": "9000"}`, nil},
+		{"a.json", `{"rtp": {"dest": "host:5004"}}`, nil},
+		{"a.json", `{"listen": null}`, nil},
+		{"a.json", `["listen"]`, nil},
+		{"a.toml", "listen = 9000\n", nil},
+	}
+	dir := t.TempDir()
+	for _, tc := range cases {
+		path := filepath.Join(dir, tc.file)
+		if err := os.WriteFile(path, []byte(tc.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readConfigFile(path)
+		if (err == nil) != (tc.want != nil) || (tc.want != nil && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("%s %q: got %v, %v; want %v", tc.file, tc.data, got, err, tc.want)
+		}
+	}
+	if _, err := readConfigFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("read a config file that does not exist")
+	}
+}
+
+// loadTestConfig loads the configuration from args and env, with the default
+// file present in a fresh audio directory and any other AUDIO_* variables
+// cleared
+func loadTestConfig(t *testing.T, args []string, env map[string]string) (sourceConfig, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "audio.wav"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sourceSettings {
+		t.Setenv(s.env, "")
+	}
+	t.Setenv("AUDIO_CONFIG", "")
+	t.Setenv("AUDIO_DIR", dir)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	fs := flag.NewFlagSet("audio-source", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return loadSourceConfig(fs, args)
+}
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSourceConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, "source.yaml", "chunk_duration_ms: 20\nqueue_depth: 30\nlisten: 9001\nrtp_ptime: 4\n")
+
+	cases := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		chunk int
+		queue int
+		addr  string
+		ptime int
+	}{
+		{name: "defaults", chunk: 100, queue: 10, addr: ":8000", ptime: rtpDefaultPtimeMs},
+		{
+			name:  "file over defaults",
+			args:  []string{"-config", file},
+			chunk: 20, queue: 30, addr: ":9001", ptime: 4,
+		},
+		{
+			name:  "file named by the environment",
+			env:   map[string]string{"AUDIO_CONFIG": file},
+			chunk: 20, queue: 30, addr: ":9001", ptime: 4,
+		},
+		{
+			name:  "environment over file",
+			args:  []string{"-config", file},
+			env:   map[string]string{"AUDIO_CHUNK_DURATION_MS": "40", "AUDIO_QUEUE_DEPTH": "50"},
+			chunk: 40, queue: 50, addr: ":9001", ptime: 4,
+		},
+		{
+			name:  "flag over environment",
+			args:  []string{"-config", file, "-chunk-duration-ms", "60", "-listen", "127.0.0.1:9002"},
+			env:   map[string]string{"AUDIO_CHUNK_DURATION_MS": "40", "AUDIO_QUEUE_DEPTH": "50"},
+			chunk: 60, queue: 50, addr: "127.0.0.1:9002", ptime: 4,
+		},
+		{
+			// A flag given its default value still counts as set
+			name:  "flag at its default",
+			args:  []string{"-config", file, "-queue-depth", "10"},
+			env:   map[string]string{"AUDIO_QUEUE_DEPTH": "50"},
+			chunk: 20, queue: 10, addr: ":9001", ptime: 4,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tc.args, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ChunkDurationMs != tc.chunk || cfg.QueueDepth != tc.queue || cfg.Listen != tc.addr || cfg.RTP.PtimeMs != tc.ptime {
+				t.Errorf("chunk %d ms, queue %d, listen %q, ptime %d; want %d, %d, %q, %d",
+					cfg.ChunkDurationMs, cfg.QueueDepth, cfg.Listen, cfg.RTP.PtimeMs, tc.chunk, tc.queue, tc.addr, tc.ptime)
+			}
+		})
+	}
+}
+
+func TestLoadSourceConfigSettings(t *testing.T) {
+	file := writeConfig(t, "source.json", `{"watermark": "2s", "watermark_level": -12, "sync_epoch": "1700000000000", "rtp_dest": "239.255.0.1:5004", "rtp_payload": "l24"}`)
+	cfg, err := loadTestConfig(t, []string{"-config", file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sourceConfig{
+		AudioDir:        cfg.AudioDir,
+		DefaultFile:     "audio.wav",
+		ChunkDurationMs: 100,
+		Listen:          ":8000",
+		QueueDepth:      10,
+		Live:            liveInputConfig{Format: "S16_LE", Rate: "44100", Channels: "2"},
+		Watermark:       watermarkConfig{Enabled: true, Interval: 2 * time.Second, LevelDb: -12},
+		SyncEpoch:       time.UnixMilli(1700000000000),
+		RTP:             rtpConfig{Dest: "239.255.0.1:5004", Bits: 24, PtimeMs: rtpDefaultPtimeMs},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v\nwant %+v", cfg, want)
+	}
+}
+
+func TestLoadSourceConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string // YAML config, when given
+	}{
+		{"unknown key", nil, nil, "volume: 11\n"},
+		{"key with dashes", nil, nil, "chunk-duration-ms: 50\n"},
+		{"bad value in file", nil, nil, "queue_depth: many\n"},
+		{"bad environment value", nil, map[string]string{"AUDIO_QUEUE_DEPTH": "many"}, ""},
+		{"bad flag value", []string{"-chunk-duration-ms", "1e2"}, nil, ""},
+		{"unknown flag", []string{"-volume", "11"}, nil, ""},
+
+		// validate() bounds
+		{"chunk too short", []string{"-chunk-duration-ms", "9"}, nil, ""},
+		{"chunk too long", []string{"-chunk-duration-ms", "1001"}, nil, ""},
+		{"queue too short", []string{"-queue-depth", "0"}, nil, ""},
+		{"queue too deep", []string{"-queue-depth", "1001"}, nil, ""},
+		{"listen address", []string{"-listen", "localhost"}, nil, ""},
+		{"listen port 0", []string{"-listen", "0"}, nil, ""},
+		{"listen port too high", []string{"-listen", ":65536"}, nil, ""},
+		{"watermark interval", []string{"-watermark", "100ms"}, nil, ""},
+		{"watermark level", []string{"-watermark", "loop", "-watermark-level", "1"}, nil, ""},
+		{"watermark mode", []string{"-watermark", "sometimes"}, nil, ""},
+		{"sync epoch", []string{"-sync-epoch", "yesterday"}, nil, ""},
+		{"rtp destination", []string{"-rtp-dest", "239.255.0.1"}, nil, ""},
+		{"rtp payload", []string{"-rtp-dest", "239.255.0.1:5004", "-rtp-payload", "PCMU"}, nil, ""},
+		{"rtp ptime 0", []string{"-rtp-dest", "239.255.0.1:5004", "-rtp-ptime", "0"}, nil, ""},
+		{"rtp ptime over the chunk", []string{"-rtp-dest", "239.255.0.1:5004", "-chunk-duration-ms", "20", "-rtp-ptime", "21"}, nil, ""},
+		{"live chunk too long", []string{"-input", "-", "-chunk-duration-ms", "201"}, nil, ""},
+		{"live format", []string{"-input", "-", "-input-rate", "999"}, nil, ""},
+		{"live with sync epoch", []string{"-input", "-", "-sync-epoch", "1700000000000"}, nil, ""},
+		{"audio dir", nil, map[string]string{"AUDIO_DIR": "/nonexistent"}, ""},
+		{"default file outside the directory", []string{"-default-file", "../audio.wav"}, nil, ""},
+		{"default file type", []string{"-default-file", "audio.mp3"}, nil, ""},
+		{"default file missing", []string{"-default-file", "other.wav"}, nil, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := tc.args
+			if tc.file != "" {
+				args = append([]string{"-config", writeConfig(t, "source.yaml", tc.file)}, args...)
+			}
+			if cfg, err := loadTestConfig(t, args, tc.env); err == nil {
+				t.Errorf("loaded %+v", cfg)
+			}
+		})
+	}
+
+	// The bounds themselves are accepted
+	for _, args := range [][]string{
+		{"-chunk-duration-ms", "10", "-queue-depth", "1"},
+		{"-chunk-duration-ms", "1000", "-queue-depth", "1000", "-listen", "65535"},
+		{"-rtp-dest", "239.255.0.1:5004", "-chunk-duration-ms", "20", "-rtp-ptime", "20"},
+		{"-input", "-", "-chunk-duration-ms", "200"},
+		{"-watermark", "500ms", "-watermark-level", "0"},
+	} {
+		if _, err := loadTestConfig(t, args, nil); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+// streamEvent is one message for a listener: an audio chunk or a
+// notification, delivered on the same channel so they stay in order
+type streamEvent struct {
+	Type  string
+	Chunk AudioChunk             // for chunkproto.EventChunk
+	Data  map[string]interface{} // for the other events; shared, not to be modified
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// wavFormatFLAC is the format tag used for FLAC audio carried in RIFF
+// containers. Here it only labels the source encoding of .flac files.
+const wavFormatFLAC = 0xF1AC
+
+// flacStreamInfo holds the fields of the STREAMINFO metadata block
+type flacStreamInfo struct {
+	MinBlockSize  int
+	MaxBlockSize  int
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	TotalSamples  uint64
+}
+
+// Channel assignments for stereo decorrelation
+const (
+	flacLeftSide  = 8
+	flacRightSide = 9
+	flacMidSide   = 10
+)
+
+// flacDecoder decodes the frames of a native FLAC stream one at a time.
+// Frame and header CRCs are read but not verified.
+type flacDecoder struct {
+	br   *bitReader
+	info flacStreamInfo
+}
+
+// newFLACDecoder reads the stream marker and metadata blocks from r
+func newFLACDecoder(r io.Reader) (*flacDecoder, error) {
+	d := &flacDecoder{br: newBitReader(r)}
+
+	marker, err := d.br.readBits(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FLAC marker: %w", err)
+	}
+	if marker != 0x664C6143 { // "fLaC"
+		return nil, fmt.Errorf("not a valid FLAC file")
+	}
+
+	foundInfo := false
+	for last := false; !last; {
+		header, err := d.br.readBits(32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FLAC metadata: %w", err)
+		}
+		last = header&0x80000000 != 0
+		blockType := (header >> 24) & 0x7F
+		length := int(header & 0xFFFFFF)
+
+		if blockType != 0 {
+			if err := d.br.skipBytes(length); err != nil {
+				return nil, fmt.Errorf("failed to skip FLAC metadata block %d: %w", blockType, err)
+			}
+			continue
+		}
+
+		if length < 34 {
+			return nil, fmt.Errorf("FLAC STREAMINFO too short: %d bytes", length)
+		}
+		if err := d.readStreamInfo(); err != nil {
+			return nil, err
+		}
+		if err := d.br.skipBytes(length - 34); err != nil {
+			return nil, fmt.Errorf("failed to read FLAC STREAMINFO: %w", err)
+		}
+		foundInfo = true
+	}
+
+	if !foundInfo {
+		return nil, fmt.Errorf("FLAC STREAMINFO not found")
+	}
+	return d, nil
+}
+
+// readStreamInfo decodes the 34-byte STREAMINFO body
+func (d *flacDecoder) readStreamInfo() error {
+	fields := []uint{16, 16, 24, 24, 20, 3, 5, 36}
+	values := make([]uint64, len(fields))
+	for i, n := range fields {
+		v, err := d.br.readBits(n)
+		if err != nil {
+			return fmt.Errorf("failed to read FLAC STREAMINFO: %w", err)
+		}
+		values[i] = v
+	}
+	// MD5 signature
+	if err := d.br.skipBytes(16); err != nil {
+		return fmt.Errorf("failed to read FLAC STREAMINFO: %w", err)
+	}
+
+	d.info = flacStreamInfo{
+		MinBlockSize:  int(values[0]),
+		MaxBlockSize:  int(values[1]),
+		SampleRate:    int(values[4]),
+		Channels:      int(values[5]) + 1,
+		BitsPerSample: int(values[6]) + 1,
+		TotalSamples:  values[7],
+	}
+
+	if d.info.SampleRate == 0 {
+		return fmt.Errorf("invalid FLAC sample rate: 0")
+	}
+	if d.info.BitsPerSample < 4 || d.info.BitsPerSample > 24 {
+		return fmt.Errorf("unsupported FLAC bit depth: %d", d.info.BitsPerSample)
+	}
+	return nil
+}
+
+// nextFrame decodes the next frame and returns its samples per channel.
+// It returns io.EOF once the stream is exhausted.
+func (d *flacDecoder) nextFrame() ([][]int32, error) {
+	br := d.br
+	br.align()
+
+	sync, err := br.readBits(16)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if sync&0xFFFE != 0xFFF8 {
+		return nil, fmt.Errorf("lost FLAC frame sync (0x%04x)", sync)
+	}
+
+	header, err := br.readBits(16)
+	if err != nil {
+		return nil, err
+	}
+	blockSizeCode := header >> 12
+	sampleRateCode := (header >> 8) & 0x0F
+	channelCode := int(header>>4) & 0x0F
+	sampleSizeCode := (header >> 1) & 0x07
+
+	// Frame or sample number, UTF-8 style coded
+	if err := br.skipUTF8(); err != nil {
+		return nil, err
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode >= 2 && blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6:
+		v, err := br.readBits(8)
+		if err != nil {
+			return nil, err
+		}
+		blockSize = int(v) + 1
+	case blockSizeCode == 7:
+		v, err := br.readBits(16)
+		if err != nil {
+			return nil, err
+		}
+		blockSize = int(v) + 1
+	case blockSizeCode >= 8:
+		blockSize = 256 << (blockSizeCode - 8)
+	default:
+		return nil, fmt.Errorf("reserved FLAC block size code")
+	}
+
+	// The frame sample rate only matters for validation; skip any
+	// explicitly coded value
+	switch sampleRateCode {
+	case 12:
+		_, err = br.readBits(8)
+	case 13, 14:
+		_, err = br.readBits(16)
+	case 15:
+		err = fmt.Errorf("invalid FLAC sample rate code")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bps := d.info.BitsPerSample
+	switch sampleSizeCode {
+	case 0:
+	case 1:
+		bps = 8
+	case 2:
+		bps = 12
+	case 4:
+		bps = 16
+	case 5:
+		bps = 20
+	case 6:
+		bps = 24
+	default:
+		return nil, fmt.Errorf("unsupported FLAC sample size code %d", sampleSizeCode)
+	}
+
+	// CRC-8 of the header
+	if _, err := br.readBits(8); err != nil {
+		return nil, err
+	}
+
+	channels := channelCode + 1
+	if channelCode >= flacLeftSide {
+		if channelCode > flacMidSide {
+			return nil, fmt.Errorf("reserved FLAC channel assignment %d", channelCode)
+		}
+		channels = 2
+	}
+	if channels != d.info.Channels {
+		return nil, fmt.Errorf("FLAC frame has %d channels, stream has %d", channels, d.info.Channels)
+	}
+
+	samples := make([][]int32, channels)
+	for ch := range samples {
+		// The side channel carries one extra bit
+		width := bps
+		if (channelCode == flacLeftSide || channelCode == flacMidSide) && ch == 1 ||
+			channelCode == flacRightSide && ch == 0 {
+			width++
+		}
+		if samples[ch], err = d.decodeSubframe(blockSize, width); err != nil {
+			return nil, fmt.Errorf("channel %d: %w", ch, err)
+		}
+	}
+
+	// Padding to a byte boundary, then CRC-16 of the frame
+	br.align()
+	if _, err := br.readBits(16); err != nil {
+		return nil, err
+	}
+
+	decorrelate(samples, channelCode)
+
+	// Left-justify to the stream bit depth if this frame is narrower
+	if shift := d.info.BitsPerSample - bps; shift > 0 {
+		for _, ch := range samples {
+			for i := range ch {
+				ch[i] <<= shift
+			}
+		}
+	}
+
+	return samples, nil
+}
+
+// decorrelate restores left and right from a stereo side-channel encoding
+func decorrelate(samples [][]int32, channelCode int) {
+	switch channelCode {
+	case flacLeftSide:
+		for i, side := range samples[1] {
+			samples[1][i] = samples[0][i] - side
+		}
+	case flacRightSide:
+		for i, side := range samples[0] {
+			samples[0][i] = side + samples[1][i]
+		}
+	case flacMidSide:
+		for i := range samples[0] {
+			side := samples[1][i]
+			mid := samples[0][i]<<1 | side&1
+			samples[0][i] = (mid + side) >> 1
+			samples[1][i] = (mid - side) >> 1
+		}
+	}
+}
+
+// decodeSubframe decodes one channel of a frame
+func (d *flacDecoder) decodeSubframe(blockSize, bps int) ([]int32, error) {
+	br := d.br
+	header, err := br.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	if header&0x80 != 0 {
+		return nil, fmt.Errorf("invalid FLAC subframe padding")
+	}
+	kind := int(header>>1) & 0x3F
+
+	wasted := 0
+	if header&1 != 0 {
+		zeros, err := br.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		wasted = zeros + 1
+		bps -= wasted
+	}
+
+	samples := make([]int32, blockSize)
+	switch {
+	case kind == 0:
+		// CONSTANT
+		v, err := br.readSigned(uint(bps))
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = int32(v)
+		}
+	case kind == 1:
+		// VERBATIM
+		for i := range samples {
+			v, err := br.readSigned(uint(bps))
+			if err != nil {
+				return nil, err
+			}
+			samples[i] = int32(v)
+		}
+	case kind >= 8 && kind <= 12:
+		if err := d.decodeFixed(samples, kind-8, bps); err != nil {
+			return nil, err
+		}
+	case kind >= 32:
+		if err := d.decodeLPC(samples, kind-31, bps); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("reserved FLAC subframe type %d", kind)
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return samples, nil
+}
+
+// readWarmup reads the verbatim samples that seed a predictor
+func (d *flacDecoder) readWarmup(samples []int32, order, bps int) error {
+	if order > len(samples) {
+		return fmt.Errorf("FLAC predictor order %d exceeds block size %d", order, len(samples))
+	}
+	for i := 0; i < order; i++ {
+		v, err := d.br.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		samples[i] = int32(v)
+	}
+	return nil
+}
+
+// decodeFixed decodes a subframe using one of the fixed polynomial predictors
+func (d *flacDecoder) decodeFixed(samples []int32, order, bps int) error {
+	if err := d.readWarmup(samples, order, bps); err != nil {
+		return err
+	}
+	if err := d.readResidual(samples, order); err != nil {
+		return err
+	}
+
+	for i := order; i < len(samples); i++ {
+		var p int64
+		switch order {
+		case 1:
+			p = int64(samples[i-1])
+		case 2:
+			p = 2*int64(samples[i-1]) - int64(samples[i-2])
+		case 3:
+			p = 3*int64(samples[i-1]) - 3*int64(samples[i-2]) + int64(samples[i-3])
+		case 4:
+			p = 4*int64(samples[i-1]) - 6*int64(samples[i-2]) + 4*int64(samples[i-3]) - int64(samples[i-4])
+		}
+		samples[i] += int32(p)
+	}
+	return nil
+}
+
+// decodeLPC decodes a subframe using linear prediction
+func (d *flacDecoder) decodeLPC(samples []int32, order, bps int) error {
+	if err := d.readWarmup(samples, order, bps); err != nil {
+		return err
+	}
+
+	precision, err := d.br.readBits(4)
+	if err != nil {
+		return err
+	}
+	if precision == 0x0F {
+		return fmt.Errorf("invalid FLAC LPC precision")
+	}
+	shift, err := d.br.readSigned(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return fmt.Errorf("negative FLAC LPC shift %d", shift)
+	}
+
+	coeffs := make([]int64, order)
+	for i := range coeffs {
+		if coeffs[i], err = d.br.readSigned(uint(precision) + 1); err != nil {
+			return err
+		}
+	}
+
+	if err := d.readResidual(samples, order); err != nil {
+		return err
+	}
+
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * int64(samples[i-1-j])
+		}
+		samples[i] += int32(sum >> uint(shift))
+	}
+	return nil
+}
+
+// readResidual reads Rice-coded residuals into samples[order:]
+func (d *flacDecoder) readResidual(samples []int32, order int) error {
+	br := d.br
+	method, err := br.readBits(2)
+	if err != nil {
+		return err
+	}
+	paramBits := uint(4)
+	switch method {
+	case 0:
+	case 1:
+		paramBits = 5
+	default:
+		return fmt.Errorf("reserved FLAC residual coding method %d", method)
+	}
+	escape := uint64(1)<<paramBits - 1
+
+	partitionOrder, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	partitionSize := len(samples) >> partitionOrder
+	if partitionSize<<partitionOrder != len(samples) || partitionSize < order {
+		return fmt.Errorf("invalid FLAC partition order %d for block size %d", partitionOrder, len(samples))
+	}
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		n := partitionSize
+		if p == 0 {
+			n -= order
+		}
+
+		param, err := br.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if param == escape {
+			// Unencoded partition with an explicit bit width
+			width, err := br.readBits(5)
+			if err != nil {
+				return err
+			}
+			for end := i + n; i < end; i++ {
+				v := int64(0)
+				if width > 0 {
+					if v, err = br.readSigned(uint(width)); err != nil {
+						return err
+					}
+				}
+				samples[i] = int32(v)
+			}
+			continue
+		}
+
+		for end := i + n; i < end; i++ {
+			q, err := br.readUnary()
+			if err != nil {
+				return err
+			}
+			low, err := br.readBits(uint(param))
+			if err != nil {
+				return err
+			}
+			v := uint64(q)<<param | low
+			samples[i] = int32(v>>1) ^ -int32(v&1)
+		}
+	}
+	return nil
+}
+
+// bitReader reads big-endian bit fields from a byte stream
+type bitReader struct {
+	r     *bufio.Reader
+	cache uint64
+	n     uint
+}
+
+func newBitReader(r io.Reader) *bitReader {
+	return &bitReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// readBits reads an unsigned value of up to 56 bits
+func (b *bitReader) readBits(n uint) (uint64, error) {
+	for b.n < n {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && b.n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.cache = b.cache<<8 | uint64(c)
+		b.n += 8
+	}
+	b.n -= n
+	v := (b.cache >> b.n) & (1<<n - 1)
+	b.cache &= 1<<b.n - 1
+	return v, nil
+}
+
+// readSigned reads a two's complement value of n bits
+func (b *bitReader) readSigned(n uint) (int64, error) {
+	v, err := b.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// readUnary counts zero bits up to and including the next one bit, a cached
+// byte at a time
+func (b *bitReader) readUnary() (int, error) {
+	count := 0
+	for {
+		if b.n == 0 {
+			c, err := b.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			b.cache, b.n = uint64(c), 8
+		}
+		if b.cache == 0 {
+			count += int(b.n)
+			b.n = 0
+			continue
+		}
+		zeros := bits.LeadingZeros64(b.cache) - (64 - int(b.n))
+		b.n -= uint(zeros) + 1
+		b.cache &= 1<<b.n - 1
+		return count + zeros, nil
+	}
+}
+
+// align discards bits up to the next byte boundary
+func (b *bitReader) align() {
+	b.n -= b.n % 8
+	b.cache &= 1<<b.n - 1
+}
+
+// skipBytes discards n whole bytes; the reader must be byte aligned
+func (b *bitReader) skipBytes(n int) error {
+	for ; n > 0 && b.n >= 8; n-- {
+		b.n -= 8
+		b.cache &= 1<<b.n - 1
+	}
+	_, err := b.r.Discard(n)
+	return err
+}
+
+// skipToSync discards input up to the next frame sync code, leaving it to be
+// read by nextFrame. Sync codes can also occur by chance inside frame data;
+// decoding from one of those fails and syncs again further on.
+func (b *bitReader) skipToSync() error {
+	b.align()
+	prev := uint64(0)
+	for {
+		c, err := b.readBits(8)
+		if err != nil {
+			return err
+		}
+		if prev == 0xFF && c&0xFE == 0xF8 {
+			b.cache |= (prev<<8 | c) << b.n
+			b.n += 16
+			return nil
+		}
+		prev = c
+	}
+}
+
+// skipUTF8 discards a UTF-8 style coded frame or sample number
+func (b *bitReader) skipUTF8() error {
+	first, err := b.readBits(8)
+	if err != nil {
+		return err
+	}
+	extra := 0
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		extra++
+	}
+	if extra == 1 || extra > 7 {
+		return fmt.Errorf("invalid FLAC frame number coding")
+	}
+	if extra > 0 {
+		extra--
+	}
+	for ; extra > 0; extra-- {
+		if _, err := b.readBits(8); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flacChunkReader serves chunks of decoded FLAC audio. Decoding runs forward
+// from the current position; a request for any other position reopens the
+// file and decodes up to it, which only happens when looping back to the start.
+type flacChunkReader struct {
+	path           string
+	format         wavFormat
+	pcmFormat      wavFormat
+	framesPerChunk int
+	numChunks      int
+	silence        byte
+
+	mu      sync.Mutex
+	file    *os.File
+	dec     *flacDecoder
+	next    int
+	pending []byte
+}
+
+// newFLACChunkReader opens a FLAC file for chunked playback
+func newFLACChunkReader(path string, chunkDurationMs int) (*flacChunkReader, error) {
+	r := &flacChunkReader{path: path}
+	if err := r.reopen(); err != nil {
+		return nil, err
+	}
+
+	info := r.dec.info
+	width := (info.BitsPerSample + 7) / 8
+	r.format = wavFormat{
+		FormatTag:     wavFormatFLAC,
+		NumChannels:   uint16(info.Channels),
+		SampleRate:    uint32(info.SampleRate),
+		BitsPerSample: uint16(info.BitsPerSample),
+		ValidBits:     uint16(info.BitsPerSample),
+	}
+	r.pcmFormat = wavFormat{
+		FormatTag:     wavFormatPCM,
+		NumChannels:   uint16(info.Channels),
+		SampleRate:    uint32(info.SampleRate),
+		ByteRate:      uint32(info.SampleRate * info.Channels * width),
+		BlockAlign:    uint16(info.Channels * width),
+		BitsPerSample: uint16(width * 8),
+		ValidBits:     uint16(info.BitsPerSample),
+	}
+	if width == 1 {
+		r.silence = 0x80
+	}
+
+	r.framesPerChunk = info.SampleRate * chunkDurationMs / 1000
+	if r.framesPerChunk < 1 {
+		r.framesPerChunk = 1
+	}
+
+	if info.TotalSamples == 0 {
+		// Length not recorded in STREAMINFO; decode once to count
+		total, err := r.countSamples()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		info.TotalSamples = total
+		if err := r.reopen(); err != nil {
+			return nil, err
+		}
+	}
+	r.numChunks = int((info.TotalSamples + uint64(r.framesPerChunk) - 1) / uint64(r.framesPerChunk))
+	if r.numChunks == 0 {
+		r.Close()
+		return nil, fmt.Errorf("FLAC file contains no audio")
+	}
+
+	return r, nil
+}
+
+// reopen restarts decoding from the beginning of the file
+func (r *flacChunkReader) reopen() error {
+	if r.file != nil {
+		r.file.Close()
+	}
+	file, err := os.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to open FLAC file: %w", err)
+	}
+	dec, err := newFLACDecoder(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.dec = dec
+	r.next = 0
+	r.pending = r.pending[:0]
+	return nil
+}
+
+// countSamples decodes the whole stream and returns its length in frames
+func (r *flacChunkReader) countSamples() (uint64, error) {
+	var total uint64
+	for {
+		samples, err := r.dec.nextFrame()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode FLAC frame: %w", err)
+		}
+		total += uint64(len(samples[0]))
+	}
+}
+
+// Len returns the number of chunks in one loop
+func (r *flacChunkReader) Len() int {
+	return r.numChunks
+}
+
+// Chunk returns the audio for a position
+func (r *flacChunkReader) Chunk(position int) ([]byte, error) {
+	if position < 0 || position >= r.numChunks {
+		return nil, fmt.Errorf("chunk %d out of range (0-%d)", position, r.numChunks-1)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if position < r.next {
+		if err := r.reopen(); err != nil {
+			return nil, err
+		}
+	}
+	for r.next < position {
+		if _, err := r.readChunk(); err != nil {
+			return nil, err
+		}
+	}
+	return r.readChunk()
+}
+
+// readChunk decodes frames until one chunk of PCM is available and returns it.
+// A frame that fails to decode silences the chunk rather than stopping playback.
+func (r *flacChunkReader) readChunk() ([]byte, error) {
+	chunkSize := r.framesPerChunk * int(r.pcmFormat.BlockAlign)
+	for len(r.pending) < chunkSize {
+		samples, err := r.dec.nextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Play the damaged chunk as silence and pick up at the next frame
+			log.Printf("Failed to decode FLAC frame in %s, chunk %d: %v", r.path, r.next, err)
+			r.pending = r.pending[:0]
+			r.dec.br.skipToSync()
+			break
+		}
+		r.pending = r.appendPCM(r.pending, samples)
+	}
+
+	// Pad the last chunk with silence
+	chunk := make([]byte, chunkSize)
+	n := copy(chunk, r.pending)
+	for j := n; j < chunkSize; j++ {
+		chunk[j] = r.silence
+	}
+	r.pending = append(r.pending[:0], r.pending[n:]...)
+	r.next++
+	return chunk, nil
+}
+
+// appendPCM interleaves decoded samples as little-endian PCM of the output width
+func (r *flacChunkReader) appendPCM(out []byte, samples [][]int32) []byte {
+	width := int(r.pcmFormat.BitsPerSample / 8)
+	shift := width*8 - int(r.format.BitsPerSample)
+	var buf [4]byte
+	for i := range samples[0] {
+		for _, ch := range samples {
+			v := ch[i] << shift
+			if width == 1 {
+				out = append(out, byte(v+128))
+				continue
+			}
+			binary.LittleEndian.PutUint32(buf[:], uint32(v))
+			out = append(out, buf[:width]...)
+		}
+	}
+	return out
+}
+
+// Close closes the underlying file
+func (r *flacChunkReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// flacWriter builds FLAC bitstreams for the decoder tests. CRCs are written
+// as zero, as the decoder does not check them.
+type flacWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (w *flacWriter) bit(b uint64) {
+	if w.n%8 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	w.buf[len(w.buf)-1] |= byte(b&1) << (7 - w.n%8)
+	w.n++
+}
+
+func (w *flacWriter) bits(v uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.bit(v >> uint(i))
+	}
+}
+
+func (w *flacWriter) signed(v int64, n uint) {
+	w.bits(uint64(v)&(1<<n-1), n)
+}
+
+func (w *flacWriter) unary(zeros uint64) {
+	for ; zeros > 0; zeros-- {
+		w.bit(0)
+	}
+	w.bit(1)
+}
+
+func (w *flacWriter) align() {
+	for w.n%8 != 0 {
+		w.bit(0)
+	}
+}
+
+// streamHeader writes the marker and a STREAMINFO block
+func (w *flacWriter) streamHeader(blockSize, sampleRate, channels, bps int, totalSamples uint64) {
+	w.bits(0x664C6143, 32)
+	w.bits(1<<31|34, 32) // last block, STREAMINFO, 34 bytes
+	w.bits(uint64(blockSize), 16)
+	w.bits(uint64(blockSize), 16)
+	w.bits(0, 24)
+	w.bits(0, 24)
+	w.bits(uint64(sampleRate), 20)
+	w.bits(uint64(channels-1), 3)
+	w.bits(uint64(bps-1), 5)
+	w.bits(totalSamples, 36)
+	w.bits(0, 64) // MD5
+	w.bits(0, 64)
+}
+
+// frame writes a frame whose block size, sample rate and sample size come
+// from the 8-bit block size field and STREAMINFO
+func (w *flacWriter) frame(number, blockSize, channelCode int, subframes ...func(*flacWriter)) {
+	w.bits(0xFFF8, 16)
+	w.bits(6, 4) // 8-bit block size follows
+	w.bits(0, 4)
+	w.bits(uint64(channelCode), 4)
+	w.bits(0, 4)
+	w.bits(uint64(number), 8)
+	w.bits(uint64(blockSize-1), 8)
+	w.bits(0, 8) // CRC-8
+	for _, sub := range subframes {
+		sub(w)
+	}
+	w.align()
+	w.bits(0, 16) // CRC-16
+}
+
+func constantSubframe(v int32, bps uint) func(*flacWriter) {
+	return func(w *flacWriter) {
+		w.bits(0, 8)
+		w.signed(int64(v), bps)
+	}
+}
+
+func verbatimSubframe(samples []int32, bps uint) func(*flacWriter) {
+	return func(w *flacWriter) {
+		w.bits(1<<1, 8)
+		for _, s := range samples {
+			w.signed(int64(s), bps)
+		}
+	}
+}
+
+// wastedSubframe writes samples with their low wasted bits dropped
+func wastedSubframe(samples []int32, bps, wasted uint) func(*flacWriter) {
+	return func(w *flacWriter) {
+		w.bits(1<<1|1, 8)
+		w.unary(uint64(wasted - 1))
+		for _, s := range samples {
+			w.signed(int64(s>>wasted), bps-wasted)
+		}
+	}
+}
+
+// fixedCoeffs are the fixed predictors of each order as LPC coefficients
+var fixedCoeffs = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+func fixedSubframe(samples []int32, order int, bps uint, partitions int, escape bool) func(*flacWriter) {
+	return func(w *flacWriter) {
+		w.bits(uint64(8+order)<<1, 8)
+		for _, s := range samples[:order] {
+			w.signed(int64(s), bps)
+		}
+		w.residual(predictionResidual(samples, fixedCoeffs[order], 0), order, partitions, escape)
+	}
+}
+
+func lpcSubframe(samples []int32, coeffs []int64, precision, shift, bps uint, partitions int) func(*flacWriter) {
+	return func(w *flacWriter) {
+		order := len(coeffs)
+		w.bits(uint64(32+order-1)<<1, 8)
+		for _, s := range samples[:order] {
+			w.signed(int64(s), bps)
+		}
+		w.bits(uint64(precision-1), 4)
+		w.signed(int64(shift), 5)
+		for _, c := range coeffs {
+			w.signed(c, precision)
+		}
+		w.residual(predictionResidual(samples, coeffs, shift), order, partitions, false)
+	}
+}
+
+// predictionResidual returns what is left of each sample after order warmup
+// samples once the predictor's estimate is taken away
+func predictionResidual(samples []int32, coeffs []int64, shift uint) []int64 {
+	res := make([]int64, 0, len(samples))
+	for i := len(coeffs); i < len(samples); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * int64(samples[i-1-j])
+		}
+		res = append(res, int64(samples[i])-sum>>shift)
+	}
+	return res
+}
+
+// residual writes Rice-coded partitions, or escaped ones holding plain
+// signed values, choosing each partition's parameter from its largest value
+func (w *flacWriter) residual(res []int64, order, partitions int, escape bool) {
+	w.bits(0, 2)
+	w.bits(uint64(bits.TrailingZeros(uint(partitions))), 4)
+	size := (len(res) + order) / partitions
+	for p := 0; p < partitions; p++ {
+		n := size
+		if p == 0 {
+			n -= order
+		}
+		part := res[:n]
+		res = res[n:]
+
+		var max uint64
+		for _, r := range part {
+			if u := zigzag(r); u > max {
+				max = u
+			}
+		}
+		if escape {
+			width := uint(bits.Len64(max)) + 1
+			w.bits(15, 4)
+			w.bits(uint64(width), 5)
+			for _, r := range part {
+				w.signed(r, width)
+			}
+			continue
+		}
+		// Parameter 15 is the escape code
+		param := uint(0)
+		if l := bits.Len64(max); l > 2 {
+			param = uint(l - 2)
+		}
+		if param > 14 {
+			param = 14
+		}
+		w.bits(uint64(param), 4)
+		for _, r := range part {
+			u := zigzag(r)
+			w.unary(u >> param)
+			w.bits(u, param)
+		}
+	}
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// testSignal is a deterministic wave with some roughness, so no predictor
+// fits it exactly
+func testSignal(n int, amplitude float64) []int32 {
+	out := make([]int32, n)
+	for i := range out {
+		out[i] = int32(amplitude*math.Sin(float64(i)/3)) + int32(i*37%23) - 11
+	}
+	return out
+}
+
+// decodeTestFrames decodes a stream and returns each frame's samples
+func decodeTestFrames(t *testing.T, stream []byte) [][][]int32 {
+	t.Helper()
+	d, err := newFLACDecoder(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("newFLACDecoder: %v", err)
+	}
+	var frames [][][]int32
+	for {
+		samples, err := d.nextFrame()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("nextFrame: %v", err)
+			}
+			return frames
+		}
+		frames = append(frames, samples)
+	}
+}
+
+func TestFLACSubframes(t *testing.T) {
+	const blockSize = 64
+	signal := testSignal(blockSize, 12000)
+	even := make([]int32, blockSize)
+	for i, s := range signal {
+		even[i] = s &^ 3
+	}
+	constant := make([]int32, blockSize)
+	for i := range constant {
+		constant[i] = -1234
+	}
+
+	cases := []struct {
+		name     string
+		subframe func(*flacWriter)
+		want     []int32
+	}{
+		{"constant", constantSubframe(-1234, 16), constant},
+		{"verbatim", verbatimSubframe(signal, 16), signal},
+		{"wasted bits", wastedSubframe(even, 16, 2), even},
+		{"fixed order 0", fixedSubframe(signal, 0, 16, 1, false), signal},
+		{"fixed order 1", fixedSubframe(signal, 1, 16, 1, false), signal},
+		{"fixed order 2", fixedSubframe(signal, 2, 16, 2, false), signal},
+		{"fixed order 3", fixedSubframe(signal, 3, 16, 4, false), signal},
+		{"fixed order 4", fixedSubframe(signal, 4, 16, 1, false), signal},
+		{"fixed escaped partitions", fixedSubframe(signal, 2, 16, 2, true), signal},
+		{"lpc order 1", lpcSubframe(signal, []int64{900}, 12, 10, 16, 1), signal},
+		{"lpc order 2", lpcSubframe(signal, []int64{1800, -850}, 12, 10, 16, 4), signal},
+		{"lpc order 8", lpcSubframe(signal, []int64{3000, -2500, 700, 120, -60, 30, -10, 5}, 15, 11, 16, 2), signal},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var w flacWriter
+			w.streamHeader(blockSize, 44100, 1, 16, blockSize)
+			w.frame(0, blockSize, 0, tc.subframe)
+			frames := decodeTestFrames(t, w.buf)
+			if len(frames) != 1 {
+				t.Fatalf("decoded %d frames, want 1", len(frames))
+			}
+			if !reflect.DeepEqual(frames[0][0], tc.want) {
+				t.Errorf("decoded %v\nwant %v", frames[0][0], tc.want)
+			}
+		})
+	}
+}
+
+func TestFLACStereoDecorrelation(t *testing.T) {
+	left := []int32{0, 1, -1, 32767, -32768, 1000, -999, 7}
+	right := []int32{0, 0, 1, -32768, 32767, -1001, -998, 8}
+	side := make([]int32, len(left))
+	mid := make([]int32, len(left))
+	for i := range left {
+		side[i] = left[i] - right[i]
+		mid[i] = (left[i] + right[i]) >> 1
+	}
+
+	cases := []struct {
+		name        string
+		channelCode int
+		first       func(*flacWriter)
+		second      func(*flacWriter)
+	}{
+		{"independent", 1, verbatimSubframe(left, 16), verbatimSubframe(right, 16)},
+		{"left/side", flacLeftSide, verbatimSubframe(left, 16), verbatimSubframe(side, 17)},
+		{"side/right", flacRightSide, verbatimSubframe(side, 17), verbatimSubframe(right, 16)},
+		{"mid/side", flacMidSide, verbatimSubframe(mid, 16), verbatimSubframe(side, 17)},
+		{"mid/side predicted", flacMidSide, fixedSubframe(mid, 1, 16, 1, false), fixedSubframe(side, 2, 17, 1, false)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var w flacWriter
+			w.streamHeader(len(left), 44100, 2, 16, uint64(len(left)))
+			w.frame(0, len(left), tc.channelCode, tc.first, tc.second)
+			frames := decodeTestFrames(t, w.buf)
+			if len(frames) != 1 {
+				t.Fatalf("decoded %d frames, want 1", len(frames))
+			}
+			if !reflect.DeepEqual(frames[0][0], left) || !reflect.DeepEqual(frames[0][1], right) {
+				t.Errorf("decoded %v / %v, want %v / %v", frames[0][0], frames[0][1], left, right)
+			}
+		})
+	}
+}
+
+func TestBitReaderUnary(t *testing.T) {
+	counts := []uint64{0, 1, 6, 7, 8, 9, 15, 16, 30, 100, 0, 3}
+	var w flacWriter
+	for i, c := range counts {
+		w.unary(c)
+		w.bits(uint64(i), 5) // interleaved fields keep the zeros unaligned
+	}
+	w.align()
+
+	br := newBitReader(bytes.NewReader(w.buf))
+	for i, want := range counts {
+		got, err := br.readUnary()
+		if err != nil {
+			t.Fatalf("readUnary %d: %v", i, err)
+		}
+		if got != int(want) {
+			t.Errorf("readUnary %d = %d, want %d", i, got, want)
+		}
+		if v, err := br.readBits(5); err != nil || v != uint64(i) {
+			t.Fatalf("field after unary %d = %d, %v", i, v, err)
+		}
+	}
+	if _, err := br.readUnary(); err == nil {
+		t.Error("readUnary past the end succeeded")
+	}
+}
+
+// repeat returns n copies of v
+func repeat(v int16, n int) []int16 {
+	out := make([]int16, n)
+	for i := range out {
+		out[i] = v
+	}
+	return out
+}
+
+// concat joins sample runs into a new slice
+func concat(runs ...[]int16) []int16 {
+	var out []int16
+	for _, r := range runs {
+		out = append(out, r...)
+	}
+	return out
+}
+
+func TestFLACChunkReaderResyncs(t *testing.T) {
+	// Five frames of 16 constant samples, 1000 apart, read as 10 ms chunks
+	// of 10 samples at 1 kHz
+	const blockSize = 16
+	frame := func(w *flacWriter, n int) {
+		w.frame(n, blockSize, 0, constantSubframe(int32(1000*(n+1)), 16))
+	}
+
+	// Both cases play the first frame and 14 samples of the second. The failed
+	// decode in chunk 3 discards the last two and leaves the chunk silent.
+	prefix := concat(repeat(1000, 16), repeat(2000, 14), repeat(0, 10))
+
+	cases := []struct {
+		name  string
+		write func(w *flacWriter)
+		want  []int16
+	}{
+		{
+			// The third frame's subframe type is reserved: the chunk it falls in
+			// is silent, and playback continues from the fourth frame
+			name: "corrupt frame",
+			write: func(w *flacWriter) {
+				for n := 0; n < 5; n++ {
+					if n != 2 {
+						frame(w, n)
+						continue
+					}
+					w.frame(n, blockSize, 0, func(w *flacWriter) {
+						w.bits(2<<1, 8)
+						w.bits(3000, 16)
+					})
+				}
+			},
+			want: concat(prefix, repeat(4000, 16), repeat(5000, 16), repeat(0, 8)),
+		},
+		{
+			// Garbage between frames loses sync until the third frame
+			name: "garbage between frames",
+			write: func(w *flacWriter) {
+				for n := 0; n < 5; n++ {
+					if n == 2 {
+						w.bits(0x12FF34FFF0FF56, 56)
+					}
+					frame(w, n)
+				}
+			},
+			want: concat(prefix, repeat(3000, 16), repeat(4000, 16), repeat(5000, 8)),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var w flacWriter
+			w.streamHeader(blockSize, 1000, 1, 16, 5*blockSize)
+			tc.write(&w)
+			path := filepath.Join(t.TempDir(), "test.flac")
+			if err := os.WriteFile(path, w.buf, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := newFLACChunkReader(path, 10)
+			if err != nil {
+				t.Fatalf("newFLACChunkReader: %v", err)
+			}
+			defer r.Close()
+			if r.Len() != 8 {
+				t.Fatalf("Len() = %d, want 8", r.Len())
+			}
+
+			var got []int16
+			for pos := 0; pos < r.Len(); pos++ {
+				chunk, err := r.Chunk(pos)
+				if err != nil {
+					t.Fatalf("Chunk(%d): %v", pos, err)
+				}
+				got = append(got, samples16(chunk)...)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("played %v\nwant %v", got, tc.want)
+			}
+
+			// Looping back reopens the file and plays from the start again
+			chunk, err := r.Chunk(0)
+			if err != nil {
+				t.Fatalf("Chunk(0) after the loop: %v", err)
+			}
+			if got := samples16(chunk); !reflect.DeepEqual(got, repeat(1000, 10)) {
+				t.Errorf("Chunk(0) after the loop = %v", got)
+			}
+		})
+	}
+}
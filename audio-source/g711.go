@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// G.711 format tags, shared by WAV files and /stream codec selection
+const (
+	wavFormatALaw = 0x0006
+	wavFormatULaw = 0x0007
+)
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+// alawSegmentEnds holds the upper bound of each A-law segment for 13-bit input
+var alawSegmentEnds = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+// ulawToLinear expands a mu-law byte to a 16-bit linear sample
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0F) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+// linearToULaw compresses a 16-bit linear sample to mu-law
+func linearToULaw(sample int16) byte {
+	pcm := int(sample)
+	sign := 0
+	if pcm < 0 {
+		pcm = -pcm
+		sign = 0x80
+	}
+	if pcm > ulawClip {
+		pcm = ulawClip
+	}
+	pcm += ulawBias
+
+	exponent := 7
+	for mask := 0x4000; pcm&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (pcm >> (exponent + 3)) & 0x0F
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// alawToLinear expands an A-law byte to a 16-bit linear sample
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// linearToALaw compresses a 16-bit linear sample to A-law
+func linearToALaw(sample int16) byte {
+	pcm := int(sample) >> 3
+	mask := 0xD5
+	if pcm < 0 {
+		mask = 0x55
+		pcm = -pcm - 1
+	}
+
+	seg := len(alawSegmentEnds)
+	for i, end := range alawSegmentEnds {
+		if pcm <= end {
+			seg = i
+			break
+		}
+	}
+	if seg == len(alawSegmentEnds) {
+		return byte(0x7F ^ mask)
+	}
+
+	aval := seg << 4
+	if seg < 2 {
+		aval |= (pcm >> 1) & 0x0F
+	} else {
+		aval |= (pcm >> seg) & 0x0F
+	}
+	return byte(aval ^ mask)
+}
+
+// decodeG711 expands A-law or mu-law bytes to 16-bit little-endian PCM
+func decodeG711(data []byte, formatTag uint16) []byte {
+	expand := ulawToLinear
+	if formatTag == wavFormatALaw {
+		expand = alawToLinear
+	}
+
+	out := make([]byte, len(data)*2)
+	for i, b := range data {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(expand(b)))
+	}
+	return out
+}
+
+// encodeG711 compresses 16-bit little-endian PCM to A-law or mu-law bytes
+func encodeG711(pcm []byte, formatTag uint16) []byte {
+	compress := linearToULaw
+	if formatTag == wavFormatALaw {
+		compress = linearToALaw
+	}
+
+	out := make([]byte, len(pcm)/2)
+	for i := range out {
+		out[i] = compress(int16(binary.LittleEndian.Uint16(pcm[i*2:])))
+	}
+	return out
+}
+
+// parseCodec maps a /stream codec query value to a format tag.
+// An empty value or "pcm" leaves chunks as they are (tag 0).
+func parseCodec(name string) (uint16, error) {
+	switch strings.ToLower(name) {
+	case "", "pcm":
+		return 0, nil
+	case "ulaw", "mulaw", "pcmu":
+		return wavFormatULaw, nil
+	case "alaw", "pcma":
+		return wavFormatALaw, nil
+	case "opus":
+		return wavFormatOpus, nil
+	}
+	return 0, fmt.Errorf("unsupported codec: %s", name)
+}
+
+// withCodec returns a copy of chunk whose audio is compressed with the given
+// G.711 codec. A zero codec returns the chunk unchanged. Opus keeps state
+// between chunks and goes through an opusStream instead.
+func (c AudioChunk) withCodec(codec uint16) (AudioChunk, error) {
+	if codec == 0 {
+		return c, nil
+	}
+	if codec == wavFormatOpus {
+		return c, fmt.Errorf("opus needs a per-listener encoder")
+	}
+
+	raw := c.raw
+	if raw == nil {
+		decoded, err := hex.DecodeString(c.Audio)
+		if err != nil {
+			return c, fmt.Errorf("failed to decode chunk audio: %w", err)
+		}
+		raw = decoded
+	}
+	pcm := toPCM16(raw, c.AudioFormat["format_tag"], c.SampleWidth)
+
+	format := make(map[string]int, len(c.AudioFormat))
+	for k, v := range c.AudioFormat {
+		format[k] = v
+	}
+	format["format_tag"] = int(codec)
+	format["bits_per_sample"] = 8
+	format["valid_bits"] = 8
+	format["block_align"] = c.Channels
+
+	c.raw = encodeG711(pcm, codec)
+	c.Audio = hex.EncodeToString(c.raw)
+	c.SampleWidth = 1
+	c.AudioFormat = format
+	return c, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import "testing"
+
+// Reference values from the ITU-T G.711 tables
+func TestG711KnownVectors(t *testing.T) {
+	ulaw := []struct {
+		code   byte
+		linear int16
+	}{
+		{0x00, -32124}, {0x10, -15996}, {0x20, -7932}, {0x30, -3900},
+		{0x40, -1884}, {0x50, -876}, {0x60, -372}, {0x70, -120},
+		{0x7E, -8}, {0x7F, 0}, {0x80, 32124}, {0xFE, 8}, {0xFF, 0},
+	}
+	for _, v := range ulaw {
+		if got := ulawToLinear(v.code); got != v.linear {
+			t.Errorf("ulawToLinear(%#02x) = %d, want %d", v.code, got, v.linear)
+		}
+	}
+
+	alaw := []struct {
+		code   byte
+		linear int16
+	}{
+		{0xD5, 8}, {0x55, -8}, {0xAA, 32256}, {0x2A, -32256},
+		{0x80, 5504}, {0x00, -5504}, {0xD4, 24}, {0xC5, 264},
+	}
+	for _, v := range alaw {
+		if got := alawToLinear(v.code); got != v.linear {
+			t.Errorf("alawToLinear(%#02x) = %d, want %d", v.code, got, v.linear)
+		}
+	}
+
+	encode := []struct {
+		linear     int16
+		ulaw, alaw byte
+	}{
+		{0, 0xFF, 0xD5},
+		{-1, 0x7F, 0x55},
+		{32767, 0x80, 0xAA},
+		{-32768, 0x00, 0x2A},
+		{1000, 0xCE, 0xFA},
+		{-1000, 0x4E, 0x7A},
+	}
+	for _, v := range encode {
+		if got := linearToULaw(v.linear); got != v.ulaw {
+			t.Errorf("linearToULaw(%d) = %#02x, want %#02x", v.linear, got, v.ulaw)
+		}
+		if got := linearToALaw(v.linear); got != v.alaw {
+			t.Errorf("linearToALaw(%d) = %#02x, want %#02x", v.linear, got, v.alaw)
+		}
+	}
+}
+
+// Every code survives decoding and re-encoding, apart from mu-law's negative
+// zero, which encodes as positive zero
+func TestG711CodeRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		code := byte(i)
+		if got := linearToALaw(alawToLinear(code)); got != code {
+			t.Errorf("A-law %#02x round trips to %#02x", code, got)
+		}
+		if code == 0x7F {
+			continue
+		}
+		if got := linearToULaw(ulawToLinear(code)); got != code {
+			t.Errorf("mu-law %#02x round trips to %#02x", code, got)
+		}
+	}
+}
+
+// Linear samples come back within half a quantization step of the segment
+// they fall in
+func TestG711LinearRoundTrip(t *testing.T) {
+	for x := -32000; x <= 32000; x += 7 {
+		sample := int16(x)
+		tolerance := abs(x)/32 + 8
+		if got := int(ulawToLinear(linearToULaw(sample))); abs(got-x) > tolerance {
+			t.Errorf("mu-law %d round trips to %d", x, got)
+		}
+		if got := int(alawToLinear(linearToALaw(sample))); abs(got-x) > tolerance {
+			t.Errorf("A-law %d round trips to %d", x, got)
+		}
+	}
+}
+
+func TestG711Buffers(t *testing.T) {
+	pcm := []byte{0x00, 0x00, 0xE8, 0x03, 0x18, 0xFC, 0xFF, 0x7F}
+	for _, tag := range []uint16{wavFormatULaw, wavFormatALaw} {
+		coded := encodeG711(pcm, tag)
+		if len(coded) != len(pcm)/2 {
+			t.Fatalf("format %#x: %d codes for %d samples", tag, len(coded), len(pcm)/2)
+		}
+		decoded := decodeG711(coded, tag)
+		if len(decoded) != len(pcm) {
+			t.Fatalf("format %#x: decoded %d bytes, want %d", tag, len(decoded), len(pcm))
+		}
+		if got := encodeG711(decoded, tag); string(got) != string(coded) {
+			t.Errorf("format %#x: re-encoded % x, want % x", tag, got, coded)
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// Generator defaults
+const (
+	defaultGeneratorRate       = 48000
+	defaultGeneratorDurationMs = 10000
+	defaultGeneratorAmplitude  = -6.0
+	defaultSineFreq            = 1000.0
+	defaultChirpStart          = 20.0
+	defaultChirpEnd            = 20000.0
+	defaultClickIntervalMs     = 1000
+)
+
+// generatorNames lists the synthetic sources accepted by /switch
+var generatorNames = []string{"sine", "chirp", "white", "pink", "silence", "click"}
+
+// generatorConfig describes a synthetic test signal. Zero values select defaults.
+type generatorConfig struct {
+	Generator  string   `json:"generator"`
+	Freq       float64  `json:"freq,omitempty"`        // sine frequency or chirp start, Hz
+	FreqEnd    float64  `json:"freq_end,omitempty"`    // chirp end, Hz
+	Amplitude  *float64 `json:"amplitude,omitempty"`   // peak level, dBFS
+	DurationMs int      `json:"duration_ms,omitempty"` // loop length
+	IntervalMs int      `json:"interval_ms,omitempty"` // click spacing
+	SampleRate int      `json:"sample_rate,omitempty"`
+	Channels   int      `json:"channels,omitempty"`
+}
+
+// withDefaults fills unset fields and validates the result
+func (c generatorConfig) withDefaults() (generatorConfig, error) {
+	known := false
+	for _, name := range generatorNames {
+		if c.Generator == name {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return c, fmt.Errorf("unknown generator: %q", c.Generator)
+	}
+
+	if c.SampleRate == 0 {
+		c.SampleRate = defaultGeneratorRate
+	}
+	if c.Channels == 0 {
+		c.Channels = 1
+	}
+	if c.DurationMs == 0 {
+		c.DurationMs = defaultGeneratorDurationMs
+	}
+	if c.Amplitude == nil {
+		amplitude := defaultGeneratorAmplitude
+		c.Amplitude = &amplitude
+	}
+	switch c.Generator {
+	case "sine":
+		if c.Freq == 0 {
+			c.Freq = defaultSineFreq
+		}
+	case "chirp":
+		if c.Freq == 0 {
+			c.Freq = defaultChirpStart
+		}
+		if c.FreqEnd == 0 {
+			c.FreqEnd = math.Min(defaultChirpEnd, float64(c.SampleRate)/2*0.95)
+		}
+	case "click":
+		if c.IntervalMs == 0 {
+			c.IntervalMs = defaultClickIntervalMs
+		}
+	}
+
+	nyquist := float64(c.SampleRate) / 2
+	switch {
+	case c.SampleRate < 8000 || c.SampleRate > 192000:
+		return c, fmt.Errorf("sample rate %d out of range (8000-192000)", c.SampleRate)
+	case c.Channels < 1 || c.Channels > 8:
+		return c, fmt.Errorf("channels %d out of range (1-8)", c.Channels)
+	case c.DurationMs < 100:
+		return c, fmt.Errorf("duration %dms too short (minimum 100ms)", c.DurationMs)
+	case *c.Amplitude > 0:
+		return c, fmt.Errorf("amplitude %.1f dBFS must not exceed 0", *c.Amplitude)
+	case c.Freq < 0 || c.Freq >= nyquist:
+		return c, fmt.Errorf("frequency %.1f Hz must be below %.0f Hz", c.Freq, nyquist)
+	case c.FreqEnd < 0 || c.FreqEnd >= nyquist:
+		return c, fmt.Errorf("end frequency %.1f Hz must be below %.0f Hz", c.FreqEnd, nyquist)
+	case c.Generator == "chirp" && c.FreqEnd == c.Freq:
+		return c, fmt.Errorf("chirp start and end frequency must differ")
+	case c.IntervalMs < 0:
+		return c, fmt.Errorf("click interval %dms must be positive", c.IntervalMs)
+	}
+	return c, nil
+}
+
+// signalGenerator is a chunkSource that synthesises a looping test signal.
+// Samples are produced in order; any other access restarts the loop so noise
+// generators repeat exactly on every loop.
+type signalGenerator struct {
+	config         generatorConfig
+	format         wavFormat
+	framesPerChunk int
+	numChunks      int
+	gain           float64
+
+	mu   sync.Mutex
+	next int
+	rng  *rand.Rand
+	pink [7]float64
+}
+
+// newSignalGenerator validates cfg and prepares a generator for chunkDurationMs chunks
+func newSignalGenerator(cfg generatorConfig, chunkDurationMs int) (*signalGenerator, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	blockAlign := uint16(cfg.Channels * 2)
+	g := &signalGenerator{
+		config: cfg,
+		format: wavFormat{
+			FormatTag:     wavFormatPCM,
+			NumChannels:   uint16(cfg.Channels),
+			SampleRate:    uint32(cfg.SampleRate),
+			ByteRate:      uint32(cfg.SampleRate) * uint32(blockAlign),
+			BlockAlign:    blockAlign,
+			BitsPerSample: 16,
+			ValidBits:     16,
+		},
+		framesPerChunk: cfg.SampleRate * chunkDurationMs / 1000,
+		numChunks:      (cfg.DurationMs + chunkDurationMs - 1) / chunkDurationMs,
+		gain:           math.Pow(10, *cfg.Amplitude/20),
+	}
+	if g.framesPerChunk < 1 {
+		g.framesPerChunk = 1
+	}
+	g.restart()
+	return g, nil
+}
+
+// name identifies the generator in current_file
+func (g *signalGenerator) name() string {
+	return "generator:" + g.config.Generator
+}
+
+// restart rewinds noise state to the start of the loop
+func (g *signalGenerator) restart() {
+	g.next = 0
+	g.rng = rand.New(rand.NewSource(1))
+	g.pink = [7]float64{}
+}
+
+// Len returns the number of chunks in one loop
+func (g *signalGenerator) Len() int {
+	return g.numChunks
+}
+
+// Chunk synthesises the audio for a position
+func (g *signalGenerator) Chunk(position int) ([]byte, error) {
+	if position < 0 || position >= g.numChunks {
+		return nil, fmt.Errorf("chunk %d out of range (0-%d)", position, g.numChunks-1)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if position < g.next {
+		g.restart()
+	}
+	for g.next < position {
+		g.render()
+	}
+	return g.render(), nil
+}
+
+// render produces the next chunk in sequence
+func (g *signalGenerator) render() []byte {
+	channels := g.config.Channels
+	rate := float64(g.config.SampleRate)
+	start := g.next * g.framesPerChunk
+	out := make([]byte, g.framesPerChunk*channels*2)
+
+	for i := 0; i < g.framesPerChunk; i++ {
+		v := g.gain * g.sample(start+i, rate)
+		pcm := int16(math.Max(-1, math.Min(1, v)) * 32767)
+		for ch := 0; ch < channels; ch++ {
+			binary.LittleEndian.PutUint16(out[(i*channels+ch)*2:], uint16(pcm))
+		}
+	}
+
+	g.next++
+	return out
+}
+
+// sample returns the unscaled signal value in [-1, 1] for frame n of the loop
+func (g *signalGenerator) sample(n int, rate float64) float64 {
+	t := float64(n) / rate
+	switch g.config.Generator {
+	case "sine":
+		return math.Sin(2 * math.Pi * g.config.Freq * t)
+	case "chirp":
+		// Exponential sweep across the whole loop
+		f0, f1 := g.config.Freq, g.config.FreqEnd
+		duration := float64(g.numChunks*g.framesPerChunk) / rate
+		k := math.Log(f1 / f0)
+		return math.Sin(2 * math.Pi * f0 * duration / k * (math.Exp(t/duration*k) - 1))
+	case "white":
+		return g.rng.Float64()*2 - 1
+	case "pink":
+		return g.pinkSample()
+	case "click":
+		period := g.config.SampleRate * g.config.IntervalMs / 1000
+		if period > 0 && n%period == 0 {
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+// pinkSample filters white noise with Paul Kellet's refined pink noise filter
+func (g *signalGenerator) pinkSample() float64 {
+	white := g.rng.Float64()*2 - 1
+	b := &g.pink
+	b[0] = 0.99886*b[0] + white*0.0555179
+	b[1] = 0.99332*b[1] + white*0.0750759
+	b[2] = 0.96900*b[2] + white*0.1538520
+	b[3] = 0.86650*b[3] + white*0.3104856
+	b[4] = 0.55000*b[4] + white*0.5329522
+	b[5] = -0.7616*b[5] - white*0.0168980
+	pink := b[0] + b[1] + b[2] + b[3] + b[4] + b[5] + b[6] + white*0.5362
+	b[6] = white * 0.115926
+	// The filter has roughly 5x gain
+	return pink * 0.2
+}
+
+// Close releases nothing; generators hold no resources
+func (g *signalGenerator) Close() error {
+	return nil
+}
@@ -2,4 +2,9 @@ module audio-source
 
 go 1.21
 
-require github.com/google/uuid v1.5.0
+require (
+	audio-common v0.0.0
+	github.com/google/uuid v1.5.0
+)
+
+replace audio-common => ../audio-common
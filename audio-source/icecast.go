@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"audio-common/chunkproto"
+)
+
+// icyMetaInterval is the number of audio bytes between ICY metadata blocks
+const icyMetaInterval = 16000
+
+// listenFormat is the fixed PCM format of one /listen connection
+type listenFormat struct {
+	SampleRate int
+	Channels   int
+	Bits       int
+	Float      bool
+}
+
+// wavFormat returns the fmt chunk fields for f
+func (f listenFormat) wavFormat() wavFormat {
+	tag := uint16(wavFormatPCM)
+	if f.Float {
+		tag = wavFormatIEEEFloat
+	}
+	blockAlign := uint16(f.Channels * f.Bits / 8)
+	return wavFormat{
+		FormatTag:     tag,
+		NumChannels:   uint16(f.Channels),
+		SampleRate:    uint32(f.SampleRate),
+		ByteRate:      uint32(f.SampleRate) * uint32(blockAlign),
+		BlockAlign:    blockAlign,
+		BitsPerSample: uint16(f.Bits),
+		ValidBits:     uint16(f.Bits),
+	}
+}
+
+// alsaName returns the aplay -f name of the sample format
+func (f listenFormat) alsaName() string {
+	switch {
+	case f.Float:
+		return "FLOAT_LE"
+	case f.Bits == 8:
+		return "U8"
+	case f.Bits == 24:
+		return "S24_3LE"
+	}
+	return fmt.Sprintf("S%d_LE", f.Bits)
+}
+
+// streamingWAVHeader returns a WAV header whose RIFF and data sizes are left
+// open-ended, as players expect for a live stream
+func streamingWAVHeader(f listenFormat) []byte {
+	format := f.wavFormat()
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 0xFFFFFFFF)
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], format.FormatTag)
+	binary.LittleEndian.PutUint16(header[22:], format.NumChannels)
+	binary.LittleEndian.PutUint32(header[24:], format.SampleRate)
+	binary.LittleEndian.PutUint32(header[28:], format.ByteRate)
+	binary.LittleEndian.PutUint16(header[32:], format.BlockAlign)
+	binary.LittleEndian.PutUint16(header[34:], format.BitsPerSample)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], 0xFFFFFFFF)
+	return header
+}
+
+// pcmConverter converts chunks to a connection's fixed format, remixing
+// channels and resampling linearly so a switch never changes the stream.
+// Frames are held interleaved in buffers the converter reuses from chunk to
+// chunk, so a steady stream does not allocate.
+type pcmConverter struct {
+	out listenFormat
+
+	inRate int
+	prev   []float64 // last input frame, already remixed; empty before the first
+	pos    float64   // position of the next output frame, in input frames after prev
+
+	frames    []float64 // the chunk remixed to the output channels
+	resampled []float64
+	buf       []byte
+}
+
+// convert returns pcm, described by an AudioChunk format map, in the output
+// format. The result is only valid until the next call.
+func (c *pcmConverter) convert(pcm []byte, format map[string]int) []byte {
+	inChannels := format["channels"]
+	width := format["bits_per_sample"] / 8
+	inFloat := format["format_tag"] == wavFormatIEEEFloat
+	if inChannels < 1 || width < 1 {
+		return nil
+	}
+
+	// Remix every input frame to the output channel count
+	channels := c.out.Channels
+	n := len(pcm) / (inChannels * width)
+	if cap(c.frames) < n*channels {
+		c.frames = make([]float64, n*channels)
+	}
+	frames := c.frames[:n*channels]
+	for i := 0; i < n; i++ {
+		remix(frames[i*channels:(i+1)*channels], pcm[i*inChannels*width:], inChannels, width, inFloat)
+	}
+
+	// A new input rate restarts interpolation
+	if format["sample_rate"] != c.inRate {
+		c.inRate = format["sample_rate"]
+		c.prev = c.prev[:0]
+		c.pos = 0
+	}
+	if c.inRate != c.out.SampleRate && c.inRate > 0 {
+		frames = c.resample(frames)
+	}
+
+	outWidth := c.out.Bits / 8
+	if cap(c.buf) < len(frames)*outWidth {
+		c.buf = make([]byte, len(frames)*outWidth)
+	}
+	out := c.buf[:len(frames)*outWidth]
+	for i, v := range frames {
+		writeSample(out[i*outWidth:], outWidth, c.out.Float, v)
+	}
+	return out
+}
+
+// resample interpolates frames from the input rate to the output rate,
+// carrying the last frame over to the next chunk
+func (c *pcmConverter) resample(frames []float64) []float64 {
+	channels := c.out.Channels
+
+	// Frame i of the sequence prev, frames
+	offset := 0
+	if len(c.prev) > 0 {
+		offset = 1
+	}
+	total := len(frames)/channels + offset
+	at := func(i int) []float64 {
+		if i < offset {
+			return c.prev
+		}
+		j := (i - offset) * channels
+		return frames[j : j+channels]
+	}
+
+	if total < 2 {
+		if total == 1 {
+			c.prev = append(c.prev[:0], at(0)...)
+		}
+		return nil
+	}
+
+	step := float64(c.inRate) / float64(c.out.SampleRate)
+	out := c.resampled[:0]
+	for ; int(c.pos)+1 < total; c.pos += step {
+		i := int(c.pos)
+		frac := c.pos - float64(i)
+		a, b := at(i), at(i+1)
+		for ch := 0; ch < channels; ch++ {
+			out = append(out, a[ch]*(1-frac)+b[ch]*frac)
+		}
+	}
+	c.resampled = out
+	c.pos -= float64(total - 1)
+	c.prev = append(c.prev[:0], at(total-1)...)
+	return out
+}
+
+// remix reads one interleaved input frame into out: mono is averaged or
+// duplicated, other layouts keep the channels they share and pad with silence
+func remix(out []float64, pcm []byte, inChannels, width int, isFloat bool) {
+	switch {
+	case len(out) == 1 && inChannels > 1:
+		out[0] = 0
+		for ch := 0; ch < inChannels; ch++ {
+			out[0] += readSample(pcm[ch*width:], width, isFloat) / float64(inChannels)
+		}
+	case inChannels == 1:
+		v := readSample(pcm, width, isFloat)
+		for ch := range out {
+			out[ch] = v
+		}
+	default:
+		for ch := range out {
+			out[ch] = 0
+			if ch < inChannels {
+				out[ch] = readSample(pcm[ch*width:], width, isFloat)
+			}
+		}
+	}
+}
+
+// icyWriter interleaves ICY metadata blocks with the audio it writes
+type icyWriter struct {
+	w         http.ResponseWriter
+	metaint   int // zero when the client did not ask for metadata
+	untilMeta int
+	title     string
+	sent      string
+}
+
+// Write sends audio, inserting a metadata block every metaint bytes
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	if iw.metaint == 0 {
+		return iw.w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > iw.untilMeta {
+			n = iw.untilMeta
+		}
+		if _, err := iw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		iw.untilMeta -= n
+
+		if iw.untilMeta == 0 {
+			if _, err := iw.w.Write(iw.metadataBlock()); err != nil {
+				return written, err
+			}
+			iw.untilMeta = iw.metaint
+		}
+	}
+	return written, nil
+}
+
+// metadataBlock returns the next metadata block: the title when it has
+// changed since the last block, otherwise an empty block
+func (iw *icyWriter) metadataBlock() []byte {
+	if iw.title == iw.sent {
+		return []byte{0}
+	}
+	iw.sent = iw.title
+
+	// ICY has no escaping, so quotes are dropped from the title
+	meta := fmt.Sprintf("StreamTitle='%s';", strings.ReplaceAll(iw.title, "'", ""))
+	blocks := (len(meta) + 15) / 16
+	if blocks > 255 {
+		blocks = 255
+		meta = meta[:blocks*16]
+	}
+	out := make([]byte, 1+blocks*16)
+	out[0] = byte(blocks)
+	copy(out[1:], meta)
+	return out
+}
+
+// streamTitle names the audio a chunk came from for ICY metadata
+func streamTitle(file string) string {
+	return filepath.Base(file)
+}
+
+// parseListenFormat starts from the current audio format and applies any
+// rate, channels and bits query overrides
+func parseListenFormat(r *http.Request, current map[string]int) (listenFormat, error) {
+	f := listenFormat{
+		SampleRate: current["sample_rate"],
+		Channels:   current["channels"],
+		Bits:       current["bits_per_sample"],
+		Float:      current["format_tag"] == wavFormatIEEEFloat,
+	}
+	if f.Bits%8 != 0 || f.Bits < 8 || f.Bits > 32 {
+		f.Bits, f.Float = 16, false
+	}
+
+	query := r.URL.Query()
+	for name, field := range map[string]*int{"rate": &f.SampleRate, "channels": &f.Channels, "bits": &f.Bits} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return listenFormat{}, fmt.Errorf("invalid %s: %s", name, v)
+		}
+		*field = n
+		if name == "bits" {
+			f.Float = false
+		}
+	}
+
+	switch {
+	case f.SampleRate < 1000 || f.SampleRate > 384000:
+		return listenFormat{}, fmt.Errorf("unsupported sample rate: %d", f.SampleRate)
+	case f.Channels < 1 || f.Channels > 8:
+		return listenFormat{}, fmt.Errorf("unsupported channel count: %d", f.Channels)
+	case f.Bits != 8 && f.Bits != 16 && f.Bits != 24 && f.Bits != 32:
+		return listenFormat{}, fmt.Errorf("unsupported bits per sample: %d", f.Bits)
+	}
+	return f, nil
+}
+
+// handleListen streams the broadcast as one continuous audio stream for
+// ordinary players: a WAV file with open-ended sizes, or raw little-endian
+// PCM with ?format=pcm. The output format is fixed when the client connects
+// and later audio is converted to it. Clients sending Icy-MetaData: 1 get
+// ICY metadata carrying the current file as StreamTitle.
+func handleListen(w http.ResponseWriter, r *http.Request) {
+	raw := false
+	switch r.URL.Query().Get("format") {
+	case "", "wav":
+	case "pcm", "raw":
+		raw = true
+	default:
+		http.Error(w, "unsupported format: "+r.URL.Query().Get("format"), http.StatusBadRequest)
+		return
+	}
+
+	state := audioServer.GetState()
+	format, err := parseListenFormat(r, state["audio_format"].(map[string]int))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	out := &icyWriter{w: w, title: streamTitle(state["current_file"].(string))}
+	if r.Header.Get("Icy-MetaData") == "1" {
+		out.metaint = icyMetaInterval
+		out.untilMeta = icyMetaInterval
+		w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInterval))
+	}
+
+	if raw {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", "audio/wav")
+	}
+	w.Header().Set("X-Audio-Sample-Rate", strconv.Itoa(format.SampleRate))
+	w.Header().Set("X-Audio-Channels", strconv.Itoa(format.Channels))
+	w.Header().Set("X-Audio-Format", format.alsaName())
+	w.Header().Set("icy-name", "k8s-audio-lab")
+	w.Header().Set("icy-br", strconv.Itoa(format.SampleRate*format.Channels*format.Bits/1000))
+	w.Header().Set("ice-audio-info", fmt.Sprintf("ice-samplerate=%d;ice-channels=%d", format.SampleRate, format.Channels))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ch := make(chan streamEvent, audioServer.queueDepth)
+	audioServer.AddListener(ch)
+	defer audioServer.RemoveListener(ch)
+
+	if !raw {
+		if _, err := out.Write(streamingWAVHeader(format)); err != nil {
+			return
+		}
+	}
+	w.(http.Flusher).Flush()
+
+	converter := &pcmConverter{out: format}
+	for {
+		select {
+		case event := <-ch:
+			if event.Type != chunkproto.EventChunk {
+				continue
+			}
+			// A switch shows up in the next metadata block
+			chunk := event.Chunk
+			out.title = streamTitle(chunk.file)
+			if _, err := out.Write(converter.convert(chunk.raw, chunk.AudioFormat)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
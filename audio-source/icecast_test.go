@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// pcm16 encodes samples as 16-bit little-endian PCM
+func pcm16(samples ...int16) []byte {
+	out := make([]byte, 0, len(samples)*2)
+	for _, s := range samples {
+		out = binary.LittleEndian.AppendUint16(out, uint16(s))
+	}
+	return out
+}
+
+func TestPCMConverterRemixAndResample(t *testing.T) {
+	mono8k := map[string]int{"channels": 1, "bits_per_sample": 16, "sample_rate": 8000, "format_tag": wavFormatPCM}
+	c := &pcmConverter{out: listenFormat{SampleRate: 16000, Channels: 2, Bits: 16}}
+
+	// Doubling the rate interpolates halfway between input frames; the last
+	// frame waits for the next chunk to interpolate against
+	got := samples16(c.convert(pcm16(0, 1000, 2000), mono8k))
+	want := []int16{0, 0, 500, 500, 1000, 1000, 1500, 1500}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("first chunk %v, want %v", got, want)
+	}
+	got = samples16(c.convert(pcm16(4000), mono8k))
+	want = []int16{2000, 2000, 3000, 3000}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("second chunk %v, want %v", got, want)
+	}
+
+	// Stereo to mono at the same rate averages the channels
+	stereo := map[string]int{"channels": 2, "bits_per_sample": 16, "sample_rate": 16000, "format_tag": wavFormatPCM}
+	m := &pcmConverter{out: listenFormat{SampleRate: 16000, Channels: 1, Bits: 16}}
+	got = samples16(m.convert(pcm16(1000, 3000, -2000, 0), stereo))
+	want = []int16{2000, -1000}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("downmix %v, want %v", got, want)
+	}
+}
+
+// A steady stream reuses the converter's buffers
+func TestPCMConverterDoesNotAllocate(t *testing.T) {
+	chunk := make([]byte, 4410*4) // 100 ms of 44.1 kHz stereo
+	format := map[string]int{"channels": 2, "bits_per_sample": 16, "sample_rate": 44100, "format_tag": wavFormatPCM}
+	outputs := []listenFormat{
+		{SampleRate: 44100, Channels: 2, Bits: 16},
+		{SampleRate: 48000, Channels: 1, Bits: 16},
+		{SampleRate: 22050, Channels: 2, Bits: 32, Float: true},
+	}
+	for _, out := range outputs {
+		c := &pcmConverter{out: out}
+		c.convert(chunk, format)
+		if allocs := testing.AllocsPerRun(20, func() { c.convert(chunk, format) }); allocs > 0 {
+			t.Errorf("%+v: %.0f allocations per chunk", out, allocs)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A live input may run up to liveMaxBufferMs ahead of the audio loop. Pipes
+// and sockets that get further ahead drop their oldest audio, back down to
+// liveTargetBufferMs, which keeps latency bounded when the sender's clock is fast.
+const (
+	liveMaxBufferMs    = 500
+	liveTargetBufferMs = 200
+)
+
+// errLiveSwitch refuses a switch away from a live input, which cannot be
+// reopened once closed
+var errLiveSwitch = errors.New("live input is playing; switching is disabled")
+
+// liveInputConfig selects a live PCM input and its declared format
+type liveInputConfig struct {
+	Input    string // "-" for stdin, a file or FIFO path, or tcp://host:port
+	Format   string // U8, S16_LE, S24_3LE, S32_LE or FLOAT_LE
+	Rate     string
+	Channels string
+}
+
+// declaredFormat builds the wavFormat given by the format flags
+func (c liveInputConfig) declaredFormat() (wavFormat, error) {
+	tag, bits := uint16(wavFormatPCM), 0
+	switch strings.ToUpper(c.Format) {
+	case "U8":
+		bits = 8
+	case "S16_LE":
+		bits = 16
+	case "S24_3LE":
+		bits = 24
+	case "S32_LE":
+		bits = 32
+	case "FLOAT_LE":
+		tag, bits = wavFormatIEEEFloat, 32
+	default:
+		return wavFormat{}, fmt.Errorf("unsupported input format %q", c.Format)
+	}
+	rate, err := strconv.Atoi(c.Rate)
+	if err != nil || rate < 1000 || rate > 384000 {
+		return wavFormat{}, fmt.Errorf("invalid input rate %q", c.Rate)
+	}
+	channels, err := strconv.Atoi(c.Channels)
+	if err != nil || channels < 1 || channels > 8 {
+		return wavFormat{}, fmt.Errorf("invalid input channels %q", c.Channels)
+	}
+
+	blockAlign := uint16(channels * bits / 8)
+	return wavFormat{
+		FormatTag:     tag,
+		NumChannels:   uint16(channels),
+		SampleRate:    uint32(rate),
+		ByteRate:      uint32(rate) * uint32(blockAlign),
+		BlockAlign:    blockAlign,
+		BitsPerSample: uint16(bits),
+		ValidBits:     uint16(bits),
+	}, nil
+}
+
+// liveInput is a chunkSource fed by a live PCM stream. It has no length:
+// chunks are handed out in arrival order whatever position is asked for,
+// and silence fills in whenever the input falls behind the audio loop.
+type liveInput struct {
+	input       string
+	format      wavFormat
+	chunkBytes  int
+	maxBytes    int
+	targetBytes int
+	silence     byte
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	closed    bool
+	closers   []io.Closer
+	connected bool
+	received  int64
+	dropped   int64
+	underruns int
+	sessions  int
+}
+
+// newLiveInput opens the configured input. Stdin and regular files may start
+// with a WAV header, which then defines the format; FIFOs and TCP connections
+// use the declared format and any WAV header they send must match it.
+func newLiveInput(cfg liveInputConfig, chunkDurationMs int) (*liveInput, error) {
+	format, err := cfg.declaredFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &liveInput{input: cfg.Input}
+	l.cond = sync.NewCond(&l.mu)
+
+	switch {
+	case strings.HasPrefix(cfg.Input, "tcp://"):
+		listener, err := net.Listen("tcp", strings.TrimPrefix(cfg.Input, "tcp://"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for live input: %w", err)
+		}
+		l.setFormat(format, chunkDurationMs)
+		l.closers = append(l.closers, listener)
+		go l.acceptLoop(listener)
+
+	case isFIFO(cfg.Input):
+		l.setFormat(format, chunkDurationMs)
+		go l.fifoLoop(cfg.Input)
+
+	default:
+		var file *os.File
+		if cfg.Input == "-" {
+			file = os.Stdin
+		} else if file, err = os.Open(cfg.Input); err != nil {
+			return nil, fmt.Errorf("failed to open live input: %w", err)
+		}
+		r := bufio.NewReader(file)
+		if f, ok, err := readStreamHeader(r); err != nil {
+			file.Close()
+			return nil, err
+		} else if ok {
+			format = f
+		}
+		l.setFormat(format, chunkDurationMs)
+		l.closers = append(l.closers, file)
+
+		// A regular file would otherwise be read far faster than real time
+		info, _ := file.Stat()
+		block := info != nil && info.Mode().IsRegular()
+		go func() {
+			l.read(r, block)
+			log.Printf("Live input %s ended", l.input)
+		}()
+	}
+
+	log.Printf("Live input %s: %d channels, %d Hz, %d-bit", cfg.Input, format.NumChannels, format.SampleRate, format.BitsPerSample)
+	return l, nil
+}
+
+// setFormat fixes the stream format and chunk size
+func (l *liveInput) setFormat(format wavFormat, chunkDurationMs int) {
+	l.format = format
+	frames := int(format.SampleRate) * chunkDurationMs / 1000
+	l.chunkBytes = frames * int(format.BlockAlign)
+	l.maxBytes = int(format.SampleRate) * liveMaxBufferMs / 1000 * int(format.BlockAlign)
+	l.targetBytes = int(format.SampleRate) * liveTargetBufferMs / 1000 * int(format.BlockAlign)
+	if format.BitsPerSample == 8 {
+		l.silence = 0x80
+	}
+}
+
+// isFIFO reports whether path names a named pipe
+func isFIFO(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// readStreamHeader consumes a WAV header if the stream starts with one,
+// stopping at the start of the data chunk
+func readStreamHeader(r *bufio.Reader) (wavFormat, bool, error) {
+	magic, err := r.Peek(4)
+	if err != nil || string(magic) != "RIFF" {
+		return wavFormat{}, false, nil
+	}
+
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[8:]) != "WAVE" {
+		return wavFormat{}, false, fmt.Errorf("invalid WAV header on live input")
+	}
+	var format wavFormat
+	foundFormat := false
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return wavFormat{}, false, fmt.Errorf("failed to read WAV header on live input: %w", err)
+		}
+		size := binary.LittleEndian.Uint32(header[4:])
+		switch string(header[:4]) {
+		case "fmt ":
+			if format, err = readFmtChunk(r, size); err != nil {
+				return wavFormat{}, false, err
+			}
+			if size%2 == 1 {
+				r.ReadByte()
+			}
+			foundFormat = true
+		case "data":
+			if !foundFormat {
+				return wavFormat{}, false, fmt.Errorf("fmt chunk not found on live input")
+			}
+			if err := format.validate(); err != nil {
+				return wavFormat{}, false, err
+			}
+			if tag := format.encoding(); tag != wavFormatPCM && tag != wavFormatIEEEFloat {
+				return wavFormat{}, false, fmt.Errorf("live input must be linear PCM, got %s", encodingName(tag))
+			}
+			return format, true, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size)+int64(size%2)); err != nil {
+				return wavFormat{}, false, fmt.Errorf("failed to skip WAV chunk on live input: %w", err)
+			}
+		}
+	}
+}
+
+// attach checks an optional WAV header on a new connection against the
+// stream format
+func (l *liveInput) attach(r *bufio.Reader) error {
+	f, ok, err := readStreamHeader(r)
+	if err != nil {
+		return err
+	}
+	if ok && (f.encoding() != l.format.encoding() || f.NumChannels != l.format.NumChannels ||
+		f.SampleRate != l.format.SampleRate || f.BitsPerSample != l.format.BitsPerSample) {
+		return fmt.Errorf("input is %d Hz %d-bit %d channels, want %d Hz %d-bit %d channels",
+			f.SampleRate, f.BitsPerSample, f.NumChannels,
+			l.format.SampleRate, l.format.BitsPerSample, l.format.NumChannels)
+	}
+	return nil
+}
+
+// acceptLoop takes one TCP sender at a time
+func (l *liveInput) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Live input accept failed: %v", err)
+			}
+			return
+		}
+
+		// Claim the input before reading so a second sender is turned away
+		l.mu.Lock()
+		busy := l.connected
+		l.connected = true
+		l.mu.Unlock()
+		if busy {
+			log.Printf("Rejecting live input from %s: already receiving", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if err := l.attach(r); err != nil {
+				log.Printf("Rejecting live input from %s: %v", conn.RemoteAddr(), err)
+				l.mu.Lock()
+				l.connected = false
+				l.mu.Unlock()
+				return
+			}
+			log.Printf("Live input connected from %s", conn.RemoteAddr())
+			l.read(r, false)
+			log.Printf("Live input from %s disconnected", conn.RemoteAddr())
+		}()
+	}
+}
+
+// fifoLoop reads a named pipe, reopening it whenever its writer goes away
+func (l *liveInput) fifoLoop(path string) {
+	for {
+		// Opening blocks until a writer appears
+		file, err := os.Open(path)
+		if err != nil {
+			log.Printf("Failed to open live input FIFO: %v", err)
+			return
+		}
+		l.mu.Lock()
+		closed := l.closed
+		l.closers = []io.Closer{file}
+		l.mu.Unlock()
+		if closed {
+			file.Close()
+			return
+		}
+
+		r := bufio.NewReader(file)
+		if err := l.attach(r); err != nil {
+			log.Printf("Rejecting live input from %s: %v", path, err)
+		} else {
+			l.read(r, false)
+		}
+		file.Close()
+	}
+}
+
+// read copies r into the buffer until it ends. Blocking readers wait for room;
+// others drop the oldest audio when the buffer is full.
+func (l *liveInput) read(r io.Reader, block bool) {
+	l.mu.Lock()
+	l.connected = true
+	l.sessions++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.connected = false
+		l.mu.Unlock()
+	}()
+
+	data := make([]byte, 16*1024)
+	for {
+		n, err := r.Read(data)
+		if n > 0 {
+			l.mu.Lock()
+			for block && len(l.buf) >= l.maxBytes && !l.closed {
+				l.cond.Wait()
+			}
+			if l.closed {
+				l.mu.Unlock()
+				return
+			}
+			l.buf = append(l.buf, data[:n]...)
+			l.received += int64(n)
+			if !block && len(l.buf) > l.maxBytes {
+				// Drop whole frames so the stream stays aligned
+				align := int(l.format.BlockAlign)
+				excess := len(l.buf) - l.targetBytes
+				excess = (excess + align - 1) / align * align
+				l.buf = l.buf[excess:]
+				l.dropped += int64(excess)
+			}
+			l.mu.Unlock()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Live input read failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// Len returns zero: a live input has no loop
+func (l *liveInput) Len() int {
+	return 0
+}
+
+// Chunk returns the next chunk of buffered audio, padded with silence when
+// the input has fallen behind
+func (l *liveInput) Chunk(position int) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	chunk := make([]byte, l.chunkBytes)
+	n := len(l.buf)
+	if n < l.chunkBytes {
+		n -= n % int(l.format.BlockAlign)
+		for i := n; i < len(chunk); i++ {
+			chunk[i] = l.silence
+		}
+		if l.connected {
+			l.underruns++
+		}
+	} else {
+		n = l.chunkBytes
+	}
+	copy(chunk, l.buf[:n])
+	l.buf = l.buf[n:]
+	l.cond.Broadcast()
+	return chunk, nil
+}
+
+// Close stops reading and releases the input
+func (l *liveInput) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	closers := l.closers
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	for _, c := range closers {
+		if c != os.Stdin {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// name identifies the input in current_file
+func (l *liveInput) name() string {
+	return "live:" + l.input
+}
+
+// info describes the live input for /status
+func (l *liveInput) info() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bytesPerMs := float64(l.format.ByteRate) / 1000
+	return map[string]interface{}{
+		"input":          l.input,
+		"connected":      l.connected,
+		"sessions":       l.sessions,
+		"buffered_ms":    float64(len(l.buf)) / bytesPerMs,
+		"received_bytes": l.received,
+		"dropped_ms":     float64(l.dropped) / bytesPerMs,
+		"underruns":      l.underruns,
+	}
+}
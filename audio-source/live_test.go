@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestLiveInput is a live input of the given format with no source attached
+func newTestLiveInput(format wavFormat) *liveInput {
+	l := &liveInput{input: "test"}
+	l.cond = sync.NewCond(&l.mu)
+	l.setFormat(format, 100)
+	return l
+}
+
+// waitReceived waits until the input has taken n bytes in total
+func waitReceived(t *testing.T, l *liveInput, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l.mu.Lock()
+		received := l.received
+		l.mu.Unlock()
+		if received >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("live input received %d bytes, want %d", received, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// ramp is n bytes counting up from zero
+func ramp(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestLiveDeclaredFormat(t *testing.T) {
+	cases := []struct {
+		cfg  liveInputConfig
+		want wavFormat // zero for an error
+	}{
+		{liveInputConfig{Format: "S16_LE", Rate: "44100", Channels: "2"},
+			wavFormat{FormatTag: wavFormatPCM, NumChannels: 2, SampleRate: 44100, ByteRate: 176400, BlockAlign: 4, BitsPerSample: 16, ValidBits: 16}},
+		{liveInputConfig{Format: "s24_3le", Rate: "48000", Channels: "1"},
+			wavFormat{FormatTag: wavFormatPCM, NumChannels: 1, SampleRate: 48000, ByteRate: 144000, BlockAlign: 3, BitsPerSample: 24, ValidBits: 24}},
+		{liveInputConfig{Format: "FLOAT_LE", Rate: "384000", Channels: "8"},
+			wavFormat{FormatTag: wavFormatIEEEFloat, NumChannels: 8, SampleRate: 384000, ByteRate: 12288000, BlockAlign: 32, BitsPerSample: 32, ValidBits: 32}},
+		{liveInputConfig{Format: "U8", Rate: "1000", Channels: "1"},
+			wavFormat{FormatTag: wavFormatPCM, NumChannels: 1, SampleRate: 1000, ByteRate: 1000, BlockAlign: 1, BitsPerSample: 8, ValidBits: 8}},
+		{liveInputConfig{Format: "S8", Rate: "44100", Channels: "2"}, wavFormat{}},
+		{liveInputConfig{Format: "S16_LE", Rate: "999", Channels: "2"}, wavFormat{}},
+		{liveInputConfig{Format: "S16_LE", Rate: "384001", Channels: "2"}, wavFormat{}},
+		{liveInputConfig{Format: "S16_LE", Rate: "44.1k", Channels: "2"}, wavFormat{}},
+		{liveInputConfig{Format: "S16_LE", Rate: "44100", Channels: "0"}, wavFormat{}},
+		{liveInputConfig{Format: "S16_LE", Rate: "44100", Channels: "9"}, wavFormat{}},
+	}
+	for _, tc := range cases {
+		got, err := tc.cfg.declaredFormat()
+		if (err != nil) != (tc.want == wavFormat{}) || got != tc.want {
+			t.Errorf("%+v: got %+v, %v; want %+v", tc.cfg, got, err, tc.want)
+		}
+	}
+
+	// A bad declared format stops the input from opening at all
+	if _, err := newLiveInput(liveInputConfig{Input: "-", Format: "S16_LE", Rate: "0", Channels: "2"}, 100); err == nil {
+		t.Error("opened a live input with a sample rate of 0")
+	}
+}
+
+func TestLiveInputChunks(t *testing.T) {
+	// 100ms of 8 kHz 16-bit mono is 1600 bytes
+	l := newTestLiveInput(wavFormat{FormatTag: wavFormatPCM, NumChannels: 1, SampleRate: 8000, ByteRate: 16000, BlockAlign: 2, BitsPerSample: 16})
+	if l.chunkBytes != 1600 || l.maxBytes != 8000 || l.targetBytes != 3200 {
+		t.Fatalf("chunk %d, max %d, target %d bytes", l.chunkBytes, l.maxBytes, l.targetBytes)
+	}
+	pr, pw := io.Pipe()
+	go l.read(pr, false)
+
+	// Enough for a chunk and a half, plus half a frame
+	data := ramp(2401)
+	pw.Write(data)
+	waitReceived(t, l, 2401)
+	if chunk, _ := l.Chunk(0); !bytes.Equal(chunk, data[:1600]) {
+		t.Errorf("first chunk is not the first 1600 bytes of input")
+	}
+
+	// The rest comes out in whole frames, padded with silence
+	chunk, _ := l.Chunk(1)
+	if !bytes.Equal(chunk[:800], data[1600:2400]) || !bytes.Equal(chunk[800:], make([]byte, 800)) {
+		t.Errorf("short chunk not padded with silence after 800 bytes")
+	}
+	if l.underruns != 1 || len(l.buf) != 1 {
+		t.Errorf("%d underruns, %d bytes left; want 1 underrun and the half frame", l.underruns, len(l.buf))
+	}
+	pw.Close()
+}
+
+func TestLiveInputSilence(t *testing.T) {
+	// Unsigned 8-bit silence is 0x80, and nothing counts as an underrun
+	// while no sender is connected
+	l := newTestLiveInput(wavFormat{FormatTag: wavFormatPCM, NumChannels: 1, SampleRate: 8000, ByteRate: 8000, BlockAlign: 1, BitsPerSample: 8})
+	chunk, _ := l.Chunk(0)
+	if len(chunk) != 800 || !bytes.Equal(chunk, bytes.Repeat([]byte{0x80}, 800)) {
+		t.Errorf("silent chunk % x...", chunk[:4])
+	}
+	if l.underruns != 0 {
+		t.Errorf("%d underruns with nothing connected", l.underruns)
+	}
+}
+
+func TestLiveInputTrim(t *testing.T) {
+	format := wavFormat{FormatTag: wavFormatPCM, NumChannels: 1, SampleRate: 8000, ByteRate: 16000, BlockAlign: 2, BitsPerSample: 16}
+
+	// A pipe 600ms ahead is cut back to the newest 200ms
+	l := newTestLiveInput(format)
+	pr, pw := io.Pipe()
+	go l.read(pr, false)
+	data := ramp(9600)
+	pw.Write(data)
+	waitReceived(t, l, 9600)
+	info := l.info()
+	if info["buffered_ms"] != 200.0 || info["dropped_ms"] != 400.0 {
+		t.Errorf("buffered %v ms, dropped %v ms; want 200 and 400", info["buffered_ms"], info["dropped_ms"])
+	}
+	if chunk, _ := l.Chunk(0); !bytes.Equal(chunk, data[6400:8000]) {
+		t.Error("trimmed buffer does not hold the newest audio")
+	}
+	pw.Close()
+
+	// Up to 500ms ahead is kept
+	l = newTestLiveInput(format)
+	pr, pw = io.Pipe()
+	go l.read(pr, false)
+	pw.Write(ramp(8000))
+	waitReceived(t, l, 8000)
+	if info := l.info(); info["buffered_ms"] != 500.0 || info["dropped_ms"] != 0.0 {
+		t.Errorf("buffered %v ms, dropped %v ms; want 500 and 0", info["buffered_ms"], info["dropped_ms"])
+	}
+	pw.Close()
+
+	// Files wait for room instead of losing audio
+	l = newTestLiveInput(format)
+	done := make(chan struct{})
+	go func() {
+		l.read(bytes.NewReader(data), true)
+		close(done)
+	}()
+	var got []byte
+	for len(got) < len(data) {
+		waitReceived(t, l, int64(len(got)+1600))
+		chunk, _ := l.Chunk(0)
+		got = append(got, chunk...)
+	}
+	<-done
+	if !bytes.Equal(got, data) || l.dropped != 0 {
+		t.Errorf("file input dropped %d bytes", l.dropped)
+	}
+}
+
+func TestLiveInputHeader(t *testing.T) {
+	declared := wavFormat{FormatTag: wavFormatPCM, NumChannels: 2, SampleRate: 44100, BlockAlign: 4, BitsPerSample: 16}
+	cases := []struct {
+		name   string
+		stream []byte
+		ok     bool
+	}{
+		{"raw PCM", ramp(64), true},
+		{"matching header", wavFile(declared, ramp(64)), true},
+		{"other rate", wavFile(wavFormat{FormatTag: wavFormatPCM, NumChannels: 2, SampleRate: 48000, BlockAlign: 4, BitsPerSample: 16}, ramp(64)), false},
+		{"other depth", wavFile(wavFormat{FormatTag: wavFormatPCM, NumChannels: 2, SampleRate: 44100, BlockAlign: 6, BitsPerSample: 24}, ramp(64)), false},
+		{"not linear PCM", wavFile(wavFormat{FormatTag: wavFormatULaw, NumChannels: 2, SampleRate: 44100, BlockAlign: 2, BitsPerSample: 8}, ramp(64)), false},
+		{"sample rate 0", wavFile(wavFormat{FormatTag: wavFormatPCM, NumChannels: 2, BlockAlign: 4, BitsPerSample: 16}, ramp(64)), false},
+	}
+	for _, tc := range cases {
+		l := newTestLiveInput(declared)
+		server, client := net.Pipe()
+		go func() {
+			client.Write(tc.stream)
+			client.Close()
+		}()
+		r := bufio.NewReader(server)
+		err := l.attach(r)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: attach returned %v", tc.name, err)
+		}
+		if err == nil {
+			// The audio after any header is what gets buffered
+			if rest, _ := io.ReadAll(r); !bytes.Equal(rest, ramp(64)) {
+				t.Errorf("%s: %d bytes of audio after the header", tc.name, len(rest))
+			}
+		}
+		server.Close()
+	}
+}
@@ -1,40 +1,36 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-)
 
-// AudioChunk represents a chunk of audio with metadata
-type AudioChunk struct {
-	IntervalID   string            `json:"interval_id"`
-	LoopCount    int               `json:"loop_count"`
-	Position     int               `json:"position"`
-	TotalChunks  int               `json:"total_chunks"`
-	Timestamp    int64             `json:"timestamp"`
-	Audio        string            `json:"audio"` // hex encoded
-	SampleRate   int               `json:"sample_rate"`
-	Channels     int               `json:"channels"`
-	SampleWidth  int               `json:"sample_width"`
-	AudioFormat  map[string]int    `json:"audio_format"`
-}
+	"audio-common/chunkproto"
+	"audio-common/opus"
+)
 
 // AudioServer manages the audio loop and clients
 type AudioServer struct {
 	wavFile         string
+	audioDir        string
 	availableFiles  []string
 	chunkDurationMs int
-	audioChunks     [][]byte
+	queueDepth      int // chunks queued per listener
+	audio           chunkSource
 	currentPosition int
 	loopStartTime   time.Time
 	intervalID      string
@@ -42,141 +38,133 @@ type AudioServer struct {
 	sampleRate      int
 	channels        int
 	sampleWidth     int
+	format          wavFormat
+	pcmFormat       wavFormat
 	
-	listeners    map[chan AudioChunk]bool
+	listeners    map[chan streamEvent]bool
 	listenersMux sync.RWMutex
 	
 	totalDurationMs int
 	switching       bool
 	switchMux       sync.Mutex
+	
+	// Optional timing watermark mixed into the audio
+	watermark *watermarker
+	
+	// Playback schedule: chunk nextChunk is due at epoch + nextChunk chunk durations
+	epoch     time.Time
+	nextChunk int
+	loopIndex int
+	timing    playbackTiming
+	
+	// Optional cluster sync; contentHash identifies the current audio
+	cluster     *clusterSync
+	contentHash string
+	
+	// Optional RTP output
+	rtp *rtpSender
+	
+	// Event IDs continue from idBase after each switch; recent chunks are
+	// kept for clients resuming with Last-Event-ID
+	idBase      int64
+	nextEventID int64
+	history     *chunkHistory
 }
 
 // NewAudioServer creates a new audio server instance
-func NewAudioServer(wavFile string, chunkDurationMs int) *AudioServer {
+func NewAudioServer(cfg sourceConfig) *AudioServer {
 	return &AudioServer{
-		wavFile:         wavFile,
-		availableFiles:  []string{"audio.wav", "audio-spam-1.wav", "audio-spam-2.wav", "audio-spam-3.wav"},
-		chunkDurationMs: chunkDurationMs,
-		listeners:       make(map[chan AudioChunk]bool),
+		wavFile:         filepath.Join(cfg.AudioDir, cfg.DefaultFile),
+		audioDir:        cfg.AudioDir,
+		availableFiles:  audioFiles(cfg.AudioDir),
+		chunkDurationMs: cfg.ChunkDurationMs,
+		queueDepth:      cfg.QueueDepth,
+		listeners:       make(map[chan streamEvent]bool),
+		history:         newChunkHistory(cfg.ChunkDurationMs),
 	}
 }
 
-// LoadAudio loads and chunks the WAV file
+// LoadAudio loads and chunks the current audio file
 func (s *AudioServer) LoadAudio() error {
+	contentHash := ""
+	if s.cluster != nil {
+		hash, err := hashFile(s.wavFile)
+		if err != nil {
+			return err
+		}
+		contentHash = hash
+	}
+	
+	load := s.loadWAV
+	if strings.EqualFold(filepath.Ext(s.wavFile), ".flac") {
+		load = s.loadFLAC
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	
+	s.contentHash = contentHash
+	return nil
+}
+
+// loadFLAC prepares a FLAC file for chunked playback
+func (s *AudioServer) loadFLAC() error {
+	reader, err := newFLACChunkReader(s.wavFile, s.chunkDurationMs)
+	if err != nil {
+		return err
+	}
+	s.setAudio(reader, reader.format, reader.pcmFormat)
+	return nil
+}
+
+// loadWAV parses the WAV header and prepares the data chunk for chunked playback
+func (s *AudioServer) loadWAV() error {
 	file, err := os.Open(s.wavFile)
 	if err != nil {
 		return fmt.Errorf("failed to open WAV file: %w", err)
 	}
 	defer file.Close()
 
-	// Read RIFF header
-	var riffHeader struct {
-		ChunkID   [4]byte
-		ChunkSize uint32
-		Format    [4]byte
+	formatInfo, dataOffset, dataSize, err := readWAVHeader(file)
+	if err != nil {
+		return err
 	}
 	
-	if err := binary.Read(file, binary.LittleEndian, &riffHeader); err != nil {
-		return fmt.Errorf("failed to read RIFF header: %w", err)
+	// Audio is read from disk on demand
+	reader, err := newWAVChunkReader(s.wavFile, dataOffset, dataSize, formatInfo, s.chunkDurationMs)
+	if err != nil {
+		return err
 	}
 	
-	if string(riffHeader.ChunkID[:]) != "RIFF" || string(riffHeader.Format[:]) != "WAVE" {
-		return fmt.Errorf("not a valid WAV file")
-	}
+	s.setAudio(reader, formatInfo, reader.pcmFormat)
+	return nil
+}
 
-	// Process chunks to find fmt and data
-	var formatInfo struct {
-		AudioFormat   uint16
-		NumChannels   uint16
-		SampleRate    uint32
-		ByteRate      uint32
-		BlockAlign    uint16
-		BitsPerSample uint16
+// setAudio installs a new chunk source, closing the previous one
+func (s *AudioServer) setAudio(audio chunkSource, format, pcmFormat wavFormat) {
+	// Chunks are streamed as linear PCM
+	s.sampleRate = int(pcmFormat.SampleRate)
+	s.channels = int(pcmFormat.NumChannels)
+	s.sampleWidth = int(pcmFormat.BitsPerSample / 8)
+	s.format = format
+	s.pcmFormat = pcmFormat
+	
+	oldAudio := s.audio
+	s.audio = audio
+	if oldAudio != nil {
+		oldAudio.Close()
 	}
 	
-	foundFormat := false
+	s.totalDurationMs = s.audio.Len() * s.chunkDurationMs
 	
-	// Look for chunks
-	for {
-		var chunkID [4]byte
-		var chunkSize uint32
-		
-		if err := binary.Read(file, binary.LittleEndian, &chunkID); err != nil {
-			if err == io.EOF {
-				return fmt.Errorf("data chunk not found")
-			}
-			return fmt.Errorf("failed to read chunk ID: %w", err)
-		}
-		if err := binary.Read(file, binary.LittleEndian, &chunkSize); err != nil {
-			return fmt.Errorf("failed to read chunk size: %w", err)
-		}
-		
-		chunkIDStr := string(chunkID[:])
-		
-		if chunkIDStr == "fmt " {
-			// Read format info
-			if err := binary.Read(file, binary.LittleEndian, &formatInfo); err != nil {
-				return fmt.Errorf("failed to read format info: %w", err)
-			}
-			foundFormat = true
-			
-			// Skip any extra format bytes
-			extraBytes := int(chunkSize) - 16
-			if extraBytes > 0 {
-				file.Seek(int64(extraBytes), 1)
-			}
-		} else if chunkIDStr == "data" && foundFormat {
-			// Found data chunk
-			s.sampleRate = int(formatInfo.SampleRate)
-			s.channels = int(formatInfo.NumChannels)
-			s.sampleWidth = int(formatInfo.BitsPerSample / 8)
-			
-			// Read all audio data
-			audioData := make([]byte, chunkSize)
-			if _, err := io.ReadFull(file, audioData); err != nil {
-				return fmt.Errorf("failed to read audio data: %w", err)
-			}
-			
-			// Calculate chunk size
-			bytesPerMs := (s.sampleRate * s.sampleWidth * s.channels) / 1000
-			chunkSize := bytesPerMs * s.chunkDurationMs
-			
-			// Ensure even chunk size for 16-bit audio
-			if chunkSize%2 != 0 {
-				chunkSize++
-			}
-			
-			// Split into chunks
-			s.audioChunks = nil
-			for i := 0; i < len(audioData); i += chunkSize {
-				end := i + chunkSize
-				if end > len(audioData) {
-					end = len(audioData)
-				}
-				
-				chunk := audioData[i:end]
-				if len(chunk) == chunkSize {
-					s.audioChunks = append(s.audioChunks, chunk)
-				} else if len(chunk) > 0 {
-					// Pad last chunk
-					padded := make([]byte, chunkSize)
-					copy(padded, chunk)
-					s.audioChunks = append(s.audioChunks, padded)
-				}
-			}
-			
-			s.totalDurationMs = len(s.audioChunks) * s.chunkDurationMs
-			
-			log.Printf("Loaded audio: %d channels, %d Hz, %d-bit, %d chunks, %dms total",
-				s.channels, s.sampleRate, s.sampleWidth*8, len(s.audioChunks), s.totalDurationMs)
-			
-			return nil
-		} else {
-			// Skip unknown chunks
-			if _, err := file.Seek(int64(chunkSize), 1); err != nil {
-				return fmt.Errorf("failed to skip chunk %s: %w", chunkIDStr, err)
-			}
-		}
+	log.Printf("Loaded audio: %d channels, %d Hz, %d-bit (format 0x%04x), %d chunks, %dms total",
+		s.channels, s.sampleRate, s.sampleWidth*8, s.format.FormatTag, s.audio.Len(), s.totalDurationMs)
+	if s.format.encoding() != pcmFormat.encoding() {
+		log.Printf("Decoded %s to %s", encodingName(s.format.encoding()), encodingName(pcmFormat.encoding()))
+	}
+	if s.format.FormatTag == wavFormatExtensible {
+		log.Printf("Extensible format: %d valid bits, channel mask 0x%x %v, sub-format %s",
+			s.format.ValidBits, s.format.ChannelMask, s.format.speakers(), s.format.subFormatString())
 	}
 }
 
@@ -185,64 +173,156 @@ func (s *AudioServer) Start() {
 	go s.audioLoop()
 }
 
-// audioLoop continuously plays audio chunks
+// audioLoop continuously plays audio chunks. Chunk n of the current playback
+// is due at epoch + n chunk durations, so late wake-ups never accumulate drift.
 func (s *AudioServer) audioLoop() {
 	time.Sleep(time.Second) // Give server time to start
 	
-	ticker := time.NewTicker(time.Duration(s.chunkDurationMs) * time.Millisecond)
-	defer ticker.Stop()
+	s.switchMux.Lock()
+	s.resetPlayback()
+	s.switchMux.Unlock()
 	
-	for range ticker.C {
-		// Start of new loop
-		if s.currentPosition == 0 {
-			s.intervalID = uuid.New().String()
-			s.loopStartTime = time.Now()
-			s.loopCount++
-			log.Printf("Starting loop #%d, interval: %s", s.loopCount, s.intervalID)
-		}
+	chunkDuration := time.Duration(s.chunkDurationMs) * time.Millisecond
+	for {
+		s.switchMux.Lock()
+		due := s.epoch.Add(time.Duration(s.nextChunk) * chunkDuration)
+		s.switchMux.Unlock()
 		
-		// Create chunk data
-		chunk := AudioChunk{
-			IntervalID:  s.intervalID,
-			LoopCount:   s.loopCount,
-			Position:    s.currentPosition,
-			TotalChunks: len(s.audioChunks),
-			Timestamp:   time.Now().UnixMilli(),
-			Audio:       hex.EncodeToString(s.audioChunks[s.currentPosition]),
-			SampleRate:  s.sampleRate,
-			Channels:    s.channels,
-			SampleWidth: s.sampleWidth,
-			AudioFormat: map[string]int{
-				"channels":        s.channels,
-				"sample_rate":     s.sampleRate,
-				"bits_per_sample": s.sampleWidth * 8,
-			},
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(wait)
 		}
 		
-		// Send to all listeners
-		s.broadcast(chunk)
-		
-		// Move to next position
-		s.currentPosition = (s.currentPosition + 1) % len(s.audioChunks)
+		s.switchMux.Lock()
+		s.tick(chunkDuration)
+		s.switchMux.Unlock()
 	}
 }
 
-// broadcast sends chunk to all listeners
-func (s *AudioServer) broadcast(chunk AudioChunk) {
+// tick sends the chunk that is due, catching up on small delays and skipping
+// ahead when playback has fallen too far behind the wall clock
+func (s *AudioServer) tick(chunkDuration time.Duration) {
+	now := time.Now()
+	lateness := now.Sub(s.epoch.Add(time.Duration(s.nextChunk) * chunkDuration))
+	if lateness < 0 {
+		// Playback was reset while we slept
+		return
+	}
+	
+	skipped := 0
+	if behind := int(lateness / chunkDuration); behind > maxCatchUpChunks {
+		log.Printf("Audio loop fell %v behind, skipping %d chunks", lateness.Round(time.Millisecond), behind)
+		skipped = behind
+		s.nextChunk += skipped
+		lateness -= time.Duration(skipped) * chunkDuration
+	}
+	s.timing.record(lateness, chunkDuration, skipped)
+	
+	// Replicas in cluster sync stamp chunks with their schedule, not the send time
+	timestamp := now
+	if s.cluster != nil {
+		timestamp = s.epoch.Add(time.Duration(s.nextChunk) * chunkDuration)
+	}
+	
+	// Position and loop follow from the chunk index
+	total := s.audio.Len()
+	loop, position := s.chunkPosition(s.nextChunk)
+	s.currentPosition = position
+	s.nextChunk++
+	
+	// Start of new loop
+	if loop != s.loopIndex {
+		previousID := s.intervalID
+		s.loopIndex = loop
+		s.loopCount = loop + 1
+		s.intervalID = uuid.New().String()
+		if s.cluster != nil {
+			s.intervalID = s.cluster.intervalID(s.contentHash, loop)
+		}
+		s.loopStartTime = s.epoch.Add(time.Duration(loop*total) * chunkDuration)
+		log.Printf("Starting loop #%d, interval: %s", s.loopCount, s.intervalID)
+		s.notify(chunkproto.EventLoop, map[string]interface{}{
+			"loop_count":           s.loopCount,
+			"interval_id":          s.intervalID,
+			"previous_interval_id": previousID,
+			"total_chunks":         total,
+			"loop_start":           s.loopStartTime.UnixMilli(),
+		})
+	}
+	
+	audio, err := s.audio.Chunk(s.currentPosition)
+	if err != nil {
+		log.Printf("Failed to read chunk %d: %v", s.currentPosition, err)
+		_, s.currentPosition = s.chunkPosition(s.nextChunk)
+		return
+	}
+	
+	if s.watermark != nil {
+		audio = s.watermark.apply(audio, s.pcmFormat, s.currentPosition, timestamp)
+	}
+	
+	// Create chunk data
+	chunk := AudioChunk{
+		Header: chunkproto.Header{
+			ProtocolVersion: chunkproto.Version,
+			IntervalID:      s.intervalID,
+			LoopCount:       s.loopCount,
+			Position:        s.currentPosition,
+			TotalChunks:     total,
+			Timestamp:       timestamp.UnixMilli(),
+			SampleRate:      s.sampleRate,
+			Channels:        s.channels,
+			SampleWidth:     s.sampleWidth,
+			AudioFormat:     s.formatInfo(),
+			EventID:         s.idBase + int64(loop*total+position),
+		},
+		Audio: hex.EncodeToString(audio),
+		raw:   audio,
+		file:  s.wavFile,
+	}
+	s.nextEventID = chunk.EventID + 1
+	
+	// Send to all listeners
+	s.history.add(chunk)
+	s.publish(streamEvent{Type: chunkproto.EventChunk, Chunk: chunk})
+	if s.rtp != nil {
+		s.rtp.send(chunk)
+	}
+	
+	// Move to next position
+	_, s.currentPosition = s.chunkPosition(s.nextChunk)
+}
+
+// chunkPosition returns the loop and position of a chunk index. A live input
+// never loops, so its single loop counts positions from the start.
+func (s *AudioServer) chunkPosition(chunk int) (int, int) {
+	total := s.audio.Len()
+	if total == 0 {
+		return 0, chunk
+	}
+	return chunk / total, chunk % total
+}
+
+// publish sends an event to all listeners
+func (s *AudioServer) publish(event streamEvent) {
 	s.listenersMux.RLock()
 	defer s.listenersMux.RUnlock()
 	
 	for ch := range s.listeners {
 		select {
-		case ch <- chunk:
+		case ch <- event:
 		default:
 			// Channel full, skip
 		}
 	}
 }
 
+// notify sends a notification to all listeners
+func (s *AudioServer) notify(event string, data map[string]interface{}) {
+	s.publish(streamEvent{Type: event, Data: data})
+}
+
 // AddListener adds a new listener channel
-func (s *AudioServer) AddListener(ch chan AudioChunk) {
+func (s *AudioServer) AddListener(ch chan streamEvent) {
 	s.listenersMux.Lock()
 	defer s.listenersMux.Unlock()
 	s.listeners[ch] = true
@@ -250,7 +330,7 @@ func (s *AudioServer) AddListener(ch chan AudioChunk) {
 }
 
 // RemoveListener removes a listener channel
-func (s *AudioServer) RemoveListener(ch chan AudioChunk) {
+func (s *AudioServer) RemoveListener(ch chan streamEvent) {
 	s.listenersMux.Lock()
 	defer s.listenersMux.Unlock()
 	delete(s.listeners, ch)
@@ -260,27 +340,101 @@ func (s *AudioServer) RemoveListener(ch chan AudioChunk) {
 
 // GetState returns current server state
 func (s *AudioServer) GetState() map[string]interface{} {
+	s.switchMux.Lock()
+	defer s.switchMux.Unlock()
+	return s.state()
+}
+
+// state describes the server; the caller holds switchMux
+func (s *AudioServer) state() map[string]interface{} {
 	elapsedMs := 0
 	if !s.loopStartTime.IsZero() {
 		elapsedMs = int(time.Since(s.loopStartTime).Milliseconds())
 	}
 	
-	return map[string]interface{}{
+	state := map[string]interface{}{
+		"protocol_version": chunkproto.Version,
 		"interval_id":      s.intervalID,
 		"loop_count":       s.loopCount,
 		"current_position": s.currentPosition,
-		"total_chunks":     len(s.audioChunks),
+		"total_chunks":     s.audio.Len(),
 		"elapsed_ms":       elapsedMs,
 		"total_duration_ms": s.totalDurationMs,
 		"chunk_duration_ms": s.chunkDurationMs,
 		"current_file":     s.wavFile,
 		"available_files":  s.availableFiles,
-		"audio_format": map[string]int{
-			"channels":        s.channels,
-			"sample_rate":     s.sampleRate,
-			"bits_per_sample": s.sampleWidth * 8,
-		},
+		"audio_format":     s.formatInfo(),
+		"source_encoding":  encodingName(s.format.encoding()),
+		"encoding":         encodingName(s.pcmFormat.encoding()),
+	}
+	
+	if gen, ok := s.audio.(*signalGenerator); ok {
+		state["generator"] = gen.config
+	}
+	if live, ok := s.audio.(*liveInput); ok {
+		state["live"] = live.info()
+	}
+	state["available_generators"] = generatorNames
+	
+	if s.watermark != nil {
+		state["watermark"] = s.watermark.info()
+	}
+	
+	state["timing"] = s.timing
+	
+	if s.cluster != nil {
+		state["sync"] = s.cluster.info(s.contentHash)
+	}
+	
+	if s.rtp != nil {
+		state["rtp"] = s.rtp.info()
+	}
+	
+	if s.format.SamplesPerBlock != 0 {
+		state["source_block_align"] = int(s.format.BlockAlign)
+		state["source_samples_per_block"] = int(s.format.SamplesPerBlock)
 	}
+	
+	if s.format.FormatTag == wavFormatExtensible {
+		state["sub_format"] = s.format.subFormatString()
+		state["channel_layout"] = s.format.speakers()
+	}
+	
+	return state
+}
+
+// Channels returns the channel count of the current audio
+func (s *AudioServer) Channels() int {
+	s.switchMux.Lock()
+	defer s.switchMux.Unlock()
+	return s.channels
+}
+
+// formatInfo describes how to decode each frame of the current audio
+func (s *AudioServer) formatInfo() map[string]int {
+	return map[string]int{
+		"channels":        s.channels,
+		"sample_rate":     s.sampleRate,
+		"bits_per_sample": s.sampleWidth * 8,
+		"format_tag":      int(s.pcmFormat.encoding()),
+		"wav_format_tag":  int(s.format.FormatTag),
+		"block_align":     int(s.pcmFormat.BlockAlign),
+		"valid_bits":      int(s.pcmFormat.ValidBits),
+		"channel_mask":    int(s.format.ChannelMask),
+	}
+}
+
+// LoadLive replaces the file with a live PCM input
+func (s *AudioServer) LoadLive(cfg liveInputConfig) error {
+	live, err := newLiveInput(cfg, s.chunkDurationMs)
+	if err != nil {
+		return err
+	}
+	
+	s.wavFile = live.name()
+	s.setAudio(live, live.format, live.format)
+	s.contentHash = ""
+	return nil
 }
 
 // SwitchAudio switches to a different audio file
@@ -288,6 +442,10 @@ func (s *AudioServer) SwitchAudio(filename string) error {
 	s.switchMux.Lock()
 	defer s.switchMux.Unlock()
 	
+	if _, ok := s.audio.(*liveInput); ok {
+		return errLiveSwitch
+	}
+	
 	// Check if file is in available list
 	found := false
 	for _, f := range s.availableFiles {
@@ -302,22 +460,64 @@ func (s *AudioServer) SwitchAudio(filename string) error {
 	
 	// Load new audio file
 	oldFile := s.wavFile
-	s.wavFile = "/app/" + filename
+	s.wavFile = filepath.Join(s.audioDir, filename)
 	if err := s.LoadAudio(); err != nil {
 		s.wavFile = oldFile // Restore on error
 		return err
 	}
 	
-	// Reset playback state
-	s.currentPosition = 0
-	s.loopCount = 0
-	s.intervalID = uuid.New().String()
-	s.loopStartTime = time.Now()
+	s.resetPlayback()
+	s.notify(chunkproto.EventSwitch, s.state())
 	
 	log.Printf("Switched to audio file: %s", filename)
 	return nil
 }
 
+// SwitchGenerator switches to a synthetic test signal
+func (s *AudioServer) SwitchGenerator(cfg generatorConfig) error {
+	s.switchMux.Lock()
+	defer s.switchMux.Unlock()
+	
+	if _, ok := s.audio.(*liveInput); ok {
+		return errLiveSwitch
+	}
+	
+	gen, err := newSignalGenerator(cfg, s.chunkDurationMs)
+	if err != nil {
+		return err
+	}
+	
+	s.wavFile = gen.name()
+	s.setAudio(gen, gen.format, gen.format)
+	if s.cluster != nil {
+		s.contentHash = hashGenerator(gen.config)
+	}
+	s.resetPlayback()
+	s.notify(chunkproto.EventSwitch, s.state())
+	
+	log.Printf("Switched to generator: %+v", gen.config)
+	return nil
+}
+
+// resetPlayback restarts the loop after a switch, anchoring it to the current time
+func (s *AudioServer) resetPlayback() {
+	s.epoch = time.Now()
+	s.nextChunk = 0
+	s.idBase = s.nextEventID
+	if s.cluster != nil {
+		// Every replica plays the same chunk at the same instant, and with
+		// the same event ID since the chunk index only grows
+		s.epoch = s.cluster.epoch
+		s.nextChunk = s.cluster.chunkIndex(time.Now(), time.Duration(s.chunkDurationMs)*time.Millisecond)
+		s.idBase = 0
+	}
+	s.loopIndex = -1
+	s.currentPosition = 0
+	s.loopCount = 0
+	s.intervalID = uuid.New().String()
+	s.loopStartTime = s.epoch
+}
+
 var audioServer *AudioServer
 
 // handleIndex serves the web player interface
@@ -349,15 +549,38 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         <div class="file-selector">
             <label for="audioFile">Select Audio File:</label>
             <select id="audioFile" onchange="switchAudio()">
-                <option value="audio.wav">audio.wav</option>
-                <option value="audio-spam-1.wav">audio-spam-1.wav</option>
-                <option value="audio-spam-2.wav">audio-spam-2.wav</option>
-                <option value="audio-spam-3.wav">audio-spam-3.wav</option>
+            </select>
+            <label for="generator">Test Signal:</label>
+            <select id="generator">
+                <option value="sine">Sine</option>
+                <option value="chirp">Log chirp sweep</option>
+                <option value="white">White noise</option>
+                <option value="pink">Pink noise</option>
+                <option value="silence">Silence</option>
+                <option value="click">Click train</option>
+            </select>
+            <div>
+                <input type="number" id="genFreq" value="1000" min="1"> Hz
+                <input type="number" id="genAmplitude" value="-6" max="0" step="1"> dBFS
+                <button onclick="switchGenerator()">Generate</button>
+            </div>
+            <label for="codec">Stream Codec:</label>
+            <select id="codec">
+                <option value="pcm">Linear PCM</option>
+                <option value="ulaw">G.711 mu-law</option>
+                <option value="alaw">G.711 A-law</option>
+            </select>
+            <label for="transport">Transport:</label>
+            <select id="transport">
+                <option value="sse">Server-Sent Events (hex JSON)</option>
+                <option value="sse-base64">Server-Sent Events (base64 JSON)</option>
+                <option value="ws">WebSocket (binary)</option>
             </select>
         </div>
         <div>
             <button class="play" onclick="startStream()">Play Stream</button>
             <button class="stop" onclick="stopStream()">Stop</button>
+            <button id="pause" onclick="togglePause()">Pause</button>
         </div>
         <div id="error"></div>
         <div id="status">
@@ -372,52 +595,53 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
     
     <script>
         let eventSource = null;
+        let socket = null;
+        let paused = false;
         let audioContext = null;
         let nextPlayTime = 0;
         let audioFormat = null;
         let isPlaying = false;
         
         async function startStream() {
-            if (eventSource) return;
+            if (eventSource || socket) return;
             
             try {
                 audioContext = new (window.AudioContext || window.webkitAudioContext)();
                 nextPlayTime = audioContext.currentTime + 0.1;
                 isPlaying = true;
                 
-                eventSource = new EventSource('/stream');
+                const codec = document.getElementById('codec').value;
                 document.getElementById('state').textContent = 'Connecting...';
                 document.getElementById('error').textContent = '';
                 
-                eventSource.onmessage = (event) => {
-                    const data = JSON.parse(event.data);
-                    
-                    if (!audioFormat && data.audio_format) {
-                        audioFormat = data.audio_format;
-                        document.getElementById('format').textContent = 
-                            audioFormat.sample_rate + 'Hz, ' + audioFormat.bits_per_sample + '-bit, ' + audioFormat.channels + 'ch';
-                    }
-                    
-                    document.getElementById('state').textContent = 'Connected';
-                    document.getElementById('loop').textContent = data.loop_count || '-';
-                    document.getElementById('position').textContent = 
-                        data.position !== undefined ? data.position + '/' + data.total_chunks : '-';
-                    document.getElementById('interval').textContent = 
-                        data.interval_id ? data.interval_id.substring(0, 8) + '...' : '-';
-                    
-                    // Update current file if present
-                    if (data.current_file) {
-                        const filename = data.current_file.split('/').pop();
-                        document.getElementById('currentFile').textContent = filename;
-                        document.getElementById('audioFile').value = filename;
-                    }
-                    
-                    if (data.audio && isPlaying) {
-                        playChunk(data);
-                    }
-                };
+                if (document.getElementById('transport').value === 'ws') {
+                    startWebSocket(codec);
+                    return;
+                }
+                
+                const encoding = document.getElementById('transport').value === 'sse-base64' ? 'base64' : 'hex';
+                eventSource = new EventSource('/stream?codec=' + codec + '&encoding=' + encoding);
+                eventSource.addEventListener('chunk', (event) => {
+                    handleMessage(JSON.parse(event.data));
+                });
+                eventSource.addEventListener('state', (event) => {
+                    handleMessage(JSON.parse(event.data));
+                });
+                eventSource.addEventListener('switch', (event) => {
+                    audioFormat = null;
+                    handleMessage(JSON.parse(event.data));
+                });
+                eventSource.addEventListener('loop', (event) => {
+                    const loop = JSON.parse(event.data);
+                    document.getElementById('loop').textContent = loop.loop_count;
+                });
                 
+                // Server error events and connection failures share the error handler
                 eventSource.onerror = (e) => {
+                    if (e.data) {
+                        document.getElementById('error').textContent = 'Error: ' + JSON.parse(e.data).error;
+                        return;
+                    }
                     document.getElementById('state').textContent = 'Error';
                     document.getElementById('error').textContent = 'Connection lost. Click Play to reconnect.';
                     stopStream();
@@ -428,24 +652,117 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
+        function startWebSocket(codec) {
+            const scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+            socket = new WebSocket(scheme + location.host + '/ws?codec=' + codec);
+            socket.binaryType = 'arraybuffer';
+            
+            socket.onmessage = (event) => {
+                if (typeof event.data === 'string') {
+                    const msg = JSON.parse(event.data);
+                    if (msg.type === 'error') {
+                        document.getElementById('error').textContent = 'Error: ' + msg.error;
+                    } else if (msg.type === 'state') {
+                        audioFormat = null;
+                        handleMessage(msg);
+                    } else if (msg.type === 'loop') {
+                        document.getElementById('loop').textContent = msg.loop_count;
+                    }
+                    return;
+                }
+                handleMessage(parseFrame(event.data));
+            };
+            
+            socket.onclose = () => {
+                if (socket) {
+                    document.getElementById('state').textContent = 'Error';
+                    document.getElementById('error').textContent = 'Connection lost. Click Play to reconnect.';
+                    stopStream();
+                }
+            };
+        }
+        
+        // parseFrame unpacks a binary chunk frame into the same shape as an SSE chunk
+        function parseFrame(buffer) {
+            const view = new DataView(buffer);
+            const headerSize = view.getUint8(1);
+            const id = Array.from(new Uint8Array(buffer, 36, 16), b => b.toString(16).padStart(2, '0')).join('');
+            const channels = view.getUint16(28, true);
+            const bitsPerSample = view.getUint16(30, true);
+            return {
+                interval_id: id.substring(0, 8) + '-' + id.substring(8, 12) + '-' + id.substring(12, 16) + '-' + id.substring(16, 20) + '-' + id.substring(20),
+                loop_count: view.getUint32(4, true),
+                position: view.getUint32(8, true),
+                total_chunks: view.getUint32(12, true),
+                timestamp: Number(view.getBigInt64(16, true)),
+                sample_rate: view.getUint32(24, true),
+                channels: channels,
+                sample_width: bitsPerSample / 8,
+                audio_format: {
+                    channels: channels,
+                    sample_rate: view.getUint32(24, true),
+                    bits_per_sample: bitsPerSample,
+                    format_tag: view.getUint16(2, true),
+                    block_align: view.getUint16(32, true),
+                    valid_bits: view.getUint16(34, true)
+                },
+                bytes: new Uint8Array(buffer, headerSize)
+            };
+        }
+        
+        function togglePause() {
+            paused = !paused;
+            document.getElementById('pause').textContent = paused ? 'Resume' : 'Pause';
+            if (socket && socket.readyState === WebSocket.OPEN) {
+                socket.send(JSON.stringify({ type: paused ? 'pause' : 'resume' }));
+            }
+        }
+        
+        function handleMessage(data) {
+            if (!audioFormat && data.audio_format) {
+                audioFormat = data.audio_format;
+                document.getElementById('format').textContent = 
+                    audioFormat.sample_rate + 'Hz, ' + audioFormat.bits_per_sample + '-bit, ' + audioFormat.channels + 'ch';
+            }
+            
+            document.getElementById('state').textContent = 'Connected';
+            document.getElementById('loop').textContent = data.loop_count || '-';
+            document.getElementById('position').textContent = 
+                data.position === undefined ? '-' :
+                data.total_chunks ? data.position + '/' + data.total_chunks : data.position + ' (live)';
+            document.getElementById('interval').textContent = 
+                data.interval_id ? data.interval_id.substring(0, 8) + '...' : '-';
+            
+            // Update current file if present
+            if (data.current_file) {
+                const filename = data.current_file.split('/').pop();
+                document.getElementById('currentFile').textContent = filename;
+                document.getElementById('audioFile').value = filename;
+            }
+            
+            if ((data.audio || data.bytes) && isPlaying && !paused) {
+                playChunk(data);
+            }
+        }
+        
         function playChunk(data) {
             try {
-                const bytes = new Uint8Array(data.audio.match(/.{1,2}/g).map(byte => parseInt(byte, 16)));
+                const bytes = data.bytes || decodeAudio(data);
                 const sampleRate = data.sample_rate || 44100;
                 const channels = data.channels || 1;
                 const sampleWidth = data.sample_width || 2;
-                const samplesPerChannel = bytes.length / (channels * sampleWidth);
+                const format = data.audio_format || {};
+                const formatTag = format.format_tag || 1;
+                const blockAlign = format.block_align || channels * sampleWidth;
+                const samplesPerChannel = Math.floor(bytes.length / blockAlign);
                 
                 const buffer = audioContext.createBuffer(channels, samplesPerChannel, sampleRate);
+                const view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
                 
-                if (sampleWidth === 2) {
-                    for (let channel = 0; channel < channels; channel++) {
-                        const channelData = buffer.getChannelData(channel);
-                        for (let i = 0; i < samplesPerChannel; i++) {
-                            const byteIndex = (i * channels + channel) * 2;
-                            const int16 = (bytes[byteIndex + 1] << 8) | bytes[byteIndex];
-                            channelData[i] = (int16 > 32767 ? int16 - 65536 : int16) / 32768.0;
-                        }
+                for (let channel = 0; channel < channels; channel++) {
+                    const channelData = buffer.getChannelData(channel);
+                    for (let i = 0; i < samplesPerChannel; i++) {
+                        channelData[i] = readSample(view, i * blockAlign + channel * sampleWidth, sampleWidth, formatTag);
                     }
                 }
                 
@@ -466,12 +783,68 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
+        function decodeAudio(data) {
+            if (data.audio_encoding === 'base64') {
+                return Uint8Array.from(atob(data.audio), c => c.charCodeAt(0));
+            }
+            return new Uint8Array(data.audio.match(/.{1,2}/g).map(byte => parseInt(byte, 16)));
+        }
+        
+        function readSample(view, offset, sampleWidth, formatTag) {
+            if (formatTag === 3) {
+                return view.getFloat32(offset, true);
+            }
+            if (formatTag === 6) {
+                return alawToFloat(view.getUint8(offset));
+            }
+            if (formatTag === 7) {
+                return ulawToFloat(view.getUint8(offset));
+            }
+            switch (sampleWidth) {
+                case 1:
+                    return (view.getUint8(offset) - 128) / 128.0;
+                case 3: {
+                    const int24 = (view.getInt8(offset + 2) << 16) | (view.getUint8(offset + 1) << 8) | view.getUint8(offset);
+                    return int24 / 8388608.0;
+                }
+                case 4:
+                    return view.getInt32(offset, true) / 2147483648.0;
+                default:
+                    return view.getInt16(offset, true) / 32768.0;
+            }
+        }
+        
+        function ulawToFloat(u) {
+            u = ~u & 0xFF;
+            let t = ((u & 0x0F) << 3) + 0x84;
+            t <<= (u & 0x70) >> 4;
+            return ((u & 0x80) ? (0x84 - t) : (t - 0x84)) / 32768.0;
+        }
+        
+        function alawToFloat(a) {
+            a ^= 0x55;
+            let t = (a & 0x0F) << 4;
+            const seg = (a & 0x70) >> 4;
+            if (seg === 0) {
+                t += 8;
+            } else {
+                t += 0x108;
+                if (seg > 1) t <<= seg - 1;
+            }
+            return ((a & 0x80) ? t : -t) / 32768.0;
+        }
+        
         function stopStream() {
             isPlaying = false;
             if (eventSource) {
                 eventSource.close();
                 eventSource = null;
             }
+            if (socket) {
+                const s = socket;
+                socket = null;
+                s.close();
+            }
             if (audioContext) {
                 audioContext.close();
                 audioContext = null;
@@ -484,6 +857,11 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             const select = document.getElementById('audioFile');
             const file = select.value;
             
+            if (socket && socket.readyState === WebSocket.OPEN) {
+                socket.send(JSON.stringify({ type: 'switch', file: file }));
+                return;
+            }
+            
             try {
                 const response = await fetch('/switch', {
                     method: 'POST',
@@ -508,12 +886,56 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
+        async function switchGenerator() {
+            const body = {
+                generator: document.getElementById('generator').value,
+                freq: parseFloat(document.getElementById('genFreq').value),
+                amplitude: parseFloat(document.getElementById('genAmplitude').value)
+            };
+            
+            if (socket && socket.readyState === WebSocket.OPEN) {
+                socket.send(JSON.stringify(Object.assign({ type: 'switch' }, body)));
+                return;
+            }
+            
+            try {
+                const response = await fetch('/switch', {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json',
+                    },
+                    body: JSON.stringify(body)
+                });
+                
+                if (!response.ok) {
+                    throw new Error(await response.text());
+                }
+                
+                document.getElementById('currentFile').textContent = 'generator:' + body.generator;
+                document.getElementById('error').textContent = '';
+            } catch (e) {
+                document.getElementById('error').textContent = 'Error switching generator: ' + e.message;
+                console.error('Generator error:', e);
+            }
+        }
+        
         // Load initial status on page load
         window.addEventListener('load', async () => {
             try {
                 const response = await fetch('/status');
                 const data = await response.json();
                 
+                if (data.available_files) {
+                    const select = document.getElementById('audioFile');
+                    select.innerHTML = '';
+                    for (const f of data.available_files) {
+                        const option = document.createElement('option');
+                        option.value = f;
+                        option.textContent = f;
+                        select.appendChild(option);
+                    }
+                }
+                
                 if (data.current_file) {
                     const filename = data.current_file.split('/').pop();
                     document.getElementById('audioFile').value = filename;
@@ -533,30 +955,148 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 
 // handleStream handles SSE streaming
 func handleStream(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/event-stream")
+	// Optional per-client G.711 or Opus compression
+	codec, err := parseCodec(r.URL.Query().Get("codec"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var encoder *opusStream
+	if codec == wavFormatOpus {
+		opts, err := opus.ParseOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if encoder, err = newOpusStream(opts, audioServer.Channels()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer encoder.Close()
+	}
+	
+	// Payload encoding: hex or base64 JSON over SSE, or binary records
+	encoding, err := chunkproto.ParseEncoding(r.URL.Query().Get("encoding"), r.Header.Get("Accept"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	if encoding == chunkproto.EncodingBinary {
+		w.Header().Set("Content-Type", chunkproto.StreamContentType)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	
-	ch := make(chan AudioChunk, 10)
+	ch := make(chan streamEvent, audioServer.queueDepth)
 	audioServer.AddListener(ch)
 	defer audioServer.RemoveListener(ch)
 	
+	// A reconnecting client gets the retained chunks it missed. The listener
+	// is registered first, so live chunks that were also replayed are skipped.
+	var replay []AudioChunk
+	var missed int64
+	replayedThrough := int64(-1)
+	lastID, resuming := chunkproto.LastEventID(r)
+	if resuming {
+		replay, missed = audioServer.history.since(lastID)
+		if len(replay) > 0 {
+			replayedThrough = replay[len(replay)-1].EventID
+		}
+		log.Printf("Client resuming after event %d: replaying %d chunks, %d no longer retained", lastID, len(replay), missed)
+	}
+	
 	// Send initial state
 	state := audioServer.GetState()
-	if data, err := json.Marshal(state); err == nil {
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		w.(http.Flusher).Flush()
+	if codec != 0 {
+		state["codec"] = encodingName(codec)
+	}
+	if encoder != nil {
+		state["codec_format"] = encoder.format()
+	}
+	state["audio_encoding"] = encoding
+	if resuming {
+		state["resume"] = map[string]interface{}{
+			"last_event_id": lastID,
+			"replayed":      len(replay),
+			"missed":        missed,
+		}
+	}
+	if err := chunkproto.WriteEvent(w, encoding, chunkproto.EventState, state); err != nil {
+		return
 	}
+	w.(http.Flusher).Flush()
 	
-	// Stream chunks
+	// send writes one chunk event; its ID lets EventSource resume
+	lastSent := int64(-1)
+	if resuming {
+		lastSent = lastID
+	}
+	send := func(chunk AudioChunk) error {
+		var err error
+		if encoder != nil {
+			chunk, err = encoder.encode(chunk)
+		} else {
+			chunk, err = chunk.withCodec(codec)
+		}
+		if err != nil {
+			log.Printf("Failed to encode chunk: %v", err)
+			return chunkproto.WriteEvent(w, encoding, chunkproto.EventError, map[string]interface{}{
+				"error":    err.Error(),
+				"event_id": chunk.EventID,
+			})
+		}
+		lastSent = chunk.EventID
+		if encoding == chunkproto.EncodingBinary {
+			if err := chunkproto.WriteRecord(w, chunkproto.RecordChunk, chunk.binaryFrame()); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+			return nil
+		}
+		if data, err := json.Marshal(chunk.withEncoding(encoding)); err == nil {
+			if _, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", chunkproto.EventChunk, chunk.EventID, data); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+		}
+		return nil
+	}
+	
+	for _, chunk := range replay {
+		if err := send(chunk); err != nil {
+			return
+		}
+	}
+	
+	// Stream chunks and notifications in the order they happened
+	heartbeat := time.NewTicker(chunkproto.HeartbeatInterval)
+	defer heartbeat.Stop()
 	for {
 		select {
-		case chunk := <-ch:
-			if data, err := json.Marshal(chunk); err == nil {
-				fmt.Fprintf(w, "data: %s\n\n", data)
+		case event := <-ch:
+			var err error
+			switch {
+			case event.Type != chunkproto.EventChunk:
+				err = chunkproto.WriteEvent(w, encoding, event.Type, event.Data)
 				w.(http.Flusher).Flush()
+			case event.Chunk.EventID > replayedThrough:
+				err = send(event.Chunk)
 			}
+			if err != nil {
+				return
+			}
+		case now := <-heartbeat.C:
+			if err := chunkproto.WriteEvent(w, encoding, chunkproto.EventHeartbeat, map[string]interface{}{
+				"timestamp":     now.UnixMilli(),
+				"last_event_id": lastSent,
+			}); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
 		case <-r.Context().Done():
 			return
 		}
@@ -574,6 +1114,33 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(state)
 }
 
+// switchRequest selects either a file or generator parameters
+type switchRequest struct {
+	File string `json:"file"`
+	generatorConfig
+}
+
+// applySwitch performs a switch request and describes the result
+func (s *AudioServer) applySwitch(req switchRequest) (map[string]string, error) {
+	if req.Generator != "" {
+		if err := s.SwitchGenerator(req.generatorConfig); err != nil {
+			return nil, err
+		}
+		return map[string]string{
+			"status":    "switched",
+			"generator": req.Generator,
+		}, nil
+	}
+	
+	if err := s.SwitchAudio(req.File); err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"status": "switched",
+		"file":   req.File,
+	}, nil
+}
+
 // handleSwitch handles audio file switching
 func handleSwitch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -581,33 +1148,270 @@ func handleSwitch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var req struct {
-		File string `json:"file"`
+	var req switchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	result, err := audioServer.applySwitch(req)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	
-	if err := audioServer.SwitchAudio(req.File); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// wsControl is a control message sent by a WebSocket client
+type wsControl struct {
+	Type string `json:"type"` // switch, pause, resume or status
+	switchRequest
+}
+
+// handleWebSocket streams chunks as binary WebSocket messages, each a
+// binaryFrame. State is sent as JSON text messages on connect, after a
+// switch and whenever the audio format changes, and loop messages mark loop
+// boundaries; clients may send wsControl messages on the same socket.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	codec, err := parseCodec(r.URL.Query().Get("codec"))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if codec == wavFormatOpus {
+		http.Error(w, "opus is only available on /stream", http.StatusBadRequest)
+		return
+	}
+	
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	
+	ch := make(chan streamEvent, audioServer.queueDepth)
+	audioServer.AddListener(ch)
+	defer audioServer.RemoveListener(ch)
+	
+	sendJSON := func(msg map[string]interface{}) error {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(wsOpText, data)
+	}
+	sendState := func() error {
+		state := audioServer.GetState()
+		state["type"] = "state"
+		if codec != 0 {
+			state["codec"] = encodingName(codec)
+		}
+		return sendJSON(state)
+	}
+	if err := sendState(); err != nil {
+		return
+	}
+	
+	// Control messages are read on their own goroutine
+	var paused atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			opcode, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if opcode != wsOpText {
+				continue
+			}
+			
+			var msg wsControl
+			if err := json.Unmarshal(data, &msg); err != nil {
+				sendJSON(map[string]interface{}{"type": "error", "error": err.Error()})
+				continue
+			}
+			
+			switch msg.Type {
+			case "switch":
+				result, err := audioServer.applySwitch(msg.switchRequest)
+				if err != nil {
+					sendJSON(map[string]interface{}{"type": "error", "error": err.Error()})
+					continue
+				}
+				reply := map[string]interface{}{"type": "switched"}
+				for k, v := range result {
+					reply[k] = v
+				}
+				sendJSON(reply)
+			case "pause":
+				paused.Store(true)
+				sendJSON(map[string]interface{}{"type": "paused"})
+			case "resume":
+				paused.Store(false)
+				sendJSON(map[string]interface{}{"type": "resumed"})
+			case "status":
+				sendState()
+			default:
+				sendJSON(map[string]interface{}{"type": "error", "error": fmt.Sprintf("unknown message type: %q", msg.Type)})
+			}
+		}
+	}()
+	
+	// Stream chunks; every switch, from any client, is followed by the new state
+	var lastFormat map[string]int
+	for {
+		select {
+		case event := <-ch:
+			switch event.Type {
+			case chunkproto.EventSwitch:
+				lastFormat = nil
+				if err := sendState(); err != nil {
+					return
+				}
+				continue
+			case chunkproto.EventLoop:
+				msg := map[string]interface{}{"type": chunkproto.EventLoop}
+				for k, v := range event.Data {
+					msg[k] = v
+				}
+				if err := sendJSON(msg); err != nil {
+					return
+				}
+				continue
+			case chunkproto.EventChunk:
+			default:
+				continue
+			}
+			if paused.Load() {
+				continue
+			}
+			chunk, err := event.Chunk.withCodec(codec)
+			if err != nil {
+				log.Printf("Failed to encode chunk: %v", err)
+				continue
+			}
+			if lastFormat != nil && !sameFormat(lastFormat, chunk.AudioFormat) {
+				if err := sendState(); err != nil {
+					return
+				}
+			}
+			lastFormat = chunk.AudioFormat
+			if err := conn.WriteMessage(wsOpBinary, chunk.binaryFrame()); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// sameFormat reports whether two audio format descriptions are identical
+func sameFormat(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// handleWatermarkDecode finds timing watermarks in an uploaded WAV recording.
+// An optional start query parameter gives the wall clock time, in Unix
+// milliseconds, of the first frame so end-to-end latency can be reported.
+func handleWatermarkDecode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var start int64
+	if v := r.URL.Query().Get("start"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		start = parsed
+	}
+	
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	format, dataOffset, dataSize, err := readWAVHeader(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end := dataOffset + dataSize; end < int64(len(body)) {
+		body = body[:end]
+	}
+	pcmFormat := format.decodedFormat()
+	samples := pcmToMono(decodeAudio(body[dataOffset:], format), pcmFormat)
+	
+	marks := DecodeWatermarks(samples, int(pcmFormat.SampleRate))
+	if start != 0 {
+		for i := range marks {
+			latency := float64(start-marks[i].Timestamp) + marks[i].OffsetMs
+			marks[i].LatencyMs = &latency
+		}
+	}
+	if marks == nil {
+		marks = []Watermark{}
+	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "switched",
-		"file":   req.File,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sample_rate": int(pcmFormat.SampleRate),
+		"duration_ms": len(samples) * 1000 / int(pcmFormat.SampleRate),
+		"watermarks":  marks,
 	})
 }
 
 func main() {
+	// Flags, environment and optional config file
+	cfg, err := loadSourceConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	
 	// Create audio server
-	audioServer = NewAudioServer("/app/audio.wav", 100) // 100ms chunks
+	audioServer = NewAudioServer(cfg)
 	
-	// Load audio
-	if err := audioServer.LoadAudio(); err != nil {
+	// Optional timing watermark
+	if cfg.Watermark.Enabled {
+		audioServer.watermark = newWatermarker(cfg.Watermark)
+	}
+	
+	// Optional cluster-wide playback position
+	if !cfg.SyncEpoch.IsZero() {
+		audioServer.cluster = &clusterSync{epoch: cfg.SyncEpoch}
+	}
+	
+	// Optional RTP output
+	if cfg.RTP.Dest != "" {
+		rtp, err := newRTPSender(cfg.RTP, time.Duration(cfg.ChunkDurationMs)*time.Millisecond)
+		if err != nil {
+			log.Fatalf("Failed to start RTP output: %v", err)
+		}
+		audioServer.rtp = rtp
+	}
+	
+	// Optional live input instead of the looping file
+	if cfg.Live.Input != "" {
+		if err := audioServer.LoadLive(cfg.Live); err != nil {
+			log.Fatalf("Failed to open live input: %v", err)
+		}
+	} else if err := audioServer.LoadAudio(); err != nil {
 		log.Fatalf("Failed to load audio: %v", err)
 	}
 	
@@ -619,10 +1423,14 @@ func main() {
 	http.HandleFunc("/stream", handleStream)
 	http.HandleFunc("/status", handleStatus)
 	http.HandleFunc("/switch", handleSwitch)
+	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("/listen", handleListen)
+	http.HandleFunc("/rtp.sdp", handleSDP)
+	http.HandleFunc("/watermark/decode", handleWatermarkDecode)
 	
 	// Start HTTP server
-	log.Println("Audio source server started on :8000")
-	if err := http.ListenAndServe(":8000", nil); err != nil {
+	log.Printf("Audio source server started on %s", cfg.Listen)
+	if err := http.ListenAndServe(cfg.Listen, nil); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
\ No newline at end of file
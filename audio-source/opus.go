@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"audio-common/opus"
+)
+
+// wavFormatOpus tags Opus chunks, whose payload is described in the shared
+// opus package
+const wavFormatOpus = opus.FormatTag
+
+// opusStream encodes one listener's chunks. Audio is converted to 48 kHz
+// mono or stereo, and samples that do not fill a frame wait for the next
+// chunk, so a chunk holds however many frames completed during it.
+type opusStream struct {
+	opts      opus.Options
+	channels  int
+	enc       opus.Encoder
+	converter *pcmConverter
+	pending   []int16
+	packet    []byte
+}
+
+// newOpusStream creates an encoder for audio with the given channel count;
+// anything beyond stereo is downmixed
+func newOpusStream(opts opus.Options, channels int) (*opusStream, error) {
+	if channels > 2 {
+		channels = 2
+	}
+	if channels < 1 {
+		channels = 1
+	}
+	enc, err := opus.NewEncoder(channels, opts.Bitrate)
+	if err != nil {
+		return nil, err
+	}
+	return &opusStream{
+		opts:      opts,
+		channels:  channels,
+		enc:       enc,
+		converter: &pcmConverter{out: listenFormat{SampleRate: opus.SampleRate, Channels: channels, Bits: 16}},
+		packet:    make([]byte, opus.MaxPacket),
+	}, nil
+}
+
+// format describes the stream's chunks. pre_skip is the encoder delay to
+// drop after decoding, in samples per channel.
+func (s *opusStream) format() map[string]int {
+	return map[string]int{
+		"format_tag":      wavFormatOpus,
+		"sample_rate":     opus.SampleRate,
+		"channels":        s.channels,
+		"bits_per_sample": 0,
+		"block_align":     0,
+		"valid_bits":      0,
+		"bitrate":         s.opts.Bitrate,
+		"frame_size":      s.opts.FrameSize,
+		"pre_skip":        s.enc.Lookahead(),
+	}
+}
+
+// encode returns a copy of chunk whose audio is replaced by Opus packets
+func (s *opusStream) encode(c AudioChunk) (AudioChunk, error) {
+	raw := c.raw
+	if raw == nil {
+		decoded, err := hex.DecodeString(c.Audio)
+		if err != nil {
+			return c, fmt.Errorf("failed to decode chunk audio: %w", err)
+		}
+		raw = decoded
+	}
+
+	pcm := s.converter.convert(raw, c.AudioFormat)
+	for i := 0; i+1 < len(pcm); i += 2 {
+		s.pending = append(s.pending, int16(binary.LittleEndian.Uint16(pcm[i:])))
+	}
+
+	var payload []byte
+	frame := s.opts.FrameSize * s.channels
+	used := 0
+	for ; len(s.pending)-used >= frame; used += frame {
+		n, err := s.enc.Encode(s.pending[used:used+frame], s.packet)
+		if err != nil {
+			return c, fmt.Errorf("failed to encode opus frame: %w", err)
+		}
+		payload = opus.AppendPacket(payload, s.packet[:n])
+	}
+	s.pending = append(s.pending[:0], s.pending[used:]...)
+
+	c.raw = payload
+	c.Audio = hex.EncodeToString(payload)
+	c.SampleRate = opus.SampleRate
+	c.Channels = s.channels
+	c.SampleWidth = 0
+	c.AudioFormat = s.format()
+	return c, nil
+}
+
+// Close releases the encoder
+func (s *opusStream) Close() {
+	s.enc.Close()
+}
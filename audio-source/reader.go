@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// readAheadChunks is how many chunks are pulled from disk per read
+const readAheadChunks = 10
+
+// chunkSource supplies fixed-duration chunks of linear PCM by position
+type chunkSource interface {
+	// Len returns the number of chunks in one loop
+	Len() int
+	// Chunk returns the audio for a position in [0, Len())
+	Chunk(position int) ([]byte, error)
+	// Close releases any resources held by the source
+	Close() error
+}
+
+// wavChunkReader reads chunks from a WAV data chunk on demand, decoding
+// compressed formats as it goes. Consecutive chunks are read ahead in batches
+// so the audio loop rarely touches the disk.
+type wavChunkReader struct {
+	file           *os.File
+	dataOffset     int64
+	dataSize       int64
+	format         wavFormat
+	pcmFormat      wavFormat
+	framesPerChunk int
+	totalFrames    int
+	numChunks      int
+	silence        byte
+
+	mu         sync.Mutex
+	cacheStart int
+	cache      [][]byte
+}
+
+// newWAVChunkReader opens path and prepares to read the data chunk found at
+// dataOffset in chunks of chunkDurationMs
+func newWAVChunkReader(path string, dataOffset, dataSize int64, format wavFormat, chunkDurationMs int) (*wavChunkReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAV file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat WAV file: %w", err)
+	}
+	// Streamed WAVs often carry a placeholder data size
+	if remaining := info.Size() - dataOffset; dataSize > remaining {
+		dataSize = remaining
+	}
+
+	pcmFormat := format.decodedFormat()
+	framesPerChunk := int(pcmFormat.SampleRate) * chunkDurationMs / 1000
+	if framesPerChunk < 1 {
+		framesPerChunk = 1
+	}
+
+	r := &wavChunkReader{
+		file:           file,
+		dataOffset:     dataOffset,
+		dataSize:       dataSize,
+		format:         format,
+		pcmFormat:      pcmFormat,
+		framesPerChunk: framesPerChunk,
+		cacheStart:     -1,
+	}
+	r.totalFrames = r.countFrames()
+	r.numChunks = (r.totalFrames + framesPerChunk - 1) / framesPerChunk
+
+	// Unsigned 8-bit PCM is centred on 0x80
+	if pcmFormat.encoding() == wavFormatPCM && pcmFormat.BitsPerSample == 8 {
+		r.silence = 0x80
+	}
+
+	return r, nil
+}
+
+// countFrames returns the number of whole frames in the data chunk
+func (r *wavChunkReader) countFrames() int {
+	blockAlign := int64(r.format.BlockAlign)
+	if r.format.encoding() != wavFormatIMAADPCM {
+		return int(r.dataSize / blockAlign)
+	}
+
+	// A truncated final ADPCM block still holds its header sample plus
+	// eight samples per complete group
+	channels := int64(r.format.NumChannels)
+	frames := int(r.dataSize/blockAlign) * imaSamplesPerBlock(int(blockAlign), int(channels))
+	if rem := r.dataSize % blockAlign; rem >= 4*channels {
+		frames += 1 + int((rem-4*channels)/(4*channels))*8
+	}
+	return frames
+}
+
+// Len returns the number of chunks in one loop
+func (r *wavChunkReader) Len() int {
+	return r.numChunks
+}
+
+// Chunk returns the audio for a position, reading ahead on a cache miss
+func (r *wavChunkReader) Chunk(position int) ([]byte, error) {
+	if position < 0 || position >= r.numChunks {
+		return nil, fmt.Errorf("chunk %d out of range (0-%d)", position, r.numChunks-1)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if position >= r.cacheStart && position < r.cacheStart+len(r.cache) {
+		return r.cache[position-r.cacheStart], nil
+	}
+
+	count := readAheadChunks
+	if position+count > r.numChunks {
+		count = r.numChunks - position
+	}
+
+	pcm, err := r.readFrames(position*r.framesPerChunk, count*r.framesPerChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := r.framesPerChunk * int(r.pcmFormat.BlockAlign)
+	r.cache = make([][]byte, count)
+	for i := range r.cache {
+		start := i * chunkSize
+		if start+chunkSize <= len(pcm) {
+			r.cache[i] = pcm[start : start+chunkSize]
+			continue
+		}
+
+		// Pad the last chunk with silence
+		padded := make([]byte, chunkSize)
+		n := 0
+		if start < len(pcm) {
+			n = copy(padded, pcm[start:])
+		}
+		for j := n; j < chunkSize; j++ {
+			padded[j] = r.silence
+		}
+		r.cache[i] = padded
+	}
+	r.cacheStart = position
+
+	return r.cache[0], nil
+}
+
+// readFrames reads and decodes up to count frames starting at frame start
+func (r *wavChunkReader) readFrames(start, count int) ([]byte, error) {
+	if start+count > r.totalFrames {
+		count = r.totalFrames - start
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	blockAlign := int(r.format.BlockAlign)
+	if r.format.encoding() != wavFormatIMAADPCM {
+		raw, err := r.readData(int64(start*blockAlign), int64(count*blockAlign))
+		if err != nil {
+			return nil, err
+		}
+		return decodeAudio(raw, r.format), nil
+	}
+
+	// ADPCM decodes whole blocks, so read the covering blocks and trim
+	samplesPerBlock := imaSamplesPerBlock(blockAlign, int(r.format.NumChannels))
+	firstBlock := start / samplesPerBlock
+	lastBlock := (start + count - 1) / samplesPerBlock
+	raw, err := r.readData(int64(firstBlock*blockAlign), int64((lastBlock-firstBlock+1)*blockAlign))
+	if err != nil {
+		return nil, err
+	}
+
+	pcm := decodeAudio(raw, r.format)
+	frameSize := int(r.pcmFormat.BlockAlign)
+	skip := (start - firstBlock*samplesPerBlock) * frameSize
+	end := skip + count*frameSize
+	if end > len(pcm) {
+		end = len(pcm)
+	}
+	return pcm[skip:end], nil
+}
+
+// readData reads length bytes at offset within the data chunk, clipped to its end
+func (r *wavChunkReader) readData(offset, length int64) ([]byte, error) {
+	if offset+length > r.dataSize {
+		length = r.dataSize - offset
+	}
+	buf := make([]byte, length)
+	if _, err := r.file.ReadAt(buf, r.dataOffset+offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read audio data: %w", err)
+	}
+	return buf, nil
+}
+
+// Close closes the underlying file
+func (r *wavChunkReader) Close() error {
+	return r.file.Close()
+}
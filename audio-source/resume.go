@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// resumeHistoryMs is how much recent audio is kept for clients resuming
+// with Last-Event-ID; it covers the relay's five-second reconnect delay
+const resumeHistoryMs = 10000
+
+// chunkHistory holds the most recent chunks in event ID order
+type chunkHistory struct {
+	mu     sync.RWMutex
+	chunks []AudioChunk
+	size   int
+}
+
+// newChunkHistory keeps resumeHistoryMs worth of chunks
+func newChunkHistory(chunkDurationMs int) *chunkHistory {
+	size := resumeHistoryMs / chunkDurationMs
+	if size < 1 {
+		size = 1
+	}
+	return &chunkHistory{size: size}
+}
+
+// add appends a chunk, dropping the oldest once the window is full
+func (h *chunkHistory) add(chunk AudioChunk) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.chunks = append(h.chunks, chunk)
+	if len(h.chunks) > h.size {
+		h.chunks = append(h.chunks[:0], h.chunks[len(h.chunks)-h.size:]...)
+	}
+}
+
+// since returns the retained chunks after lastID, and how many IDs between
+// lastID and the oldest retained chunk are no longer available
+func (h *chunkHistory) since(lastID int64) ([]AudioChunk, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var replay []AudioChunk
+	for _, c := range h.chunks {
+		if c.EventID > lastID {
+			replay = append(replay, c)
+		}
+	}
+	var missed int64
+	if len(replay) > 0 && replay[0].EventID > lastID+1 && len(replay) == len(h.chunks) {
+		missed = replay[0].EventID - lastID - 1
+	}
+	return replay, missed
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RTP settings
+const (
+	rtpVersion        = 2
+	rtpDynamicPayload = 96
+	rtpMaxPayload     = 1200 // stays inside a typical MTU with IP/UDP/RTP headers
+	rtpDefaultPtimeMs = 5
+)
+
+// rtpStream describes the RTP stream for one audio format. A format change
+// starts a new stream with its own SSRC.
+type rtpStream struct {
+	ssrc        uint32
+	payloadType int
+	sampleRate  int
+	channels    int
+	frames      int // frames per packet
+	version     int // bumped in the SDP origin line for each new stream
+}
+
+// rtpQueued is a chunk waiting to be sent, with the number of frames dropped
+// from the queue just before it
+type rtpQueued struct {
+	chunk   AudioChunk
+	skipped int
+}
+
+// rtpSender packetizes chunks from the audio loop as L16 or L24 RTP and sends
+// them to a unicast or multicast UDP address, spreading each chunk's packets
+// over the chunk duration
+type rtpSender struct {
+	conn     *net.UDPConn
+	dest     *net.UDPAddr
+	bits     int // 16 or 24
+	ptimeMs  int
+	chunkDur time.Duration
+	queue    chan rtpQueued
+
+	mu        sync.Mutex
+	stream    rtpStream
+	sequence  uint16
+	timestamp uint32
+	marker    bool
+	pending   []byte // payload carried over to the next packet
+	packets   uint64
+	octets    uint64
+	dropped   uint64
+	skipped   int // frames dropped since the last queued chunk
+	sessionID uint32
+}
+
+// rtpConfig selects RTP output
+type rtpConfig struct {
+	Dest    string // host:port; empty when RTP output is off
+	Bits    int    // 16 or 24
+	PtimeMs int    // packet duration
+}
+
+// parseRTPPayload reads an RTP payload name and returns its sample width
+func parseRTPPayload(v string) (int, error) {
+	switch strings.ToUpper(strings.TrimSpace(v)) {
+	case "L16":
+		return 16, nil
+	case "L24":
+		return 24, nil
+	}
+	return 0, fmt.Errorf("want L16 or L24, got %q", v)
+}
+
+// newRTPSender opens a UDP socket towards the configured destination
+func newRTPSender(cfg rtpConfig, chunkDur time.Duration) (*rtpSender, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Dest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve RTP destination: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RTP socket: %w", err)
+	}
+
+	s := &rtpSender{
+		conn:      conn,
+		dest:      addr,
+		bits:      cfg.Bits,
+		ptimeMs:   cfg.PtimeMs,
+		chunkDur:  chunkDur,
+		queue:     make(chan rtpQueued, 10),
+		sequence:  uint16(randomUint32()),
+		timestamp: randomUint32(),
+		sessionID: randomUint32(),
+	}
+	go s.run()
+	log.Printf("RTP output: L%d to %s, %d ms packets", cfg.Bits, addr, cfg.PtimeMs)
+	return s, nil
+}
+
+// randomUint32 returns a random value for SSRCs and initial counters
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// send queues a chunk for transmission without blocking the audio loop. A
+// dropped chunk is remembered so the timestamps still account for it.
+func (s *rtpSender) send(chunk AudioChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.queue <- rtpQueued{chunk: chunk, skipped: s.skipped}:
+		s.skipped = 0
+	default:
+		s.dropped++
+		if frameSize := chunk.AudioFormat["bits_per_sample"] / 8 * chunk.AudioFormat["channels"]; frameSize > 0 {
+			s.skipped += len(chunk.raw) / frameSize
+		}
+	}
+}
+
+// run sends queued chunks, pacing packets across each chunk
+func (s *rtpSender) run() {
+	for queued := range s.queue {
+		packets := s.packetize(queued.chunk, queued.skipped)
+		if len(packets) == 0 {
+			continue
+		}
+		start := time.Now()
+		interval := s.chunkDur / time.Duration(len(packets))
+		for i, packet := range packets {
+			if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+				time.Sleep(wait)
+			}
+			if _, err := s.conn.Write(packet); err != nil {
+				log.Printf("Failed to send RTP packet: %v", err)
+				continue
+			}
+			s.mu.Lock()
+			s.packets++
+			s.octets += uint64(len(packet) - 12)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// packetize splits a chunk into RTP packets, starting a new stream when the
+// audio format has changed. skipped frames were dropped before the chunk.
+func (s *rtpSender) packetize(chunk AudioChunk, skipped int) [][]byte {
+	format := chunk.AudioFormat
+	width := format["bits_per_sample"] / 8
+	channels := format["channels"]
+	if width < 1 || channels < 1 || format["sample_rate"] < 1 {
+		return nil
+	}
+	isFloat := format["format_tag"] == wavFormatIEEEFloat
+	outWidth := s.bits / 8
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream.sampleRate != format["sample_rate"] || s.stream.channels != channels {
+		s.newStream(format["sample_rate"], channels)
+	} else if skipped > 0 {
+		// The timestamps skip the dropped audio, and the frames held back
+		// for the next packet, so receivers see the gap instead of playing
+		// the audio either side of it back to back
+		s.timestamp += uint32(len(s.pending)/(channels*outWidth) + skipped)
+		s.pending = nil
+	}
+
+	// Samples go out big-endian at the payload depth. Frames that do not
+	// fill a packet wait for the next chunk so every packet lasts ptime.
+	samples := len(chunk.raw) / width / channels * channels
+	for i := 0; i < samples; i++ {
+		v := pcmToInt(chunk.raw[i*width:], width, isFloat, s.bits)
+		for b := outWidth - 1; b >= 0; b-- {
+			s.pending = append(s.pending, byte(v>>(8*b)))
+		}
+	}
+
+	var packets [][]byte
+	payloadSize := s.stream.frames * channels * outWidth
+	for len(s.pending) >= payloadSize {
+		packet := make([]byte, 12, 12+payloadSize)
+		packet[0] = rtpVersion << 6
+		packet[1] = byte(s.stream.payloadType)
+		if s.marker {
+			packet[1] |= 0x80
+			s.marker = false
+		}
+		binary.BigEndian.PutUint16(packet[2:], s.sequence)
+		binary.BigEndian.PutUint32(packet[4:], s.timestamp)
+		binary.BigEndian.PutUint32(packet[8:], s.stream.ssrc)
+		packets = append(packets, append(packet, s.pending[:payloadSize]...))
+
+		s.pending = s.pending[payloadSize:]
+		s.sequence++
+		s.timestamp += uint32(s.stream.frames)
+	}
+	return packets
+}
+
+// newStream switches to a new SSRC for the given format; the caller holds mu
+func (s *rtpSender) newStream(sampleRate, channels int) {
+	frames := sampleRate * s.ptimeMs / 1000
+	if max := rtpMaxPayload / (channels * s.bits / 8); frames > max {
+		frames = max
+	}
+	if frames < 1 {
+		frames = 1
+	}
+
+	s.stream = rtpStream{
+		ssrc:        randomUint32(),
+		payloadType: rtpPayloadType(s.bits, sampleRate, channels),
+		sampleRate:  sampleRate,
+		channels:    channels,
+		frames:      frames,
+		version:     s.stream.version + 1,
+	}
+	s.marker = true
+	s.pending = nil
+	log.Printf("RTP stream %08x: L%d/%d/%d, %d frames per packet", s.stream.ssrc, s.bits, sampleRate, channels, frames)
+}
+
+// rtpPayloadType returns the static RFC 3551 payload type for 44.1 kHz L16
+// mono or stereo, and the dynamic type otherwise
+func rtpPayloadType(bits, sampleRate, channels int) int {
+	if bits == 16 && sampleRate == 44100 {
+		switch channels {
+		case 1:
+			return 11
+		case 2:
+			return 10
+		}
+	}
+	return rtpDynamicPayload
+}
+
+// pcmToInt returns a linear PCM sample as a signed integer of bits width
+func pcmToInt(b []byte, width int, isFloat bool, bits int) int32 {
+	if isFloat {
+		v := math.Max(-1, math.Min(1, readSample(b, width, true)))
+		return int32(math.Round(v * float64(int32(1)<<(bits-1)-1)))
+	}
+
+	var v int32
+	if width == 1 {
+		v = int32(b[0]) - 128
+	} else {
+		for i := width - 1; i >= 0; i-- {
+			v = v<<8 | int32(b[i])
+		}
+		shift := 32 - 8*width
+		v = v << shift >> shift
+	}
+	if shift := 8*width - bits; shift > 0 {
+		return v >> shift
+	}
+	return v << (bits - 8*width)
+}
+
+// sdp describes the current stream for receivers
+func (s *rtpSender) sdp() string {
+	s.mu.Lock()
+	stream := s.stream
+	s.mu.Unlock()
+	if stream.version == 0 {
+		return ""
+	}
+
+	addrType := "IP4"
+	if s.dest.IP.To4() == nil {
+		addrType = "IP6"
+	}
+	origin := "127.0.0.1"
+	if local, ok := s.conn.LocalAddr().(*net.UDPAddr); ok && !local.IP.IsUnspecified() {
+		origin = local.IP.String()
+	}
+	connection := s.dest.IP.String()
+	if s.dest.IP.IsMulticast() && addrType == "IP4" {
+		connection += "/1" // the default multicast TTL, which keeps packets on the local network
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- %d %d IN %s %s\r\n", s.sessionID, stream.version, addrType, origin)
+	fmt.Fprintf(&b, "s=k8s-audio-lab\r\n")
+	fmt.Fprintf(&b, "c=IN %s %s\r\n", addrType, connection)
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "m=audio %d RTP/AVP %d\r\n", s.dest.Port, stream.payloadType)
+	fmt.Fprintf(&b, "a=rtpmap:%d L%d/%d/%d\r\n", stream.payloadType, s.bits, stream.sampleRate, stream.channels)
+	fmt.Fprintf(&b, "a=ptime:%g\r\n", float64(stream.frames)*1000/float64(stream.sampleRate))
+	fmt.Fprintf(&b, "a=ssrc:%d cname:k8s-audio-lab\r\n", stream.ssrc)
+	return b.String()
+}
+
+// info describes the RTP output for /status
+func (s *rtpSender) info() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"destination":    s.dest.String(),
+		"multicast":      s.dest.IP.IsMulticast(),
+		"payload":        fmt.Sprintf("L%d", s.bits),
+		"payload_type":   s.stream.payloadType,
+		"ssrc":           s.stream.ssrc,
+		"ptime_ms":       s.ptimeMs,
+		"packets_sent":   s.packets,
+		"octets_sent":    s.octets,
+		"chunks_dropped": s.dropped,
+	}
+}
+
+// handleSDP serves the SDP description of the RTP output
+func handleSDP(w http.ResponseWriter, r *http.Request) {
+	if audioServer.rtp == nil {
+		http.Error(w, "RTP output is not enabled (set AUDIO_RTP_DEST)", http.StatusNotFound)
+		return
+	}
+	sdp := audioServer.rtp.sdp()
+	if sdp == "" {
+		http.Error(w, "RTP stream has not started yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write([]byte(sdp))
+}
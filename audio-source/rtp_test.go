@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"audio-common/chunkproto"
+)
+
+// rampChunk is n stereo 16-bit frames whose left channel counts up from
+// first and whose right channel is its negation
+func rampChunk(sampleRate, first, n int) AudioChunk {
+	samples := make([]int16, 0, 2*n)
+	for i := first; i < first+n; i++ {
+		samples = append(samples, int16(i), int16(-i))
+	}
+	return AudioChunk{
+		Header: chunkproto.Header{
+			AudioFormat: map[string]int{"format_tag": wavFormatPCM, "bits_per_sample": 16, "channels": 2, "sample_rate": sampleRate},
+		},
+		raw: pcm16(samples...),
+	}
+}
+
+// rtpHeader is the fixed part of an RTP packet header
+type rtpHeader struct {
+	marker      bool
+	payloadType int
+	sequence    uint16
+	timestamp   uint32
+	ssrc        uint32
+}
+
+func parseRTPHeader(t *testing.T, packet []byte) rtpHeader {
+	t.Helper()
+	if len(packet) < 12 || packet[0] != 0x80 {
+		t.Fatalf("bad RTP packet % x", packet[:2])
+	}
+	return rtpHeader{
+		marker:      packet[1]&0x80 != 0,
+		payloadType: int(packet[1] & 0x7F),
+		sequence:    binary.BigEndian.Uint16(packet[2:]),
+		timestamp:   binary.BigEndian.Uint32(packet[4:]),
+		ssrc:        binary.BigEndian.Uint32(packet[8:]),
+	}
+}
+
+// checkRamp checks that a stereo L16 packet of rampChunk audio starts at frame
+func checkRamp(t *testing.T, packet []byte, frame int) {
+	t.Helper()
+	payload := packet[12:]
+	for i := 0; i < len(payload)/4; i++ {
+		left := int16(binary.BigEndian.Uint16(payload[4*i:]))
+		right := int16(binary.BigEndian.Uint16(payload[4*i+2:]))
+		if left != int16(frame+i) || right != -int16(frame+i) {
+			t.Fatalf("frame %d of the packet is %d/%d, want %d", i, left, right, frame+i)
+		}
+	}
+}
+
+func TestRTPPacketize(t *testing.T) {
+	s := &rtpSender{bits: 16, ptimeMs: 5, sequence: 0xFFFE, timestamp: 0xFFFFF000}
+
+	// 220 frames per 5 ms packet at 44.1 kHz, so each 100 ms chunk leaves
+	// 10 more frames for the next one
+	var headers []rtpHeader
+	var packets [][]byte
+	for i, want := range []int{20, 20, 20} {
+		got := s.packetize(rampChunk(44100, 4410*i, 4410), 0)
+		if len(got) != want {
+			t.Fatalf("chunk %d made %d packets, want %d", i, len(got), want)
+		}
+		for _, p := range got {
+			headers = append(headers, parseRTPHeader(t, p))
+		}
+		packets = append(packets, got...)
+	}
+	if len(s.pending) != 30*4 {
+		t.Errorf("%d bytes held back, want 30 frames", len(s.pending))
+	}
+
+	for i, h := range headers {
+		if len(packets[i]) != 12+220*4 {
+			t.Fatalf("packet %d is %d bytes", i, len(packets[i]))
+		}
+		if h.marker != (i == 0) || h.payloadType != 10 || h.ssrc != headers[0].ssrc {
+			t.Errorf("packet %d header %+v", i, h)
+		}
+		if h.sequence != uint16(0xFFFE+i) || h.timestamp != 0xFFFFF000+uint32(220*i) {
+			t.Errorf("packet %d sequence %d, timestamp %d", i, h.sequence, h.timestamp)
+		}
+		checkRamp(t, packets[i], 220*i)
+	}
+
+	// A new format starts a new stream; the held back frames are discarded
+	s.timestamp = 1000
+	got := s.packetize(rampChunk(48000, 0, 4800), 0)
+	if len(got) != 20 {
+		t.Fatalf("48 kHz chunk made %d packets, want 20", len(got))
+	}
+	h := parseRTPHeader(t, got[0])
+	if !h.marker || h.payloadType != rtpDynamicPayload || h.ssrc == headers[0].ssrc || h.timestamp != 1000 {
+		t.Errorf("first packet of the new stream %+v", h)
+	}
+	if s.stream.version != 2 {
+		t.Errorf("stream version %d, want 2", s.stream.version)
+	}
+	checkRamp(t, got[0], 0)
+}
+
+func TestRTPPacketSize(t *testing.T) {
+	cases := []struct {
+		bits, ptimeMs, sampleRate, channels int
+		frames                              int
+	}{
+		{16, 5, 48000, 2, 240},
+		{24, 5, 48000, 2, 200}, // 240 frames would pass rtpMaxPayload
+		{16, 20, 8000, 1, 160},
+		{24, 1, 44100, 1, 44},
+		{16, 1, 800, 1, 1}, // never less than a frame
+	}
+	for _, tc := range cases {
+		s := &rtpSender{bits: tc.bits, ptimeMs: tc.ptimeMs}
+		s.newStream(tc.sampleRate, tc.channels)
+		if s.stream.frames != tc.frames {
+			t.Errorf("L%d/%d/%d at %d ms: %d frames per packet, want %d",
+				tc.bits, tc.sampleRate, tc.channels, tc.ptimeMs, s.stream.frames, tc.frames)
+		}
+	}
+}
+
+func TestRTPDroppedChunkAdvancesTimestamp(t *testing.T) {
+	s := &rtpSender{bits: 16, ptimeMs: 5, timestamp: 5000, queue: make(chan rtpQueued, 1)}
+	s.send(rampChunk(44100, 0, 4410))
+	s.send(rampChunk(44100, 4410, 4410)) // the queue is full
+	first := <-s.queue
+	s.send(rampChunk(44100, 8820, 4410))
+	third := <-s.queue
+	if s.dropped != 1 || third.skipped != 4410 {
+		t.Fatalf("dropped %d, skipped %d frames; want 1 chunk of 4410", s.dropped, third.skipped)
+	}
+
+	s.packetize(first.chunk, first.skipped)
+	got := s.packetize(third.chunk, third.skipped)
+	// The third chunk starts 8820 frames after the first, and the 10 frames
+	// held back from the first are lost with the gap
+	h := parseRTPHeader(t, got[0])
+	if h.timestamp != 5000+8820 || h.marker {
+		t.Errorf("packet after the gap %+v, want timestamp %d", h, 5000+8820)
+	}
+	checkRamp(t, got[0], 8820)
+	if len(got) != 20 || len(s.pending) != 10*4 {
+		t.Errorf("%d packets and %d bytes held back", len(got), len(s.pending))
+	}
+}
+
+func TestRTPSDP(t *testing.T) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5004})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream := rtpStream{ssrc: 0x12345678, payloadType: rtpDynamicPayload, sampleRate: 48000, channels: 2, frames: 240, version: 3}
+
+	cases := []struct {
+		dest string
+		want string
+	}{
+		{"192.0.2.10:5004", "c=IN IP4 192.0.2.10\r\n"},
+		{"239.255.0.1:5004", "c=IN IP4 239.255.0.1/1\r\n"},
+	}
+	for _, tc := range cases {
+		dest, _ := net.ResolveUDPAddr("udp", tc.dest)
+		s := &rtpSender{conn: conn, dest: dest, bits: 24, sessionID: 42, stream: stream}
+		want := "v=0\r\n" +
+			"o=- 42 3 IN IP4 127.0.0.1\r\n" +
+			"s=k8s-audio-lab\r\n" +
+			tc.want +
+			"t=0 0\r\n" +
+			"m=audio 5004 RTP/AVP 96\r\n" +
+			"a=rtpmap:96 L24/48000/2\r\n" +
+			"a=ptime:5\r\n" +
+			"a=ssrc:305419896 cname:k8s-audio-lab\r\n"
+		if got := s.sdp(); got != want {
+			t.Errorf("SDP for %s\n%q, want\n%q", tc.dest, got, want)
+		}
+	}
+
+	// IPv6 destinations take no TTL
+	dest, _ := net.ResolveUDPAddr("udp", "[ff02::1]:5004")
+	s := &rtpSender{conn: conn, dest: dest, bits: 16, stream: stream}
+	if got := s.sdp(); !strings.Contains(got, "o=- 0 3 IN IP6 127.0.0.1\r\n") || !strings.Contains(got, "c=IN IP6 ff02::1\r\n") {
+		t.Errorf("IPv6 SDP\n%s", got)
+	}
+
+	// Nothing to describe before the first chunk
+	if got := (&rtpSender{conn: conn, dest: dest}).sdp(); got != "" {
+		t.Errorf("SDP before any stream %q", got)
+	}
+}
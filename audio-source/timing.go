@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// maxCatchUpChunks is how far playback may fall behind the wall clock before
+// chunks are skipped instead of being sent back to back
+const maxCatchUpChunks = 5
+
+// playbackTiming counts how closely the audio loop tracks its schedule
+type playbackTiming struct {
+	LateTicks      int     `json:"late_ticks"`       // chunks sent more than half a chunk late
+	CaughtUpChunks int     `json:"caught_up_chunks"` // chunks sent back to back to catch up
+	SkippedChunks  int     `json:"skipped_chunks"`   // chunks dropped to rejoin the schedule
+	DriftMs        float64 `json:"drift_ms"`         // lateness of the last chunk sent
+	MaxDriftMs     float64 `json:"max_drift_ms"`
+}
+
+// record notes that a chunk went out lateness after it was due, having
+// skipped skipped chunks to get there
+func (t *playbackTiming) record(lateness, chunkDuration time.Duration, skipped int) {
+	if skipped > 0 {
+		t.SkippedChunks += skipped
+	} else if lateness >= chunkDuration {
+		t.CaughtUpChunks++
+	}
+	if lateness > chunkDuration/2 || skipped > 0 {
+		t.LateTicks++
+	}
+
+	t.DriftMs = float64(lateness.Microseconds()) / 1000
+	if t.DriftMs > t.MaxDriftMs {
+		t.MaxDriftMs = t.DriftMs
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Timing watermarks are short binary FSK bursts mixed into the PCM. Each burst
+// carries the source wall clock in milliseconds and a sequence number, so a
+// recording of the played-out audio can be matched back to the moment the
+// chunk left the source.
+const (
+	watermarkBaud      = 600
+	watermarkMarkFreq  = 1200.0 // 1 bits
+	watermarkSpaceFreq = 2200.0 // 0 bits
+	watermarkRampMs    = 1
+
+	// Alternating preamble followed by a sync word
+	watermarkPreamble = 0xAAAA
+	watermarkSync     = 0x2DD4
+
+	// The first preamble bits may be ramped or masked, so only the rest of
+	// the header is required to match
+	watermarkHeaderBits = 32
+	watermarkSkipBits   = 8
+
+	// Header, 48-bit timestamp, 32-bit sequence and CRC-8
+	watermarkFrameBytes = 4 + 6 + 4 + 1
+
+	defaultWatermarkLevel = -20.0
+	minWatermarkInterval  = 500 * time.Millisecond
+)
+
+// Watermark is a timing burst recovered from audio
+type Watermark struct {
+	Offset    int      `json:"offset"`    // frame where the burst starts
+	OffsetMs  float64  `json:"offset_ms"` // offset from the start of the recording
+	Timestamp int64    `json:"timestamp"` // source wall clock when the burst was sent, ms
+	Sequence  uint32   `json:"sequence"`
+	LatencyMs *float64 `json:"latency_ms,omitempty"`
+}
+
+// watermarker overlays timing bursts onto outgoing chunks. It is only used
+// from the audio loop, apart from the counters reported by info.
+type watermarker struct {
+	interval time.Duration // zero marks the start of each loop only
+	levelDb  float64
+	gain     float64
+
+	sequence  atomic.Uint32
+	lastBurst time.Time
+	burstRate int
+	pending   []float64
+}
+
+// watermarkConfig selects timing watermarks
+type watermarkConfig struct {
+	Enabled  bool
+	Interval time.Duration // zero marks the start of each loop only
+	LevelDb  float64
+}
+
+// parseWatermarkMode reads a watermark mode: "loop" (or on/true/1) for a
+// burst at the start of each loop, a duration such as "2s" for periodic
+// bursts, or off
+func parseWatermarkMode(v string) (bool, time.Duration, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(v)); mode {
+	case "", "off", "false", "0":
+		return false, 0, nil
+	case "loop", "on", "true", "1":
+		return true, 0, nil
+	default:
+		d, err := time.ParseDuration(mode)
+		if err != nil {
+			return false, 0, fmt.Errorf("want off, loop or a duration, got %q", v)
+		}
+		return true, d, nil
+	}
+}
+
+// newWatermarker prepares bursts for a validated configuration
+func newWatermarker(cfg watermarkConfig) *watermarker {
+	return &watermarker{
+		interval: cfg.Interval,
+		levelDb:  cfg.LevelDb,
+		gain:     math.Pow(10, cfg.LevelDb/20),
+	}
+}
+
+// info describes the watermark settings for /status
+func (w *watermarker) info() map[string]interface{} {
+	mode := "loop"
+	if w.interval != 0 {
+		mode = "interval"
+	}
+	return map[string]interface{}{
+		"mode":        mode,
+		"interval_ms": w.interval.Milliseconds(),
+		"level_db":    w.levelDb,
+		"baud":        watermarkBaud,
+		"bursts_sent": w.sequence.Load(),
+	}
+}
+
+// apply starts a burst when one is due and mixes any pending burst samples
+// into a copy of pcm. The burst carries now, which should match the chunk timestamp.
+func (w *watermarker) apply(pcm []byte, format wavFormat, position int, now time.Time) []byte {
+	rate := int(format.SampleRate)
+	if rate != w.burstRate {
+		// Audio was switched mid-burst
+		w.pending = nil
+	}
+
+	due := position == 0
+	if w.interval != 0 {
+		due = w.lastBurst.IsZero() || now.Sub(w.lastBurst) >= w.interval
+	}
+	if due && len(w.pending) == 0 {
+		seq := w.sequence.Add(1)
+		w.pending = watermarkBurst(now.UnixMilli(), seq, rate, w.gain)
+		w.burstRate = rate
+		w.lastBurst = now
+	}
+	if len(w.pending) == 0 {
+		return pcm
+	}
+
+	out := make([]byte, len(pcm))
+	copy(out, pcm)
+	n := mixPCM(out, format, w.pending)
+	w.pending = w.pending[n:]
+	return out
+}
+
+// watermarkFrame builds the bytes carried by one burst
+func watermarkFrame(timestampMs int64, sequence uint32) []byte {
+	frame := make([]byte, watermarkFrameBytes)
+	binary.BigEndian.PutUint16(frame[0:], watermarkPreamble)
+	binary.BigEndian.PutUint16(frame[2:], watermarkSync)
+	binary.BigEndian.PutUint16(frame[4:], uint16(timestampMs>>32))
+	binary.BigEndian.PutUint32(frame[6:], uint32(timestampMs))
+	binary.BigEndian.PutUint32(frame[10:], sequence)
+	frame[14] = crc8(frame[4:14])
+	return frame
+}
+
+// watermarkBitStart returns the first frame of bit i within a burst
+func watermarkBitStart(i, sampleRate int) int {
+	return int(math.Round(float64(i) * float64(sampleRate) / watermarkBaud))
+}
+
+// watermarkBurst synthesises the phase-continuous FSK signal for one frame
+func watermarkBurst(timestampMs int64, sequence uint32, sampleRate int, gain float64) []float64 {
+	frame := watermarkFrame(timestampMs, sequence)
+	bits := len(frame) * 8
+	out := make([]float64, watermarkBitStart(bits, sampleRate))
+
+	phase := 0.0
+	for i := 0; i < bits; i++ {
+		freq := watermarkSpaceFreq
+		if frame[i/8]&(0x80>>(i%8)) != 0 {
+			freq = watermarkMarkFreq
+		}
+		step := 2 * math.Pi * freq / float64(sampleRate)
+		for n := watermarkBitStart(i, sampleRate); n < watermarkBitStart(i+1, sampleRate); n++ {
+			out[n] = gain * math.Sin(phase)
+			phase += step
+		}
+	}
+
+	// Short raised-cosine ramps avoid clicks at either end
+	ramp := sampleRate * watermarkRampMs / 1000
+	for n := 0; n < ramp && n < len(out)/2; n++ {
+		g := 0.5 - 0.5*math.Cos(math.Pi*float64(n)/float64(ramp))
+		out[n] *= g
+		out[len(out)-1-n] *= g
+	}
+	return out
+}
+
+// crc8 computes CRC-8 with polynomial 0x07
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// mixPCM adds signal to every channel of the frames in pcm, clipping at full
+// scale, and returns the number of frames mixed
+func mixPCM(pcm []byte, format wavFormat, signal []float64) int {
+	width := int(format.BitsPerSample / 8)
+	channels := int(format.NumChannels)
+	isFloat := format.encoding() == wavFormatIEEEFloat
+
+	frames := len(pcm) / (width * channels)
+	if frames > len(signal) {
+		frames = len(signal)
+	}
+	for i := 0; i < frames; i++ {
+		for ch := 0; ch < channels; ch++ {
+			b := pcm[(i*channels+ch)*width:]
+			writeSample(b, width, isFloat, readSample(b, width, isFloat)+signal[i])
+		}
+	}
+	return frames
+}
+
+// readSample returns a linear PCM sample scaled to [-1, 1]
+func readSample(b []byte, width int, isFloat bool) float64 {
+	if isFloat {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	if width == 1 {
+		return float64(int(b[0])-128) / 128
+	}
+	var v int64
+	for i := width - 1; i >= 0; i-- {
+		v = v<<8 | int64(b[i])
+	}
+	shift := 64 - 8*width
+	v = v << shift >> shift
+	return float64(v) / float64(int64(1)<<(8*width-1))
+}
+
+// writeSample stores v, clipped to [-1, 1], as a linear PCM sample
+func writeSample(b []byte, width int, isFloat bool, v float64) {
+	v = math.Max(-1, math.Min(1, v))
+	if isFloat {
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v)))
+		return
+	}
+	if width == 1 {
+		b[0] = byte(math.Max(0, math.Min(255, math.Round(v*128)+128)))
+		return
+	}
+	scale := float64(int64(1)<<(8*width-1)) - 1
+	s := int64(math.Round(v * scale))
+	for i := 0; i < width; i++ {
+		b[i] = byte(s >> (8 * i))
+	}
+}
+
+// pcmToMono mixes interleaved linear PCM down to mono samples in [-1, 1]
+func pcmToMono(pcm []byte, format wavFormat) []float64 {
+	width := int(format.BitsPerSample / 8)
+	channels := int(format.NumChannels)
+	isFloat := format.encoding() == wavFormatIEEEFloat
+
+	out := make([]float64, len(pcm)/(width*channels))
+	for i := range out {
+		sum := 0.0
+		for ch := 0; ch < channels; ch++ {
+			sum += readSample(pcm[(i*channels+ch)*width:], width, isFloat)
+		}
+		out[i] = sum / float64(channels)
+	}
+	return out
+}
+
+// DecodeWatermarks scans mono samples for timing bursts and returns them in
+// order. Bursts whose checksum fails are ignored.
+func DecodeWatermarks(samples []float64, sampleRate int) []Watermark {
+	window := sampleRate / watermarkBaud
+	if window < 2 || len(samples) < window {
+		return nil
+	}
+	d := fskDiscriminator(samples, sampleRate, window)
+
+	// bitAt slices bit i of a burst starting at frame start
+	bitAt := func(start, i int) (byte, bool) {
+		pos := start + watermarkBitStart(i, sampleRate)
+		if pos >= len(d) {
+			return 0, false
+		}
+		if d[pos] > 0 {
+			return 1, true
+		}
+		return 0, true
+	}
+	header := uint32(watermarkPreamble)<<16 | watermarkSync
+	headerAt := func(start int) bool {
+		for i := watermarkSkipBits; i < watermarkHeaderBits; i++ {
+			bit, ok := bitAt(start, i)
+			if !ok || uint32(bit) != header>>(watermarkHeaderBits-1-i)&1 {
+				return false
+			}
+		}
+		return true
+	}
+
+	var marks []Watermark
+	burstLen := watermarkBitStart(watermarkFrameBytes*8, sampleRate)
+	for start := 0; start < len(d); start++ {
+		if !headerAt(start) {
+			continue
+		}
+
+		// The header decodes over a range of alignments; use the middle
+		end := start
+		for end+1 < len(d) && end+1-start < window && headerAt(end+1) {
+			end++
+		}
+		centre := (start + end) / 2
+
+		frame := make([]byte, watermarkFrameBytes)
+		complete := true
+		for i := 0; i < len(frame)*8; i++ {
+			bit, ok := bitAt(centre, i)
+			if !ok {
+				complete = false
+				break
+			}
+			frame[i/8] |= bit << (7 - i%8)
+		}
+		if !complete {
+			break
+		}
+		if crc8(frame[4:14]) != frame[14] {
+			continue
+		}
+
+		marks = append(marks, Watermark{
+			Offset:    centre,
+			OffsetMs:  float64(centre) * 1000 / float64(sampleRate),
+			Timestamp: int64(binary.BigEndian.Uint16(frame[4:]))<<32 | int64(binary.BigEndian.Uint32(frame[6:])),
+			Sequence:  binary.BigEndian.Uint32(frame[10:]),
+		})
+		start = centre + burstLen - 1
+	}
+	return marks
+}
+
+// fskDiscriminator returns, for each window of samples starting at n, the
+// mark tone energy minus the space tone energy, using a sliding DFT
+func fskDiscriminator(samples []float64, sampleRate, window int) []float64 {
+	wm := 2 * math.Pi * watermarkMarkFreq / float64(sampleRate)
+	ws := 2 * math.Pi * watermarkSpaceFreq / float64(sampleRate)
+
+	var mRe, mIm, sRe, sIm float64
+	accumulate := func(k int, sign float64) {
+		v := sign * samples[k]
+		mRe += v * math.Cos(wm*float64(k))
+		mIm -= v * math.Sin(wm*float64(k))
+		sRe += v * math.Cos(ws*float64(k))
+		sIm -= v * math.Sin(ws*float64(k))
+	}
+
+	d := make([]float64, len(samples)-window+1)
+	for k := 0; k < window; k++ {
+		accumulate(k, 1)
+	}
+	for n := range d {
+		if n > 0 {
+			accumulate(n-1, -1)
+			accumulate(n+window-1, 1)
+		}
+		d[n] = mRe*mRe + mIm*mIm - sRe*sRe - sIm*sIm
+	}
+	return d
+}
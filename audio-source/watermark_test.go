@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatermarkRoundTrip(t *testing.T) {
+	cases := []struct {
+		name       string
+		sampleRate int
+		levelDb    float64
+		noise      float64 // peak of uniform noise, full scale 1
+		tone       float64 // amplitude of a 440 Hz tone under the bursts
+	}{
+		{"0 dBFS", 44100, 0, 0, 0},
+		{"default level under noise", 44100, defaultWatermarkLevel, 0.05, 0.1},
+		{"16 kHz under noise", 16000, -12, 0.05, 0.3},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			format := wavFormat{
+				FormatTag:     wavFormatPCM,
+				NumChannels:   2,
+				SampleRate:    uint32(tc.sampleRate),
+				BitsPerSample: 16,
+				BlockAlign:    4,
+			}
+			w := newWatermarker(watermarkConfig{Enabled: true, Interval: time.Second, LevelDb: tc.levelDb})
+
+			// Three seconds of 100 ms chunks, with a burst due each second
+			start := time.UnixMilli(1700000000123)
+			rng := rand.New(rand.NewSource(1))
+			framesPerChunk := tc.sampleRate / 10
+			var recording []byte
+			for pos := 0; pos < 30; pos++ {
+				chunk := make([]byte, framesPerChunk*4)
+				for i := 0; i < framesPerChunk; i++ {
+					n := pos*framesPerChunk + i
+					v := tc.tone * math.Sin(2*math.Pi*440*float64(n)/float64(tc.sampleRate))
+					v += tc.noise * (2*rng.Float64() - 1)
+					writeSample(chunk[i*4:], 2, false, v)
+					writeSample(chunk[i*4+2:], 2, false, v)
+				}
+				now := start.Add(time.Duration(pos) * 100 * time.Millisecond)
+				recording = append(recording, w.apply(chunk, format, pos, now)...)
+			}
+
+			marks := DecodeWatermarks(pcmToMono(recording, format), tc.sampleRate)
+			if len(marks) != 3 {
+				t.Fatalf("decoded %d watermarks, want 3: %+v", len(marks), marks)
+			}
+			for i, m := range marks {
+				wantTime := start.Add(time.Duration(i) * time.Second).UnixMilli()
+				if m.Timestamp != wantTime || m.Sequence != uint32(i+1) {
+					t.Errorf("watermark %d = %d/#%d, want %d/#%d", i, m.Timestamp, m.Sequence, wantTime, i+1)
+				}
+				// The burst starts at its chunk; the decoder places it to
+				// within a bit
+				wantOffset := i * tc.sampleRate
+				if d := m.Offset - wantOffset; d < -tc.sampleRate/watermarkBaud || d > tc.sampleRate/watermarkBaud {
+					t.Errorf("watermark %d at frame %d, want %d", i, m.Offset, wantOffset)
+				}
+			}
+		})
+	}
+}
+
+func TestWatermarkIgnoresCorruptBurst(t *testing.T) {
+	const rate = 44100
+	burst := watermarkBurst(1700000000123, 7, rate, 0.5)
+
+	// Send the other tone for one bit of the timestamp, which breaks the CRC
+	bit := 5 * 8
+	freq := watermarkMarkFreq
+	if watermarkFrame(1700000000123, 7)[5]&0x80 != 0 {
+		freq = watermarkSpaceFreq
+	}
+	for n := watermarkBitStart(bit, rate); n < watermarkBitStart(bit+1, rate); n++ {
+		burst[n] = 0.5 * math.Sin(2*math.Pi*freq*float64(n)/rate)
+	}
+	intact := watermarkBurst(1700000000999, 8, rate, 0.5)
+	signal := append(append(burst, make([]float64, rate/10)...), intact...)
+
+	marks := DecodeWatermarks(signal, rate)
+	if len(marks) != 1 || marks[0].Sequence != 8 || marks[0].Timestamp != 1700000000999 {
+		t.Errorf("decoded %+v, want only sequence 8", marks)
+	}
+}
+
+// wavFile wraps data in a RIFF header with a 16-byte fmt chunk
+func wavFile(f wavFormat, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+len(data)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16})
+	binary.Write(&b, binary.LittleEndian, []uint16{f.FormatTag, f.NumChannels})
+	binary.Write(&b, binary.LittleEndian, []uint32{f.SampleRate, f.SampleRate * uint32(f.BlockAlign)})
+	binary.Write(&b, binary.LittleEndian, []uint16{f.BlockAlign, f.BitsPerSample})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func TestHandleWatermarkDecode(t *testing.T) {
+	const rate = 8000
+	burst := watermarkBurst(1700000000123, 3, rate, 0.5)
+	recording := make([]byte, 2*(rate/2+len(burst)))
+	for i, v := range burst {
+		writeSample(recording[2*(rate/2+i):], 2, false, v)
+	}
+	mono := wavFormat{FormatTag: wavFormatPCM, NumChannels: 1, SampleRate: rate, BitsPerSample: 16, BlockAlign: 2}
+	noRate := mono
+	noRate.SampleRate = 0
+
+	cases := []struct {
+		name   string
+		method string
+		body   []byte
+		status int
+		marks  int
+	}{
+		{"recording", http.MethodPost, wavFile(mono, recording), http.StatusOK, 1},
+		{"silence", http.MethodPost, wavFile(mono, make([]byte, 2*rate)), http.StatusOK, 0},
+		{"sample rate 0", http.MethodPost, wavFile(noRate, recording), http.StatusBadRequest, 0},
+		{"not a WAV", http.MethodPost, []byte("hello"), http.StatusBadRequest, 0},
+		{"GET", http.MethodGet, nil, http.StatusMethodNotAllowed, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleWatermarkDecode(rec, httptest.NewRequest(tc.method, "/watermark/decode?start=1700000000200", bytes.NewReader(tc.body)))
+			if rec.Code != tc.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.status, rec.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var got struct {
+				SampleRate int         `json:"sample_rate"`
+				Watermarks []Watermark `json:"watermarks"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.SampleRate != rate || len(got.Watermarks) != tc.marks {
+				t.Fatalf("decoded %+v", got)
+			}
+			if tc.marks > 0 {
+				m := got.Watermarks[0]
+				// Sent at ...123 and found 500 ms into a recording started at ...200
+				if m.Sequence != 3 || m.LatencyMs == nil || math.Abs(*m.LatencyMs-577) > 2 {
+					t.Errorf("watermark %+v", m)
+				}
+			}
+		})
+	}
+}
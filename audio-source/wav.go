@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// WAV format tags understood by LoadAudio
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// subFormatSuffix is the common tail of the KSDATAFORMAT_SUBTYPE_* GUIDs.
+// The first two bytes of a sub-format GUID carry the equivalent format tag.
+var subFormatSuffix = [14]byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+// speakerNames maps WAVEFORMATEXTENSIBLE channel mask bits to speaker positions
+var speakerNames = []string{
+	"FL", "FR", "FC", "LFE", "BL", "BR", "FLC", "FRC", "BC",
+	"SL", "SR", "TC", "TFL", "TFC", "TFR", "TBL", "TBC", "TBR",
+}
+
+// wavFormat holds the decoded contents of a fmt chunk
+type wavFormat struct {
+	FormatTag     uint16
+	NumChannels   uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	ValidBits     uint16
+	ChannelMask   uint32
+	SubFormat     [16]byte
+
+	// SamplesPerBlock is set for block-based codecs such as IMA ADPCM
+	SamplesPerBlock uint16
+}
+
+// readWAVHeader walks the RIFF chunks of a WAV stream up to the data chunk,
+// returning the validated format and the location and size of the audio data
+func readWAVHeader(r io.ReadSeeker) (wavFormat, int64, int64, error) {
+	var riffHeader struct {
+		ChunkID   [4]byte
+		ChunkSize uint32
+		Format    [4]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &riffHeader); err != nil {
+		return wavFormat{}, 0, 0, fmt.Errorf("failed to read RIFF header: %w", err)
+	}
+	if string(riffHeader.ChunkID[:]) != "RIFF" || string(riffHeader.Format[:]) != "WAVE" {
+		return wavFormat{}, 0, 0, fmt.Errorf("not a valid WAV file")
+	}
+
+	var format wavFormat
+	foundFormat := false
+	for {
+		var chunkID [4]byte
+		var chunkSize uint32
+		if err := binary.Read(r, binary.LittleEndian, &chunkID); err != nil {
+			if err == io.EOF {
+				return wavFormat{}, 0, 0, fmt.Errorf("data chunk not found")
+			}
+			return wavFormat{}, 0, 0, fmt.Errorf("failed to read chunk ID: %w", err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunkSize); err != nil {
+			return wavFormat{}, 0, 0, fmt.Errorf("failed to read chunk size: %w", err)
+		}
+
+		chunkIDStr := string(chunkID[:])
+		switch {
+		case chunkIDStr == "fmt ":
+			// Read format info, including any extensible fields
+			f, err := readFmtChunk(r, chunkSize)
+			if err != nil {
+				return wavFormat{}, 0, 0, err
+			}
+			if err := f.validate(); err != nil {
+				return wavFormat{}, 0, 0, err
+			}
+			format = f
+			foundFormat = true
+		case chunkIDStr == "data" && foundFormat:
+			dataOffset, err := r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return wavFormat{}, 0, 0, fmt.Errorf("failed to locate audio data: %w", err)
+			}
+			return format, dataOffset, int64(chunkSize), nil
+		default:
+			// Skip unknown chunks
+			if _, err := r.Seek(int64(chunkSize), io.SeekCurrent); err != nil {
+				return wavFormat{}, 0, 0, fmt.Errorf("failed to skip chunk %s: %w", chunkIDStr, err)
+			}
+		}
+	}
+}
+
+// readFmtChunk decodes a fmt chunk of the given size, including the
+// WAVE_FORMAT_EXTENSIBLE fields when present
+func readFmtChunk(r io.Reader, size uint32) (wavFormat, error) {
+	var f wavFormat
+	if size < 16 {
+		return f, fmt.Errorf("fmt chunk too short: %d bytes", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return f, fmt.Errorf("failed to read format info: %w", err)
+	}
+
+	f.FormatTag = binary.LittleEndian.Uint16(buf[0:2])
+	f.NumChannels = binary.LittleEndian.Uint16(buf[2:4])
+	f.SampleRate = binary.LittleEndian.Uint32(buf[4:8])
+	f.ByteRate = binary.LittleEndian.Uint32(buf[8:12])
+	f.BlockAlign = binary.LittleEndian.Uint16(buf[12:14])
+	f.BitsPerSample = binary.LittleEndian.Uint16(buf[14:16])
+	f.ValidBits = f.BitsPerSample
+
+	if f.FormatTag == wavFormatIMAADPCM && size >= 20 {
+		f.SamplesPerBlock = binary.LittleEndian.Uint16(buf[18:20])
+	}
+
+	if f.FormatTag != wavFormatExtensible {
+		return f, nil
+	}
+
+	// cbSize (2 bytes) followed by 22 bytes of extension
+	if size < 40 {
+		return f, fmt.Errorf("extensible fmt chunk too short: %d bytes", size)
+	}
+	if cbSize := binary.LittleEndian.Uint16(buf[16:18]); cbSize < 22 {
+		return f, fmt.Errorf("extensible fmt chunk has cbSize %d, need 22", cbSize)
+	}
+	f.ValidBits = binary.LittleEndian.Uint16(buf[18:20])
+	f.ChannelMask = binary.LittleEndian.Uint32(buf[20:24])
+	copy(f.SubFormat[:], buf[24:40])
+
+	return f, nil
+}
+
+// encoding returns the effective format tag, resolving the sub-format GUID
+// for extensible files. It returns 0 for unrecognised sub-formats.
+func (f wavFormat) encoding() uint16 {
+	if f.FormatTag != wavFormatExtensible {
+		return f.FormatTag
+	}
+	var suffix [14]byte
+	copy(suffix[:], f.SubFormat[2:])
+	if suffix != subFormatSuffix {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(f.SubFormat[0:2])
+}
+
+// validate verifies that the format can be chunked and streamed
+func (f wavFormat) validate() error {
+	if f.NumChannels == 0 || f.BlockAlign == 0 {
+		return fmt.Errorf("invalid format: %d channels, block align %d", f.NumChannels, f.BlockAlign)
+	}
+	if f.SampleRate == 0 {
+		return fmt.Errorf("invalid format: sample rate 0")
+	}
+
+	switch f.encoding() {
+	case wavFormatPCM:
+		switch f.BitsPerSample {
+		case 8, 16, 24, 32:
+		default:
+			return fmt.Errorf("unsupported PCM bit depth: %d", f.BitsPerSample)
+		}
+	case wavFormatIEEEFloat:
+		if f.BitsPerSample != 32 {
+			return fmt.Errorf("unsupported float bit depth: %d", f.BitsPerSample)
+		}
+	case wavFormatALaw, wavFormatULaw:
+		if f.BitsPerSample != 8 {
+			return fmt.Errorf("unsupported G.711 bit depth: %d", f.BitsPerSample)
+		}
+	case wavFormatIMAADPCM:
+		// Block-based, so the per-frame alignment check below does not apply
+		return f.validateIMAADPCM()
+	case 0:
+		return fmt.Errorf("unsupported extensible sub-format: %s", f.subFormatString())
+	default:
+		return fmt.Errorf("unsupported WAV format tag: 0x%04x", f.encoding())
+	}
+
+	if int(f.BlockAlign) != int(f.NumChannels)*int(f.BitsPerSample/8) {
+		return fmt.Errorf("block align %d does not match %d channels of %d-bit samples",
+			f.BlockAlign, f.NumChannels, f.BitsPerSample)
+	}
+
+	if f.FormatTag == wavFormatExtensible {
+		if f.ValidBits == 0 || f.ValidBits > f.BitsPerSample {
+			return fmt.Errorf("valid bits %d exceed %d-bit container", f.ValidBits, f.BitsPerSample)
+		}
+		if n := bits.OnesCount32(f.ChannelMask); n > int(f.NumChannels) {
+			return fmt.Errorf("channel mask 0x%x names %d speakers for %d channels",
+				f.ChannelMask, n, f.NumChannels)
+		}
+	}
+
+	return nil
+}
+
+// decodedFormat describes the linear PCM that decodeAudio produces for this format
+func (f wavFormat) decodedFormat() wavFormat {
+	switch f.encoding() {
+	case wavFormatALaw, wavFormatULaw, wavFormatIMAADPCM:
+		d := f
+		d.FormatTag = wavFormatPCM
+		d.BitsPerSample = 16
+		d.ValidBits = 16
+		d.BlockAlign = f.NumChannels * 2
+		d.ByteRate = f.SampleRate * uint32(d.BlockAlign)
+		d.SubFormat = [16]byte{}
+		d.SamplesPerBlock = 0
+		return d
+	}
+	return f
+}
+
+// decodeAudio converts the contents of a data chunk to the format returned by decodedFormat
+func decodeAudio(data []byte, f wavFormat) []byte {
+	switch tag := f.encoding(); tag {
+	case wavFormatALaw, wavFormatULaw:
+		return decodeG711(data, tag)
+	case wavFormatIMAADPCM:
+		return decodeIMAADPCM(data, int(f.BlockAlign), int(f.NumChannels))
+	}
+	return data
+}
+
+// toPCM16 converts streamed samples of the given format tag and width to
+// 16-bit little-endian PCM
+func toPCM16(data []byte, formatTag, sampleWidth int) []byte {
+	switch formatTag {
+	case wavFormatALaw, wavFormatULaw:
+		return decodeG711(data, uint16(formatTag))
+	}
+	if sampleWidth == 2 && formatTag == wavFormatPCM {
+		return data
+	}
+
+	n := len(data) / sampleWidth
+	out := make([]byte, n*2)
+	for i := 0; i < n; i++ {
+		in := data[i*sampleWidth:]
+		var v int16
+		switch {
+		case formatTag == wavFormatIEEEFloat:
+			f := math.Float32frombits(binary.LittleEndian.Uint32(in))
+			v = int16(math.Max(-1, math.Min(1, float64(f))) * 32767)
+		case sampleWidth == 1:
+			v = int16(int(in[0])-128) << 8
+		default:
+			// Keep the two most significant bytes
+			v = int16(binary.LittleEndian.Uint16(in[sampleWidth-2:]))
+		}
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(v))
+	}
+	return out
+}
+
+// encodingName returns a short name for a format tag
+func encodingName(formatTag uint16) string {
+	switch formatTag {
+	case wavFormatPCM:
+		return "pcm"
+	case wavFormatIEEEFloat:
+		return "float"
+	case wavFormatALaw:
+		return "alaw"
+	case wavFormatULaw:
+		return "ulaw"
+	case wavFormatIMAADPCM:
+		return "ima_adpcm"
+	case wavFormatFLAC:
+		return "flac"
+	case wavFormatOpus:
+		return "opus"
+	}
+	return fmt.Sprintf("0x%04x", formatTag)
+}
+
+// subFormatString formats the sub-format GUID in registry notation
+func (f wavFormat) subFormatString() string {
+	if f.FormatTag != wavFormatExtensible {
+		return ""
+	}
+	g := f.SubFormat
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// speakers lists the speaker position of each channel in order. Channels
+// beyond those named by the channel mask are reported as empty strings.
+func (f wavFormat) speakers() []string {
+	layout := make([]string, 0, f.NumChannels)
+	for bit := 0; bit < len(speakerNames) && len(layout) < int(f.NumChannels); bit++ {
+		if f.ChannelMask&(1<<bit) != 0 {
+			layout = append(layout, speakerNames[bit])
+		}
+	}
+	for len(layout) < int(f.NumChannels) {
+		layout = append(layout, "")
+	}
+	return layout
+}
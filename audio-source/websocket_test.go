@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// clientFrame builds a frame as a client sends it. lengthBytes forces the
+// 0, 2 or 8 byte extended length encoding.
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool, lengthBytes int) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+	switch lengthBytes {
+	case 0:
+		frame[1] = byte(len(payload))
+	case 2:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+// frame is a masked frame with the shortest length encoding
+func frame(fin bool, opcode byte, payload string) []byte {
+	n := 0
+	if len(payload) > 125 {
+		n = 2
+	}
+	return clientFrame(fin, opcode, []byte(payload), true, n)
+}
+
+// readServerFrame reads one unmasked frame as a client would
+func readServerFrame(r io.Reader) (byte, []byte, int, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, 0, err
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		return 0, nil, 0, fmt.Errorf("server frame header %x", head)
+	}
+	length, extended := uint64(head[1]), 0
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length, extended = uint64(binary.BigEndian.Uint16(ext[:])), 2
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length, extended = binary.BigEndian.Uint64(ext[:]), 8
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, 0, err
+	}
+	return head[0] & 0x0F, payload, extended, nil
+}
+
+// describe summarises a server frame, e.g. "0xa p" for a pong or "close 1002"
+func describe(opcode byte, payload []byte) string {
+	if opcode == wsOpClose && len(payload) >= 2 {
+		return fmt.Sprintf("close %d", binary.BigEndian.Uint16(payload))
+	}
+	return fmt.Sprintf("0x%x %s", opcode, payload)
+}
+
+// readOver sends frames to a wsConn over a pipe and reads one message. It
+// returns the message and every frame the server sent back until it closed.
+func readOver(frames [][]byte) (byte, []byte, []string, error) {
+	server, client := net.Pipe()
+	c := &wsConn{conn: server, br: bufio.NewReader(server)}
+
+	go func() {
+		for _, f := range frames {
+			if _, err := client.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+	replies := make(chan []string)
+	go func() {
+		var got []string
+		for {
+			opcode, payload, _, err := readServerFrame(client)
+			if err != nil {
+				replies <- got
+				return
+			}
+			got = append(got, describe(opcode, payload))
+		}
+	}()
+
+	opcode, msg, err := c.ReadMessage()
+	c.Close()
+	return opcode, msg, <-replies, err
+}
+
+func TestWebSocketReadMessage(t *testing.T) {
+	big := strings.Repeat("x", 40*1024)
+	cases := []struct {
+		name    string
+		frames  [][]byte
+		opcode  byte // message expected unless err is set
+		msg     string
+		err     bool
+		replies []string // frames the server sends, ending with its close
+	}{
+		{
+			name:    "masked text",
+			frames:  [][]byte{frame(true, wsOpText, "hello")},
+			opcode:  wsOpText,
+			msg:     "hello",
+			replies: []string{"close 1000"},
+		},
+		{
+			name:    "unmasked frame",
+			frames:  [][]byte{clientFrame(true, wsOpText, []byte("hello"), false, 0)},
+			err:     true,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "reserved bits",
+			frames:  [][]byte{append([]byte{0xC1}, frame(true, wsOpText, "x")[1:]...)},
+			err:     true,
+			replies: []string{"close 1002"},
+		},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				frame(false, wsOpBinary, "ab"),
+				frame(false, wsOpContinuation, "cd"),
+				frame(true, wsOpContinuation, "ef"),
+			},
+			opcode:  wsOpBinary,
+			msg:     "abcdef",
+			replies: []string{"close 1000"},
+		},
+		{
+			name: "ping between fragments",
+			frames: [][]byte{
+				frame(false, wsOpText, "he"),
+				frame(true, wsOpPing, "p"),
+				frame(true, wsOpContinuation, "llo"),
+			},
+			opcode:  wsOpText,
+			msg:     "hello",
+			replies: []string{"0xa p", "close 1000"},
+		},
+		{
+			name: "pong between fragments",
+			frames: [][]byte{
+				frame(false, wsOpText, "he"),
+				frame(true, wsOpPong, "p"),
+				frame(true, wsOpContinuation, "llo"),
+			},
+			opcode:  wsOpText,
+			msg:     "hello",
+			replies: []string{"close 1000"},
+		},
+		{
+			name: "close between fragments",
+			frames: [][]byte{
+				frame(false, wsOpText, "he"),
+				frame(true, wsOpClose, "\x03\xe9"),
+			},
+			err:     true,
+			replies: []string{"close 1001"},
+		},
+		{
+			name:    "fragmented ping",
+			frames:  [][]byte{frame(false, wsOpPing, "p")},
+			err:     true,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "continuation first",
+			frames:  [][]byte{frame(true, wsOpContinuation, "x")},
+			err:     true,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "new message inside a fragmented one",
+			frames:  [][]byte{frame(false, wsOpText, "a"), frame(true, wsOpText, "b")},
+			err:     true,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "unknown opcode",
+			frames:  [][]byte{frame(true, 0x3, "x")},
+			err:     true,
+			replies: []string{"close 1002"},
+		},
+		{
+			name:    "16-bit length",
+			frames:  [][]byte{clientFrame(true, wsOpBinary, []byte(big[:300]), true, 2)},
+			opcode:  wsOpBinary,
+			msg:     big[:300],
+			replies: []string{"close 1000"},
+		},
+		{
+			name:    "64-bit length",
+			frames:  [][]byte{clientFrame(true, wsOpBinary, []byte(big[:1000]), true, 8)},
+			opcode:  wsOpBinary,
+			msg:     big[:1000],
+			replies: []string{"close 1000"},
+		},
+		{
+			name:    "frame over the size limit",
+			frames:  [][]byte{clientFrame(true, wsOpBinary, make([]byte, wsMaxMessageSize+1), true, 8)},
+			err:     true,
+			replies: []string{"close 1009"},
+		},
+		{
+			name:    "fragments over the size limit",
+			frames:  [][]byte{frame(false, wsOpBinary, big), frame(true, wsOpContinuation, big)},
+			err:     true,
+			replies: []string{"close 1009"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opcode, msg, replies, err := readOver(tc.frames)
+			if tc.err {
+				if err == nil {
+					t.Errorf("read %q, want an error", msg)
+				}
+			} else if err != nil || opcode != tc.opcode || string(msg) != tc.msg {
+				t.Errorf("read 0x%x %.20q, %v; want 0x%x %.20q", opcode, msg, err, tc.opcode, tc.msg)
+			}
+			if fmt.Sprint(replies) != fmt.Sprint(tc.replies) {
+				t.Errorf("server sent %q, want %q", replies, tc.replies)
+			}
+		})
+	}
+}
+
+func TestWebSocketWriteLengths(t *testing.T) {
+	for _, tc := range []struct{ size, extended int }{{0, 0}, {125, 0}, {126, 2}, {65535, 2}, {65536, 8}, {100000, 8}} {
+		server, client := net.Pipe()
+		c := &wsConn{conn: server, br: bufio.NewReader(server)}
+		payload := bytes.Repeat([]byte{0x5a}, tc.size)
+		go c.WriteMessage(wsOpBinary, payload)
+
+		opcode, got, extended, err := readServerFrame(client)
+		if err != nil || opcode != wsOpBinary || !bytes.Equal(got, payload) || extended != tc.extended {
+			t.Errorf("%d bytes: read 0x%x, %d bytes with a %d byte length, %v; want %d byte length",
+				tc.size, opcode, len(got), extended, err, tc.extended)
+		}
+		server.Close()
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		c.WriteMessage(wsOpText, []byte("hi"))
+		c.Close()
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The key and accept value from RFC 6455 section 1.3
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake response %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	if opcode, payload, _, err := readServerFrame(br); err != nil || describe(opcode, payload) != "0x1 hi" {
+		t.Errorf("first frame %s, %v", describe(opcode, payload), err)
+	}
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	upgrade := http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"Upgrade"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		"Sec-Websocket-Version": {"13"},
+	}
+	with := func(name, value string) http.Header {
+		h := upgrade.Clone()
+		h.Set(name, value)
+		return h
+	}
+	cases := []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+	}{
+		{"POST", http.MethodPost, upgrade, http.StatusMethodNotAllowed},
+		{"plain request", http.MethodGet, with("Upgrade", ""), http.StatusBadRequest},
+		{"no connection upgrade", http.MethodGet, with("Connection", "keep-alive"), http.StatusBadRequest},
+		{"version 8", http.MethodGet, with("Sec-WebSocket-Version", "8"), http.StatusUpgradeRequired},
+		{"no key", http.MethodGet, with("Sec-WebSocket-Key", ""), http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, "/ws", nil)
+		req.Header = tc.header
+		if c, err := upgradeWebSocket(rec, req); c != nil || err == nil || rec.Code != tc.status {
+			t.Errorf("%s: status %d, %v; want %d", tc.name, rec.Code, err, tc.status)
+		}
+	}
+}